@@ -6,6 +6,7 @@ import (
 	"container/list"
 	"fmt"
 	"math/big"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,6 +16,7 @@ import (
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcwallet/waddrmgr"
 )
 
 const (
@@ -35,14 +37,11 @@ const (
 	// maxTimeOffset is the maximum duration a block time is allowed to be
 	// ahead of the curent time. This is currently 2 hours.
 	maxTimeOffset = 2 * time.Hour
-)
 
-// TODO: Redo this using query API.
-var (
-	// WaitForMoreCFHeaders is a configurable time to wait for CFHeaders
-	// messages from peers. It defaults to 3 seconds but can be increased
-	// for higher security and decreased for faster synchronization.
-	WaitForMoreCFHeaders = 3 * time.Second
+	// medianTimeBlocks is the number of previous blocks which should be
+	// used to calculate the median time used to validate block
+	// timestamps.
+	medianTimeBlocks = 11
 )
 
 // zeroHash is the zero value hash (all zeros).  It is defined as a convenience.
@@ -72,23 +71,10 @@ type invMsg struct {
 type headersMsg struct {
 	headers *wire.MsgHeaders
 	peer    *serverPeer
-}
 
-// cfheadersMsg packages a bitcoin cfheaders message and the peer it came from
-// together so the block handler has access to that information.
-type cfheadersMsg struct {
-	cfheaders *wire.MsgCFHeaders
-	peer      *serverPeer
-}
-
-// cfheadersProcessedMsg tells the block manager to try to see if there are
-// enough samples of cfheaders messages to process the committed filter header
-// chain. This is kind of a hack until these get soft-forked in, but we do
-// verification to avoid getting bamboozled by malicious nodes.
-type processCFHeadersMsg struct {
-	earliestNode *headerNode
-	stopHash     chainhash.Hash
-	extended     bool
+	// prefetched is set for headers that were downloaded by the parallel
+	// header fetcher rather than requested by the block manager itself.
+	prefetched bool
 }
 
 // donePeerMsg signifies a newly disconnected peer to the block handler.
@@ -131,25 +117,52 @@ type blockManager struct {
 	// peerChan is a channel for messages that come from peers
 	peerChan chan interface{}
 
-	// intChan is a channel for messages that come from internal commands
-	intChan chan interface{}
-
 	wg   sync.WaitGroup
 	quit chan struct{}
 
 	headerList     *list.List
-	reorgList      *list.List
-	startHeader    *list.Element
 	nextCheckpoint *chaincfg.Checkpoint
 	lastRequested  chainhash.Hash
 
-	basicHeaders            map[chainhash.Hash]map[chainhash.Hash][]*serverPeer
-	lastBasicCFHeaderHeight int32
-	numBasicCFHeadersMsgs   int32
-	extendedHeaders         map[chainhash.Hash]map[chainhash.Hash][]*serverPeer
-	lastExtCFHeaderHeight   int32
-	numExtCFHeadersMsgs     int32
-	mapMutex                sync.Mutex
+	// headerFetcher is non-nil while the checkpointed part of the header
+	// chain is being downloaded from several peers in parallel. While it
+	// runs, the block manager doesn't request headers itself.
+	headerFetcher *headerFetcher
+
+	// sideChains holds the forks of the header chain we're tracking that
+	// don't have more work than our chain.
+	sideChains []*sideChain
+
+	// lastCFHeaderHeights holds the height up to which the filter header
+	// chain of each filter type has been synced. The heights must only be
+	// used atomically.
+	lastCFHeaderHeights map[*FilterType]*int32
+
+	// cfHeadersSignal wakes up the cfheader sync when new block headers
+	// have been written.
+	cfHeadersSignal chan struct{}
+
+	// suspectCFHeaders holds, for each filter type, the lowest height of
+	// a block that turned out not to match our filter headers, and whose
+	// filter headers the cfheader sync has yet to check again. It's
+	// guarded by suspectMtx.
+	suspectCFHeaders map[*FilterType]int32
+	suspectMtx       sync.Mutex
+
+	// cfilterMismatches holds, for each filter type, the filters our
+	// peers sent us that didn't match our filter headers, until the
+	// cfheader sync has checked the filter headers again. It's guarded by
+	// suspectMtx.
+	cfilterMismatches map[*FilterType][]*cfilterMismatch
+
+	// syncRate estimates how fast we're syncing for the sync progress,
+	// and progressSubs holds the subscriptions to sync progress updates.
+	syncRate     syncRateEstimator
+	progressSubs syncProgressSubscriptions
+
+	// syncPeerProgress is when the sync peer was chosen or last sent us
+	// headers. It's used to detect a stalled sync peer.
+	syncPeerProgress time.Time
 
 	minRetargetTimespan int64 // target timespan / adjustment factor
 	maxRetargetTimespan int64 // target timespan * adjustment factor
@@ -168,19 +181,19 @@ func newBlockManager(s *ChainService) (*blockManager, error) {
 		requestedBlocks:     make(map[chainhash.Hash]struct{}),
 		peerChan:            make(chan interface{}, MaxPeers*3),
 		progressLogger:      newBlockProgressLogger("Processed", log),
-		intChan:             make(chan interface{}, 1),
+		cfHeadersSignal:     make(chan struct{}, 1),
+		suspectCFHeaders:    make(map[*FilterType]int32),
+		cfilterMismatches:   make(map[*FilterType][]*cfilterMismatch),
 		headerList:          list.New(),
-		reorgList:           list.New(),
 		quit:                make(chan struct{}),
 		blocksPerRetarget:   int32(targetTimespan / targetTimePerBlock),
 		minRetargetTimespan: targetTimespan / adjustmentFactor,
 		maxRetargetTimespan: targetTimespan * adjustmentFactor,
-		basicHeaders: make(
-			map[chainhash.Hash]map[chainhash.Hash][]*serverPeer,
-		),
-		extendedHeaders: make(
-			map[chainhash.Hash]map[chainhash.Hash][]*serverPeer,
-		),
+	}
+
+	bm.lastCFHeaderHeights = make(map[*FilterType]*int32)
+	for _, filterType := range filterTypes {
+		bm.lastCFHeaderHeights[filterType] = new(int32)
 	}
 
 	// Initialize the next checkpoint based on the current height.
@@ -202,8 +215,9 @@ func (b *blockManager) Start() {
 	}
 
 	log.Trace("Starting block manager")
-	b.wg.Add(1)
+	b.wg.Add(2)
 	go b.blockHandler()
+	go b.cfHandler()
 }
 
 // Stop gracefully shuts down the block manager by stopping all asynchronous
@@ -279,6 +293,9 @@ func (b *blockManager) handleDonePeerMsg(peers *list.List, sp *serverPeer) {
 
 	log.Infof("Lost peer %s", sp)
 
+	// We won't get the ancestors of any orphan headers from it now.
+	b.removePeerOrphans(sp)
+
 	// Attempt to find a new peer to sync from if the quitting peer is the
 	// sync peer.  Also, reset the header state.
 	if b.syncPeer != nil && b.syncPeer == sp {
@@ -302,24 +319,10 @@ func (b *blockManager) handleDonePeerMsg(peers *list.List, sp *serverPeer) {
 // the fetching should proceed.
 func (b *blockManager) blockHandler() {
 	candidatePeers := list.New()
+	stallTicker := time.NewTicker(syncPeerCheckInterval)
+	defer stallTicker.Stop()
 out:
 	for {
-		// Check internal messages channel first and continue if
-		// there's nothing to process.
-		select {
-		case m := <-b.intChan:
-			switch msg := m.(type) {
-			case *processCFHeadersMsg:
-				b.handleProcessCFHeadersMsg(msg)
-
-			default:
-				log.Warnf("Invalid message type in block "+
-					"handler: %T", msg)
-			}
-		default:
-		}
-
-		// Now check peer messages and quit channels.
 		select {
 		case m := <-b.peerChan:
 			switch msg := m.(type) {
@@ -330,27 +333,43 @@ out:
 				b.handleInvMsg(msg)
 
 			case *headersMsg:
-				b.handleHeadersMsg(msg)
-
-			case *cfheadersMsg:
-				b.handleCFHeadersMsg(msg)
+				b.handleHeadersMsg(candidatePeers, msg)
 
 			case *donePeerMsg:
 				b.handleDonePeerMsg(candidatePeers, msg.peer)
 
+			case *headerFetchDoneMsg:
+				b.handleHeaderFetchDoneMsg()
+
 			case isCurrentMsg:
 				msg.reply <- b.current()
 
+			case syncProgressMsg:
+				msg.reply <- b.syncProgress(candidatePeers)
+
 			default:
 				log.Warnf("Invalid message type in block "+
 					"handler: %T", msg)
 			}
 
+		case <-stallTicker.C:
+			b.checkSyncPeer(candidatePeers)
+			b.pruneSideChains()
+
 		case <-b.quit:
 			break out
 		}
+
+		// Let any subscribers know if we've made progress.
+		if b.progressSubs.active() {
+			b.progressSubs.notify(b.syncProgress(candidatePeers))
+		}
 	}
 
+	// There won't be any more progress updates, so subscribers can stop
+	// waiting for them.
+	b.progressSubs.closeAll()
+
 	b.wg.Done()
 	log.Trace("Block handler done")
 }
@@ -428,29 +447,12 @@ func (b *blockManager) findPreviousHeaderCheckpoint(height int32) *chaincfg.Chec
 func (b *blockManager) resetHeaderState(newestHeader *wire.BlockHeader,
 	newestHeight int32) {
 	b.headerList.Init()
-	b.startHeader = nil
-	b.mapMutex.Lock()
-	b.basicHeaders = make(
-		map[chainhash.Hash]map[chainhash.Hash][]*serverPeer,
-	)
-	b.extendedHeaders = make(
-		map[chainhash.Hash]map[chainhash.Hash][]*serverPeer,
-	)
-	b.mapMutex.Unlock()
 
 	// Add an entry for the latest known block into the header pool.
 	// This allows the next downloaded header to prove it links to the chain
 	// properly.
 	node := headerNode{header: newestHeader, height: newestHeight}
 	b.headerList.PushBack(&node)
-	b.mapMutex.Lock()
-	b.basicHeaders[newestHeader.BlockHash()] = make(
-		map[chainhash.Hash][]*serverPeer,
-	)
-	b.extendedHeaders[newestHeader.BlockHash()] = make(
-		map[chainhash.Hash][]*serverPeer,
-	)
-	b.mapMutex.Unlock()
 }
 
 // startSync will choose the best peer among the available candidate peers to
@@ -469,7 +471,6 @@ func (b *blockManager) startSync(peers *list.List) {
 			"latest block: %s", err)
 		return
 	}
-	var bestPeer *serverPeer
 	var enext *list.Element
 	for e := peers.Front(); e != nil; e = enext {
 		enext = e.Next()
@@ -485,16 +486,14 @@ func (b *blockManager) startSync(peers *list.List) {
 		// during regression test.
 		if sp.LastBlock() < best.Height {
 			peers.Remove(e)
-			continue
-		}
-
-		// TODO: Use a better algorithm to choose the best peer.
-		// For now, just pick the candidate with the highest last block.
-		if bestPeer == nil || sp.LastBlock() > bestPeer.LastBlock() {
-			bestPeer = sp
 		}
 	}
 
+	// Pick the candidate with the best score, taking into account its
+	// height, how quickly it responds, how well it has behaved and how
+	// many other candidates share its network group.
+	bestPeer := bestSyncPeer(peers)
+
 	// Start syncing from the best peer if one was selected.
 	if bestPeer != nil {
 		// Clear the requestedBlocks if the sync peer changes,
@@ -532,8 +531,16 @@ func (b *blockManager) startSync(peers *list.List) {
 		b.syncPeerMutex.Lock()
 		b.syncPeer = bestPeer
 		b.syncPeerMutex.Unlock()
+		b.syncPeerProgress = time.Now()
 		if b.nextCheckpoint != nil && best.Height < b.nextCheckpoint.Height {
 
+			// If we can, download the headers between the
+			// remaining checkpoints from several peers at once
+			// instead of just the sync peer.
+			if b.startHeaderFetch(peers, best) {
+				return
+			}
+
 			b.syncPeer.PushGetHeadersMsg(locator, b.nextCheckpoint.Hash)
 			log.Infof("Downloading headers for blocks %d to "+
 				"%d from peer %s", best.Height+1,
@@ -550,6 +557,80 @@ func (b *blockManager) startSync(peers *list.List) {
 	}
 }
 
+// startHeaderFetch starts downloading the checkpointed part of the header
+// chain from several candidate peers in parallel. It returns true if a
+// parallel fetch is running, in which case the caller shouldn't request
+// headers from the sync peer, and false if parallel download isn't possible
+// or worthwhile.
+func (b *blockManager) startHeaderFetch(peers *list.List,
+	best *waddrmgr.BlockStamp) bool {
+
+	// If we're already fetching, there's nothing more to do.
+	if b.headerFetcher != nil {
+		return true
+	}
+
+	if MaxParallelHeaderPeers < 2 {
+		return false
+	}
+
+	// Only consider peers that know about at least the next checkpoint,
+	// since they can't serve any of the ranges otherwise.
+	var fetchPeers []*serverPeer
+	for e := peers.Front(); e != nil; e = e.Next() {
+		sp := e.Value.(*serverPeer)
+		if sp.LastBlock() < b.nextCheckpoint.Height {
+			continue
+		}
+		fetchPeers = append(fetchPeers, sp)
+		if len(fetchPeers) == MaxParallelHeaderPeers {
+			break
+		}
+	}
+
+	// With a single peer or a single range, we can't do any better than
+	// a serial sync.
+	ranges := b.checkpointRanges(best)
+	if len(fetchPeers) < 2 || len(ranges) < 2 {
+		return false
+	}
+
+	log.Infof("Downloading headers for blocks %d to %d in %d ranges "+
+		"from %d peers", best.Height+1, ranges[len(ranges)-1].endHeight,
+		len(ranges), len(fetchPeers))
+
+	b.headerFetcher = newHeaderFetcher(b, ranges, fetchPeers)
+	b.headerFetcher.start()
+	return true
+}
+
+// handleHeaderFetchDoneMsg handles the end of a parallel header fetch. Any
+// headers past the point the fetcher got to, including those past the final
+// checkpoint, are requested serially from the sync peer.
+func (b *blockManager) handleHeaderFetchDoneMsg() {
+	b.headerFetcher = nil
+
+	if b.syncPeer == nil {
+		return
+	}
+
+	locator, err := b.server.LatestBlockLocator()
+	if err != nil {
+		log.Errorf("Failed to get block locator for the latest "+
+			"block: %s", err)
+		return
+	}
+	nextHash := zeroHash
+	if b.nextCheckpoint != nil {
+		nextHash = *b.nextCheckpoint.Hash
+	}
+	err = b.syncPeer.PushGetHeadersMsg(locator, &nextHash)
+	if err != nil {
+		log.Warnf("Failed to send getheaders message to peer %s: %s",
+			b.syncPeer.Addr(), err)
+	}
+}
+
 // current returns true if we believe we are synced with our peers, false if we
 // still have blocks to check
 func (b *blockManager) current() bool {
@@ -649,8 +730,10 @@ func (b *blockManager) handleInvMsg(imsg *invMsg) {
 	}
 
 	// If this is the sync peer or we're current, get the headers for the
-	// announced blocks and update the last announced block.
-	if lastBlock != -1 && (imsg.peer == b.syncPeer || b.current()) {
+	// announced blocks and update the last announced block. While the
+	// parallel header fetcher is running, it takes care of this for us.
+	if lastBlock != -1 && b.headerFetcher == nil &&
+		(imsg.peer == b.syncPeer || b.current()) {
 		lastEl := b.headerList.Back()
 		var lastHash chainhash.Hash
 		if lastEl != nil {
@@ -699,15 +782,34 @@ func (b *blockManager) QueueHeaders(headers *wire.MsgHeaders, sp *serverPeer) {
 	b.peerChan <- &headersMsg{headers: headers, peer: sp}
 }
 
-// handleHeadersMsg handles headers messages from all peers.
-func (b *blockManager) handleHeadersMsg(hmsg *headersMsg) {
+// handleHeadersMsg handles headers messages from all peers, both in response
+// to our getheaders requests and unsolicited announcements of new blocks from
+// peers we've sent sendheaders to. The passed list of candidate peers is used
+// to replace the sync peer if it can't deliver the headers it advertised.
+func (b *blockManager) handleHeadersMsg(peers *list.List, hmsg *headersMsg) {
 	msg := hmsg.headers
 	numHeaders := len(msg.Headers)
 
-	// Nothing to do for an empty headers message.
+	// Nothing to do for an empty headers message, unless it's from the
+	// sync peer while we're still behind the height it advertised, in
+	// which case it can't deliver what it promised.
 	if numHeaders == 0 {
+		if hmsg.peer != b.syncPeer || hmsg.prefetched ||
+			b.headerFetcher != nil {
+			return
+		}
+		_, height, err := b.server.LatestBlock()
+		if err == nil && int32(height) < hmsg.peer.LastBlock() {
+			hmsg.peer.addBanScore(0, undeliveredHeightBanScore,
+				"advertised a height it can't deliver")
+			b.replaceSyncPeer(peers,
+				"advertised height not delivered")
+		}
 		return
 	}
+	if hmsg.peer == b.syncPeer {
+		b.syncPeerProgress = time.Now()
+	}
 
 	// For checking to make sure blocks aren't too far in the future as of
 	// the time we receive the headers message.
@@ -723,6 +825,7 @@ func (b *blockManager) handleHeadersMsg(hmsg *headersMsg) {
 	receivedCheckpoint := false
 	var finalHash *chainhash.Hash
 	var finalHeight int32
+	var sideHeaders []*wire.BlockHeader
 	for i, blockHeader := range msg.Headers {
 		blockHash := blockHeader.BlockHash()
 		finalHash = &blockHash
@@ -745,7 +848,7 @@ func (b *blockManager) handleHeadersMsg(hmsg *headersMsg) {
 		prevHash := prevNode.header.BlockHash()
 		if prevHash.IsEqual(&blockHeader.PrevBlock) {
 			err := b.checkHeaderSanity(blockHeader, maxTimestamp,
-				false)
+				b.headerList)
 			if err != nil {
 				log.Warnf("Header doesn't pass sanity check: "+
 					"%s -- disconnecting peer", err)
@@ -763,21 +866,7 @@ func (b *blockManager) handleHeadersMsg(hmsg *headersMsg) {
 			hmsg.peer.UpdateLastBlockHeight(node.height)
 			b.progressLogger.LogBlockHeight(blockHeader, node.height)
 
-			// Finally initialize the header ->
-			// map[filterHash]*peer map for filter header
-			// validation purposes later.
-			e := b.headerList.PushBack(&node)
-			b.mapMutex.Lock()
-			b.basicHeaders[node.header.BlockHash()] = make(
-				map[chainhash.Hash][]*serverPeer,
-			)
-			b.extendedHeaders[node.header.BlockHash()] = make(
-				map[chainhash.Hash][]*serverPeer,
-			)
-			b.mapMutex.Unlock()
-			if b.startHeader == nil {
-				b.startHeader = e
-			}
+			b.addHeaderNode(&node)
 		} else {
 			// The block doesn't connect to the last block we know.
 			// We will need to do some additional checks to process
@@ -788,9 +877,8 @@ func (b *blockManager) handleHeadersMsg(hmsg *headersMsg) {
 			// sync peer, they might not be aligned correctly or
 			// even on the right chain. Just ignore the rest of the
 			// message. However, if we're current, this might be a
-			// reorg, in which case we'll either change our sync
-			// peer or disconnect the peer that sent us these bad
-			// headers.
+			// reorg, in which case the side chain tracker will
+			// work out whether to switch to it.
 			if hmsg.peer != b.syncPeer && !b.current() {
 				return
 			}
@@ -809,164 +897,11 @@ func (b *blockManager) handleHeadersMsg(hmsg *headersMsg) {
 				continue
 			}
 
-			// Check if the previous block is known. If it is, this
-			// is probably a reorg based on the estimated latest
-			// block that matches between us and the peer as
-			// derived from the block locator we sent to request
-			// these headers. Otherwise, the headers don't connect
-			// to anything we know and we should disconnect the
-			// peer.
-			backHead, backHeight, err := b.server.GetBlockByHash(
-				blockHeader.PrevBlock)
-			if err != nil {
-				log.Warnf("Received block header that does not"+
-					" properly connect to the chain from"+
-					" peer %s (%s) -- disconnecting",
-					hmsg.peer.Addr(), err)
-				hmsg.peer.Disconnect()
-				return
-			}
-
-			// We've found a branch we weren't aware of. If the
-			// branch is earlier than the latest synchronized
-			// checkpoint, it's invalid and we need to disconnect
-			// the reporting peer.
-			prevCheckpoint := b.findPreviousHeaderCheckpoint(
-				prevNode.height)
-			if backHeight < uint32(prevCheckpoint.Height) {
-				log.Errorf("Attempt at a reorg earlier than a "+
-					"checkpoint past which we've already "+
-					"synchronized -- disconnecting peer "+
-					"%s", hmsg.peer.Addr())
-				hmsg.peer.Disconnect()
-				return
-			}
-
-			// Check the sanity of the new branch. If any of the
-			// blocks don't pass sanity checks, disconnect the
-			// peer.  We also keep track of the work represented by
-			// these headers so we can compare it to the work in
-			// the known good chain.
-			b.reorgList.Init()
-			b.reorgList.PushBack(&headerNode{
-				header: &backHead,
-				height: int32(backHeight),
-			})
-			totalWork := big.NewInt(0)
-			for j, reorgHeader := range msg.Headers[i:] {
-				err = b.checkHeaderSanity(reorgHeader,
-					maxTimestamp, true)
-				if err != nil {
-					log.Warnf("Header doesn't pass sanity"+
-						" check: %s -- disconnecting "+
-						"peer", err)
-					hmsg.peer.Disconnect()
-					return
-				}
-				totalWork.Add(totalWork,
-					blockchain.CalcWork(reorgHeader.Bits))
-				b.reorgList.PushBack(&headerNode{
-					header: reorgHeader,
-					height: int32(backHeight+1) + int32(j),
-				})
-			}
-			log.Tracef("Sane reorg attempted. Total work from "+
-				"reorg chain: %v", totalWork)
-
-			// All the headers pass sanity checks. Now we calculate
-			// the total work for the known chain.
-			knownWork := big.NewInt(0)
-
-			// This should NEVER be nil because the most recent
-			// block is always pushed back by resetHeaderState
-			knownEl := b.headerList.Back()
-			var knownHead wire.BlockHeader
-			for j := uint32(prevNode.height); j > backHeight; j-- {
-				if knownEl != nil {
-					knownHead = *knownEl.Value.(*headerNode).header
-					knownEl = knownEl.Prev()
-				} else {
-					knownHead, _, err = b.server.GetBlockByHash(
-						knownHead.PrevBlock)
-					if err != nil {
-						log.Criticalf("Can't get block"+
-							"header for hash %s: "+
-							"%v",
-							knownHead.PrevBlock,
-							err)
-						// Should we panic here?
-					}
-				}
-				knownWork.Add(knownWork,
-					blockchain.CalcWork(knownHead.Bits))
-			}
-
-			log.Tracef("Total work from known chain: %v", knownWork)
-
-			// Compare the two work totals and reject the new chain
-			// if it doesn't have more work than the previously
-			// known chain. Disconnect if it's actually less than
-			// the known chain.
-			switch knownWork.Cmp(totalWork) {
-			case 1:
-				log.Warnf("Reorg attempt that has less work "+
-					"than known chain from peer %s -- "+
-					"disconnecting", hmsg.peer.Addr())
-				hmsg.peer.Disconnect()
-				fallthrough
-			case 0:
-				return
-			default:
-			}
-
-			// At this point, we have a valid reorg, so we roll
-			// back the existing chain and add the new block
-			// header.  We also change the sync peer. Then we can
-			// continue with the rest of the headers in the message
-			// as if nothing has happened.
-			b.syncPeerMutex.Lock()
-			b.syncPeer = hmsg.peer
-			b.syncPeerMutex.Unlock()
-			_, err = b.server.rollBackToHeight(backHeight)
-			if err != nil {
-				log.Criticalf("Rollback failed: %s",
-					err)
-				// Should we panic here?
-			}
-
-			// TODO(roasbeef): should be atomic update
-			err = b.server.putBlock(*blockHeader, backHeight+1)
-			if err != nil {
-				log.Criticalf("Couldn't write block to "+
-					"database: %s", err)
-				// Should we panic here?
-			}
-			err = b.server.putMaxBlockHeight(backHeight + 1)
-			if err != nil {
-				log.Criticalf("Couldn't write max block height"+
-					" to database: %s", err)
-				// Should we panic here?
-			}
-
-			b.resetHeaderState(&backHead, int32(backHeight))
-			b.headerList.PushBack(&headerNode{
-				header: blockHeader,
-				height: int32(backHeight + 1),
-			})
-			b.mapMutex.Lock()
-			b.basicHeaders[blockHeader.BlockHash()] = make(
-				map[chainhash.Hash][]*serverPeer,
-			)
-			b.extendedHeaders[blockHeader.BlockHash()] = make(
-				map[chainhash.Hash][]*serverPeer,
-			)
-			b.mapMutex.Unlock()
-			if b.lastBasicCFHeaderHeight > int32(backHeight) {
-				b.lastBasicCFHeaderHeight = int32(backHeight)
-			}
-			if b.lastExtCFHeaderHeight > int32(backHeight) {
-				b.lastExtCFHeaderHeight = int32(backHeight)
-			}
+			// The rest of the message belongs to a fork of our
+			// chain. It's handed to the side chain tracker once
+			// we've written the headers that do extend our chain.
+			sideHeaders = msg.Headers[i:]
+			break
 		}
 
 		// Verify the header at the next checkpoint height matches.
@@ -1004,35 +939,27 @@ func (b *blockManager) handleHeadersMsg(hmsg *headersMsg) {
 		}
 	}
 
+	// Any headers that don't extend our chain are tracked as a side chain,
+	// which takes care of requesting whatever else it needs.
+	if len(sideHeaders) != 0 {
+		defer b.handleSideChainHeaders(hmsg.peer, sideHeaders,
+			maxTimestamp)
+	}
+
+	// If every header in the message was already known, there's nothing
+	// to write.
+	if len(headerWriteBatch) == 0 {
+		return
+	}
+
 	log.Tracef("Writing header batch of %v block headers",
 		len(headerWriteBatch))
 
 	// With all the headers in this batch validated, we'll write them all
 	// in a single transaction such that this entire batch is atomic.
-	tx, err := b.server.db.BeginReadWriteTx()
+	err := b.server.putBlockBatch(headerWriteBatch)
 	if err != nil {
-		panic(fmt.Sprintf("unable to start db transaction: %v", err))
-	}
-	bucket := tx.ReadWriteBucket(spvBucketName)
-
-	// With each of these headers validated, we'll store them in the
-	// database, marking the height of each entry.
-	for _, headerNode := range headerWriteBatch {
-		err := putBlock(*headerNode.header, uint32(headerNode.height))(bucket)
-		if err != nil {
-			tx.Rollback()
-			panic(fmt.Sprintf("unable to write block header: %v", err))
-		}
-	}
-
-	// Finally also record the current tip of our best known chain.
-	err = putMaxBlockHeight(uint32(finalHeight))(bucket)
-	if err != nil {
-		tx.Rollback()
-		panic(fmt.Sprintf("unable to update max height: %v", err))
-	}
-	if err := tx.Commit(); err != nil {
-		panic(fmt.Sprintf("unable to commit write batch: %v", err))
+		panic(fmt.Sprintf("unable to write header batch: %v", err))
 	}
 
 	// When this header is a checkpoint, switch to fetching the blocks for
@@ -1041,34 +968,23 @@ func (b *blockManager) handleHeadersMsg(hmsg *headersMsg) {
 		b.nextCheckpoint = b.findNextHeaderCheckpoint(finalHeight)
 	}
 
-	// Send getcfheaders to each peer based on these headers.
-	cfhLocator := blockchain.BlockLocator([]*chainhash.Hash{
-		&msg.Headers[0].PrevBlock,
-	})
-	cfhStopHash := msg.Headers[len(msg.Headers)-1].BlockHash()
-	cfhCount := len(msg.Headers)
-	cfhReqB := cfhRequest{
-		extended: false,
-		stopHash: cfhStopHash,
-	}
-	cfhReqE := cfhRequest{
-		extended: true,
-		stopHash: cfhStopHash,
-	}
-	b.server.ForAllPeers(func(sp *serverPeer) {
-		// Should probably use better isolation for this but we're in
-		// the same package. One of the things to clean up when we do
-		// more general cleanup.
-		sp.mtxReqCFH.Lock()
-		sp.requestedCFHeaders[cfhReqB] = cfhCount
-		sp.requestedCFHeaders[cfhReqE] = cfhCount
-		sp.mtxReqCFH.Unlock()
-		sp.pushGetCFHeadersMsg(cfhLocator, &cfhStopHash, false)
-		sp.pushGetCFHeadersMsg(cfhLocator, &cfhStopHash, true)
-	})
+	// Let the cfheader sync know there are new headers to fetch filter
+	// headers for. For headers announced to us through sendheaders, this
+	// is all it takes to get the filter headers for a new block.
+	b.signalCFHeaderSync()
 
 	// If not current, request the next batch of headers starting from the
-	// latest known header and ending with the next checkpoint.
+	// latest known header and ending with the next checkpoint. If the
+	// parallel header fetcher is running, it's already requesting the
+	// headers we need. Peers other than the sync peer may announce new
+	// blocks to us with headers while we're still syncing, but we leave
+	// the rest of the sync to the sync peer.
+	if b.headerFetcher != nil || hmsg.prefetched || len(sideHeaders) != 0 {
+		return
+	}
+	if hmsg.peer != b.syncPeer && !b.current() {
+		return
+	}
 	if !b.current() || b.server.chainParams.Net == chaincfg.SimNetParams.Net {
 
 		locator := blockchain.BlockLocator([]*chainhash.Hash{finalHash})
@@ -1087,353 +1003,134 @@ func (b *blockManager) handleHeadersMsg(hmsg *headersMsg) {
 	}
 }
 
-// QueueCFHeaders adds the passed headers message and peer to the block
-// handling queue.
-func (b *blockManager) QueueCFHeaders(cfheaders *wire.MsgCFHeaders,
-	sp *serverPeer) {
-
-	// No channel handling here because peers do not need to block on
-	// cfheaders messages.
-	if atomic.LoadInt32(&b.shutdown) != 0 {
-		return
-	}
-
-	// Ignore messages with 0 headers.
-	if len(cfheaders.HeaderHashes) == 0 {
-		return
+// addHeaderNode adds a validated header that extends our chain to the header
+// list. Only the headers needed to validate the difficulty of the ones that
+// follow are kept in the list, as older ones can be read from the database.
+func (b *blockManager) addHeaderNode(node *headerNode) {
+	b.headerList.PushBack(node)
+	if b.headerList.Len() > int(b.blocksPerRetarget) {
+		b.headerList.Remove(b.headerList.Front())
 	}
+}
 
-	// Check that the count is correct. This works even when the map lookup
-	// fails as it returns 0 in that case.
-	req := cfhRequest{
-		extended: cfheaders.Extended,
-		stopHash: cfheaders.StopHash,
-	}
-	// TODO: Get rid of this by refactoring all of this using the query API
-	sp.mtxReqCFH.Lock()
-	expLen := sp.requestedCFHeaders[req]
-	sp.mtxReqCFH.Unlock()
-	if expLen != len(cfheaders.HeaderHashes) {
-		log.Warnf("Received cfheaders message doesn't match any "+
-			"getcfheaders request. Peer %s is probably on a "+
-			"different chain -- ignoring", sp.Addr())
-		return
+// checkHeaderSanity checks the PoW, timestamp and version of a block header.
+// The passed list must end with the header's parent.
+func (b *blockManager) checkHeaderSanity(blockHeader *wire.BlockHeader,
+	maxTimestamp time.Time, hList *list.List) error {
+	diff, err := b.calcNextRequiredDifficulty(
+		blockHeader.Timestamp, hList)
+	if err != nil {
+		return err
 	}
-	// TODO: Remove this by refactoring this section into a query client.
-	sp.mtxReqCFH.Lock()
-	delete(sp.requestedCFHeaders, req)
-	sp.mtxReqCFH.Unlock()
-
-	// Track number of pending cfheaders messsages for both basic and
-	// extended filters.
-	pendingMsgs := &b.numBasicCFHeadersMsgs
-	if cfheaders.Extended {
-		pendingMsgs = &b.numExtCFHeadersMsgs
+	stubBlock := btcutil.NewBlock(&wire.MsgBlock{
+		Header: *blockHeader,
+	})
+	err = blockchain.CheckProofOfWork(stubBlock,
+		blockchain.CompactToBig(diff))
+	if err != nil {
+		return err
 	}
-	atomic.AddInt32(pendingMsgs, 1)
-	b.peerChan <- &cfheadersMsg{cfheaders: cfheaders, peer: sp}
-}
-
-// handleCFHeadersMsg handles cfheaders messages from all peers.
-// TODO: Refactor this using query API.
-func (b *blockManager) handleCFHeadersMsg(cfhmsg *cfheadersMsg) {
-	// Grab the matching request we sent, as this message should correspond
-	// to that, and delete it from the map on return as we're now handling
-	// it.
-	headerMap := b.basicHeaders
-	pendingMsgs := &b.numBasicCFHeadersMsgs
-	if cfhmsg.cfheaders.Extended {
-		headerMap = b.extendedHeaders
-		pendingMsgs = &b.numExtCFHeadersMsgs
-	}
-	atomic.AddInt32(pendingMsgs, -1)
-	headerList := cfhmsg.cfheaders.HeaderHashes
-	respLen := len(headerList)
-
-	// Find the block header matching the last filter header, if any.
-	el := b.headerList.Back()
-	for el != nil {
-		if el.Value.(*headerNode).header.BlockHash() ==
-			cfhmsg.cfheaders.StopHash {
-			break
-		}
-		el = el.Prev()
+	// Ensure the block time is not too far in the future.
+	if blockHeader.Timestamp.After(maxTimestamp) {
+		return fmt.Errorf("block timestamp of %v is too far in the "+
+			"future", blockHeader.Timestamp)
 	}
 
-	// If nothing matched, there's nothing more to do.
-	if el == nil {
-		return
+	// The rest of the checks depend on where the header is in the chain.
+	prevNodeEl := hList.Back()
+	if prevNodeEl == nil {
+		return nil
 	}
+	prevNode := prevNodeEl.Value.(*headerNode)
+	height := prevNode.height + 1
 
-	// Cycle through the filter header hashes and process them.
-	var node *headerNode
-	var hash chainhash.Hash
-	for i := respLen - 1; i >= 0 && el != nil; i-- {
-		// If there's no map for this header, the header is either no
-		// longer valid or has already been processed and committed to
-		// the database. Either way, break processing.
-		node = el.Value.(*headerNode)
-		hash = node.header.BlockHash()
-		b.mapMutex.Lock()
-		if _, ok := headerMap[hash]; !ok {
-			b.mapMutex.Unlock()
-			log.Tracef("Breaking at %d (%s)", node.height, hash)
-			break
-		}
-
-		// Process this header and set up the next iteration.
-		headerMap[hash][*headerList[i]] = append(
-			headerMap[hash][*headerList[i]], cfhmsg.peer,
-		)
-		b.mapMutex.Unlock()
-		el = el.Prev()
+	// Ensure the timestamp is after the median time of the last several
+	// blocks.
+	medianTime, err := b.calcPastMedianTime(hList)
+	if err != nil {
+		return err
 	}
-
-	b.intChan <- &processCFHeadersMsg{
-		earliestNode: node,
-		stopHash:     cfhmsg.cfheaders.StopHash,
-		extended:     cfhmsg.cfheaders.Extended,
+	if !blockHeader.Timestamp.After(medianTime) {
+		return fmt.Errorf("block timestamp of %v is not after "+
+			"expected %v", blockHeader.Timestamp, medianTime)
 	}
 
-	log.Tracef("Processed cfheaders starting at %d(%s), ending at %s, from"+
-		" peer %s, extended: %t", node.height, node.header.BlockHash(),
-		cfhmsg.cfheaders.StopHash, cfhmsg.peer.Addr(),
-		cfhmsg.cfheaders.Extended)
+	return checkBlockVersion(blockHeader.Version, height,
+		&b.server.chainParams)
 }
 
-// handleProcessCFHeadersMsg checks to see if we have enough cfheaders to make
-// a decision about what the correct headers are, makes that decision if
-// possible, and downloads any cfilters and blocks necessary to make that
-// decision.
-//
-// TODO: Refactor this using query API.
-func (b *blockManager) handleProcessCFHeadersMsg(msg *processCFHeadersMsg) {
-	// Assume we aren't ready to make a decision about correct headers yet.
-	ready := false
-
-	headerMap := b.basicHeaders
-	writeFunc := putBasicHeader
-	readFunc := b.server.GetBasicHeader
-	lastCFHeaderHeight := &b.lastBasicCFHeaderHeight
-	pendingMsgs := &b.numBasicCFHeadersMsgs
-	if msg.extended {
-		headerMap = b.extendedHeaders
-		writeFunc = putExtHeader
-		readFunc = b.server.GetExtHeader
-		lastCFHeaderHeight = &b.lastExtCFHeaderHeight
-		pendingMsgs = &b.numExtCFHeadersMsgs
-	}
-
-	stopHash := msg.earliestNode.header.PrevBlock
-
-	// If we have started receiving cfheaders messages for blocks farther
-	// than the last set we haven't made a decision on, it's time to make a
-	// decision.
-	if msg.earliestNode.height > *lastCFHeaderHeight+1 {
-		ready = true
-	}
-
-	// If we have fewer processed cfheaders messages for the earliest node
-	// than the number of connected peers, give the other peers some time
-	// to catch up before checking if we've processed all of the queued
-	// cfheaders messages.
-	numHeaders := 0
-	blockMap := headerMap[msg.earliestNode.header.BlockHash()]
-	for headerHash := range blockMap {
-		numHeaders += len(blockMap[headerHash])
-	}
-
-	// Sleep for a bit if we have more peers than cfheaders messages for
-	// the earliest node for which we're trying to get cfheaders. This lets
-	// us wait for other peers to send cfheaders messages before making any
-	// decisions about whether we should write the headers in this message.
-	connCount := int(b.server.ConnectedCount())
-	log.Tracef("Number of peers for which we've processed a cfheaders for "+
-		"block %s: %d of %d", msg.earliestNode.header.BlockHash(),
-		numHeaders, connCount)
-	if numHeaders < connCount {
-		log.Infof("waiting for more")
-		time.Sleep(WaitForMoreCFHeaders)
-	}
-
-	// If there are no other cfheaders messages left for this type (basic vs
-	// extended), we should go ahead and make a decision because we have all
-	// the info we're going to get.
-	if atomic.LoadInt32(pendingMsgs) == 0 {
-		ready = true
-		stopHash = msg.stopHash
-	}
-
-	// Do nothing if we're not ready to make a decision yet.
-	if !ready {
-		return
-	}
+// checkBlockVersion rejects outdated block versions once a majority of the
+// network has upgraded, as marked by the activation heights of BIP0034,
+// BIP0066 and BIP0065.
+func checkBlockVersion(version int32, height int32,
+	params *chaincfg.Params) error {
 
-	type headerTriple struct {
-		headerHash chainhash.Hash
-		filterHash chainhash.Hash
-		header     *wire.BlockHeader
-	}
-	var headerWriteBatch []headerTriple
+	if version < 2 && height >= params.BIP0034Height ||
+		version < 3 && height >= params.BIP0066Height ||
+		version < 4 && height >= params.BIP0065Height {
 
-	// At this point, we've got all the cfheaders messages we're going to
-	// get for the range of headers described by the passed message. We now
-	// iterate through all of those headers, looking for conflicts. If we
-	// find a conflict, we have to do additional checks; otherwise, we
-	// write the filter header to the database.
-	el := b.headerList.Front()
-	for el != nil {
-		node := el.Value.(*headerNode)
-		header := node.header
-		hash := header.BlockHash()
-		if node.height > *lastCFHeaderHeight {
-			b.mapMutex.Lock()
-			blockMap := headerMap[hash]
-			switch len(blockMap) {
-			// This should only happen if the filter has already
-			// been written to the database.
-			case 0:
-				if _, err := readFunc(hash); err != nil {
-					// We don't have the filter stored in
-					// the DB, there's something wrong.
-					log.Warnf("Somehow we have 0 cfheaders"+
-						" for block %d (%s)",
-						node.height, hash)
-					b.mapMutex.Unlock()
-					return
-				}
+		return fmt.Errorf("new blocks with version %d are no longer "+
+			"valid at height %d", version, height)
+	}
+	return nil
+}
 
-			// This is the normal case when nobody's trying to
-			// bamboozle us (or ALL our peers are).
-			case 1:
-				// This will only cycle once
-				for headerHash := range blockMap {
-					log.Tracef("Accepted header for block %d "+
-						"with %d cfheaders messages, "+
-						"extended: %t", node.height,
-						len(blockMap[headerHash]),
-						msg.extended)
-
-					// Add the accepted header to the current write batch.
-					headerWriteBatch = append(headerWriteBatch,
-						headerTriple{
-							headerHash: hash,
-							filterHash: headerHash,
-							header:     header,
-						})
+// calcPastMedianTime calculates the median time of the last
+// medianTimeBlocks blocks ending with the last header in the passed list.
+// Headers before the start of the list are read from the database.
+func (b *blockManager) calcPastMedianTime(hList *list.List) (time.Time,
+	error) {
 
-				}
-				*lastCFHeaderHeight = node.height
-			// This is when we have conflicting information from
-			// multiple peers.
-			// TODO: Handle this case as an adversarial condition.
-			default:
-				log.Warnf("Got more than 1 possible filter "+
-					"header for block %d (%s)", node.height,
-					node.header.BlockHash())
+	timestamps := make([]int64, 0, medianTimeBlocks)
+	el := hList.Back()
+	height := el.Value.(*headerNode).height
+	for len(timestamps) < medianTimeBlocks && height >= 0 {
+		if el != nil {
+			node := el.Value.(*headerNode)
+			timestamps = append(timestamps,
+				node.header.Timestamp.Unix())
+			el = el.Prev()
+		} else {
+			header, err := b.server.GetBlockByHeight(uint32(height))
+			if err != nil {
+				return time.Time{}, err
 			}
-			b.mapMutex.Unlock()
+			timestamps = append(timestamps, header.Timestamp.Unix())
 		}
-
-		//elToRemove := el
-		el = el.Next()
-		//b.headerList.Remove(elToRemove)
-		//b.startHeader = el
-
-		// If we've reached the end, we can exit and write out batch
-		// (if any).
-		if hash == stopHash {
-			log.Tracef("Finished processing cfheaders messages up "+
-				"to height %d/hash %s, extended: %t",
-				node.height, hash, msg.extended)
-			break
-		}
-	}
-
-	log.Tracef("Writing fitler batch of %v filter headers",
-		len(headerWriteBatch))
-
-	// With all the headers in this batch validated, we'll write them all
-	// in a single transaction such that this entire batch is atomic.
-	tx, err := b.server.db.BeginReadWriteTx()
-	if err != nil {
-		tx.Rollback()
-		panic(fmt.Sprintf("unable to start db transaction: %v", err))
+		height--
 	}
-	bucket := tx.ReadWriteBucket(spvBucketName)
 
-	// Writ eeach of the new headers to the database with their proper
-	// filter hash and header hash.
-	for _, headerGroup := range headerWriteBatch {
-		err := writeFunc(headerGroup.headerHash,
-			headerGroup.filterHash)(bucket)
-		if err != nil {
-			tx.Rollback()
-			panic(fmt.Sprintf("unable to write header: %v", err))
-		}
+	// The timestamps aren't necessarily in order, so sort them to find
+	// the median.
+	sort.Sort(timeSorter(timestamps))
+	return time.Unix(timestamps[len(timestamps)/2], 0), nil
+}
 
-	}
+// timeSorter implements sort.Interface to allow a slice of timestamps to be
+// sorted.
+type timeSorter []int64
 
-	// With all the headers in the batch written, we'll now write
-	// everything to disk in an atomic batch.
-	if err := tx.Commit(); err != nil {
-		panic(fmt.Sprintf("unable to commit write batch: %v", err))
-	}
+// Len returns the number of timestamps in the slice.
+func (s timeSorter) Len() int {
+	return len(s)
+}
 
-	// Notify subscribers of a connected block.
-	go func() {
-		b.server.mtxSubscribers.RLock()
-		for _, headerGroup := range headerWriteBatch {
-			for sub := range b.server.blockSubscribers {
-				channel := sub.onConnectBasic
-				if msg.extended {
-					channel = sub.onConnectExt
-				}
-				if channel != nil {
-					select {
-					case channel <- *headerGroup.header:
-					case <-sub.quit:
-					}
-				}
-			}
-		}
-		b.server.mtxSubscribers.RUnlock()
-	}()
+// Swap swaps the timestamps at the passed indices.
+func (s timeSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
 }
 
-// checkHeaderSanity checks the PoW, and timestamp of a block header.
-func (b *blockManager) checkHeaderSanity(blockHeader *wire.BlockHeader,
-	maxTimestamp time.Time, reorgAttempt bool) error {
-	diff, err := b.calcNextRequiredDifficulty(
-		blockHeader.Timestamp, reorgAttempt)
-	if err != nil {
-		return err
-	}
-	stubBlock := btcutil.NewBlock(&wire.MsgBlock{
-		Header: *blockHeader,
-	})
-	err = blockchain.CheckProofOfWork(stubBlock,
-		blockchain.CompactToBig(diff))
-	if err != nil {
-		return err
-	}
-	// Ensure the block time is not too far in the future.
-	if blockHeader.Timestamp.After(maxTimestamp) {
-		return fmt.Errorf("block timestamp of %v is too far in the "+
-			"future", blockHeader.Timestamp)
-	}
-	return nil
+// Less returns whether the timestamp with index i should sort before the
+// timestamp with index j.
+func (s timeSorter) Less(i, j int) bool {
+	return s[i] < s[j]
 }
 
 // calcNextRequiredDifficulty calculates the required difficulty for the block
-// after the passed previous block node based on the difficulty retarget rules.
+// after the last block in the passed list based on the difficulty retarget
+// rules.
 func (b *blockManager) calcNextRequiredDifficulty(newBlockTime time.Time,
-	reorgAttempt bool) (uint32, error) {
-
-	hList := b.headerList
-	if reorgAttempt {
-		hList = b.reorgList
-	}
+	hList *list.List) (uint32, error) {
 
 	lastNodeEl := hList.Back()
 
@@ -1479,8 +1176,8 @@ func (b *blockManager) calcNextRequiredDifficulty(newBlockTime time.Time,
 
 	// Get the block node at the previous retarget (targetTimespan days
 	// worth of blocks).
-	firstNode, err := b.server.GetBlockByHeight(
-		uint32(lastNode.height + 1 - b.blocksPerRetarget))
+	firstNode, err := b.headerAtHeight(hList,
+		lastNode.height+1-b.blocksPerRetarget)
 	if err != nil {
 		return 0, err
 	}
@@ -1529,6 +1226,29 @@ func (b *blockManager) calcNextRequiredDifficulty(newBlockTime time.Time,
 	return newTargetBits, nil
 }
 
+// headerAtHeight returns the header at the passed height, looking for it in
+// the passed list first and falling back to the database. This allows headers
+// that haven't been written to the database yet to be found.
+func (b *blockManager) headerAtHeight(hList *list.List,
+	height int32) (*wire.BlockHeader, error) {
+
+	for el := hList.Back(); el != nil; el = el.Prev() {
+		node := el.Value.(*headerNode)
+		if node.height == height {
+			return node.header, nil
+		}
+		if node.height < height {
+			break
+		}
+	}
+
+	header, err := b.server.GetBlockByHeight(uint32(height))
+	if err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
 // findPrevTestNetDifficulty returns the difficulty of the previous block which
 // did not have the special testnet minimum difficulty rule applied.
 func (b *blockManager) findPrevTestNetDifficulty(hList *list.List) (uint32, error) {
@@ -0,0 +1,131 @@
+package neutrino
+
+import (
+	"container/list"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// TestCheckBlockVersion checks that outdated block versions are rejected from
+// the activation heights of BIP0034, BIP0066 and BIP0065 on.
+func TestCheckBlockVersion(t *testing.T) {
+	params := &chaincfg.Params{
+		BIP0034Height: 100,
+		BIP0066Height: 200,
+		BIP0065Height: 300,
+	}
+
+	tests := []struct {
+		version int32
+		height  int32
+		valid   bool
+	}{
+		{version: 1, height: 99, valid: true},
+		{version: 1, height: 100, valid: false},
+		{version: 2, height: 100, valid: true},
+		{version: 2, height: 199, valid: true},
+		{version: 2, height: 200, valid: false},
+		{version: 3, height: 200, valid: true},
+		{version: 3, height: 299, valid: true},
+		{version: 3, height: 300, valid: false},
+		{version: 4, height: 300, valid: true},
+		{version: 1, height: 1000, valid: false},
+		{version: 0x20000000, height: 1000, valid: true},
+	}
+
+	for _, test := range tests {
+		err := checkBlockVersion(test.version, test.height, params)
+		if test.valid && err != nil {
+			t.Errorf("version %d at height %d rejected: %s",
+				test.version, test.height, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("version %d at height %d accepted",
+				test.version, test.height)
+		}
+	}
+}
+
+// TestCalcPastMedianTime checks that the median time is calculated over the
+// last blocks, taking the headers the list doesn't hold from the database.
+func TestCalcPastMedianTime(t *testing.T) {
+	db, dir, cleanup := newTestDB(t)
+	defer cleanup()
+	store := openTestStore(t, db, dir)
+	defer store.close()
+
+	// The timestamps of the blocks, in seconds after the genesis block,
+	// are out of order, as they may be in a real chain.
+	offsets := []int64{
+		0, 600, 300, 1500, 900, 1200, 100, 2000, 1800, 1700, 2500,
+		2400, 3000, 2900, 3500, 3100,
+	}
+	nodes := []*headerNode{{header: testGenesis}}
+	for height := 1; height < len(offsets); height++ {
+		prev := nodes[height-1].header
+		nodes = append(nodes, &headerNode{
+			header: &wire.BlockHeader{
+				Version:   1,
+				PrevBlock: prev.BlockHash(),
+				Timestamp: testGenesis.Timestamp.Add(
+					time.Duration(offsets[height]) *
+						time.Second),
+				Bits: prev.Bits,
+			},
+			height: int32(height),
+		})
+	}
+	if err := store.writeHeaders(nodes[1:]); err != nil {
+		t.Fatalf("unable to write headers: %s", err)
+	}
+
+	b := &blockManager{
+		server: &ChainService{
+			headers:     store,
+			chainParams: chaincfg.RegressionNetParams,
+		},
+	}
+
+	tests := []struct {
+		name string
+
+		// tipHeight is the height of the last header in the list and
+		// listLen the number of headers in the list.
+		tipHeight int
+		listLen   int
+
+		// median is the expected median time, in seconds after the
+		// genesis block.
+		median int64
+	}{
+		{name: "all in list", tipHeight: 15, listLen: 11, median: 2400},
+		{name: "longer list", tipHeight: 15, listLen: 16, median: 2400},
+		{name: "partly in database", tipHeight: 12, listLen: 3,
+			median: 1700},
+		{name: "near genesis", tipHeight: 3, listLen: 1, median: 600},
+		{name: "genesis", tipHeight: 0, listLen: 1, median: 0},
+	}
+
+	for _, test := range tests {
+		hList := list.New()
+		start := test.tipHeight - test.listLen + 1
+		for _, node := range nodes[start : test.tipHeight+1] {
+			hList.PushBack(node)
+		}
+		medianTime, err := b.calcPastMedianTime(hList)
+		if err != nil {
+			t.Errorf("%s: unable to calculate median time: %s",
+				test.name, err)
+			continue
+		}
+		want := testGenesis.Timestamp.Add(
+			time.Duration(test.median) * time.Second)
+		if !medianTime.Equal(want) {
+			t.Errorf("%s: median time is %v, want %v", test.name,
+				medianTime, want)
+		}
+	}
+}
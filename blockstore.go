@@ -0,0 +1,249 @@
+// NOTE: THIS API IS UNSTABLE RIGHT NOW.
+
+package neutrino
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcwallet/walletdb"
+)
+
+// blockFileName is the name of the flat file holding the blocks stored with
+// Config.PersistMatchedBlocks, relative to the data directory.
+const blockFileName = "matched_blocks.bin"
+
+// flatBlockStore keeps serialized blocks in an append-only flat file. The mb
+// bucket in the database indexes them by block hash, holding the offset and
+// length of each block in the file.
+//
+// Blocks are appended to the file before they're added to the index, so
+// anything in the file past the last indexed block is left over from an
+// interrupted write and is truncated when the store is opened. Blocks are
+// never removed: a block's contents are fixed by its hash, and a block that's
+// been disconnected is never asked for again, as we don't have its header.
+type flatBlockStore struct {
+	mtx  sync.RWMutex
+	file *os.File
+	db   walletdb.DB
+
+	// end is the offset in the file right after the last indexed block.
+	end int64
+}
+
+// newFlatBlockStore opens the block file at the passed path, creating it if
+// needed, and brings it in line with the database.
+func newFlatBlockStore(path string, db walletdb.DB) (*flatBlockStore,
+	error) {
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	store := &flatBlockStore{
+		file: file,
+		db:   db,
+	}
+	if err := store.init(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// init truncates the block file after the last indexed block.
+func (b *flatBlockStore) init() error {
+	err := dbView(b.db, func(bucket walletdb.ReadBucket) error {
+		indexBucket := bucket.NestedReadBucket(matchedBlockBucketName)
+		if indexBucket == nil {
+			return nil
+		}
+		return indexBucket.ForEach(func(k, v []byte) error {
+			offset, length, err := decodeBlockIndex(v)
+			if err != nil {
+				return err
+			}
+			if offset+length > b.end {
+				b.end = offset + length
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return b.file.Truncate(b.end)
+}
+
+// fetchBlock returns the stored block with the passed hash, or nil if it
+// isn't stored.
+func (b *flatBlockStore) fetchBlock(blockHash chainhash.Hash) (
+	*wire.MsgBlock, error) {
+
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	var offset, length int64
+	err := dbView(b.db, getMatchedBlockIndex(blockHash, &offset, &length))
+	if err != nil || length == 0 {
+		return nil, err
+	}
+
+	raw := make([]byte, length)
+	if _, err := b.file.ReadAt(raw, offset); err != nil {
+		return nil, fmt.Errorf("failed to read block %s: %s",
+			blockHash, err)
+	}
+	var msgBlock wire.MsgBlock
+	if err := msgBlock.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("failed to deserialize block %s: %s",
+			blockHash, err)
+	}
+	if msgBlock.BlockHash() != blockHash {
+		return nil, fmt.Errorf("block file has %s where index has %s",
+			msgBlock.BlockHash(), blockHash)
+	}
+	return &msgBlock, nil
+}
+
+// storeBlock appends the passed block to the file and indexes it, unless
+// it's stored already.
+func (b *flatBlockStore) storeBlock(msgBlock *wire.MsgBlock) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	blockHash := msgBlock.BlockHash()
+	var offset, length int64
+	err := dbView(b.db, getMatchedBlockIndex(blockHash, &offset, &length))
+	if err != nil || length != 0 {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(msgBlock.SerializeSize())
+	if err := msgBlock.Serialize(&buf); err != nil {
+		return err
+	}
+	if _, err := b.file.WriteAt(buf.Bytes(), b.end); err != nil {
+		return err
+	}
+	if err := b.file.Sync(); err != nil {
+		return err
+	}
+	err = dbUpdate(b.db, putMatchedBlockIndex(blockHash, b.end,
+		int64(buf.Len())))
+	if err != nil {
+		return err
+	}
+	b.end += int64(buf.Len())
+	return nil
+}
+
+// close closes the block file.
+func (b *flatBlockStore) close() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.file.Close()
+}
+
+// getMatchedBlock gets the block with the passed hash, which matched the
+// filters of a rescan or GetUtxo, using GetBlockFromNetwork. If
+// Config.PersistMatchedBlocks is set, the block is also stored on disk, so it
+// doesn't have to be fetched from the network again after a restart.
+func (s *ChainService) getMatchedBlock(blockHash chainhash.Hash,
+	options ...QueryOption) (*btcutil.Block, error) {
+
+	block, err := s.GetBlockFromNetwork(blockHash, options...)
+	if err != nil || block == nil || s.blockStore == nil {
+		return block, err
+	}
+	if err := s.blockStore.storeBlock(block.MsgBlock()); err != nil {
+		log.Warnf("Unable to store block %s: %s", blockHash, err)
+	}
+	return block, nil
+}
+
+// getStoredBlock returns the block with the passed hash and height from the
+// block store, or nil if it isn't stored or there's no block store.
+func (s *ChainService) getStoredBlock(blockHash chainhash.Hash,
+	height uint32) *btcutil.Block {
+
+	if s.blockStore == nil {
+		return nil
+	}
+	msgBlock, err := s.blockStore.fetchBlock(blockHash)
+	if err != nil {
+		log.Warnf("Unable to read stored block %s: %s", blockHash,
+			err)
+		return nil
+	}
+	if msgBlock == nil {
+		return nil
+	}
+	atomic.AddUint64(&s.blockStoreHits, 1)
+
+	block := btcutil.NewBlock(msgBlock)
+	block.SetHeight(int32(height))
+	return block
+}
+
+// putMatchedBlockIndex stores the offset and length of the block with the
+// passed hash in the block file.
+func putMatchedBlockIndex(blockHash chainhash.Hash,
+	offset, length int64) dbUpdateOption {
+
+	return func(bucket walletdb.ReadWriteBucket) error {
+		// The bucket is created on demand, as databases created
+		// before it existed don't have it.
+		indexBucket, err := bucket.CreateBucketIfNotExists(
+			matchedBlockBucketName)
+		if err != nil {
+			return err
+		}
+		var v [12]byte
+		binary.LittleEndian.PutUint64(v[:8], uint64(offset))
+		binary.LittleEndian.PutUint32(v[8:], uint32(length))
+		return indexBucket.Put(blockHash[:], v[:])
+	}
+}
+
+// getMatchedBlockIndex retrieves the offset and length of the block with the
+// passed hash in the block file. The length is left at 0 if the block isn't
+// stored.
+func getMatchedBlockIndex(blockHash chainhash.Hash,
+	offset, length *int64) dbViewOption {
+
+	return func(bucket walletdb.ReadBucket) error {
+		indexBucket := bucket.NestedReadBucket(matchedBlockBucketName)
+		if indexBucket == nil {
+			return nil
+		}
+		v := indexBucket.Get(blockHash[:])
+		if v == nil {
+			return nil
+		}
+		var err error
+		*offset, *length, err = decodeBlockIndex(v)
+		return err
+	}
+}
+
+// decodeBlockIndex decodes the offset and length of a block from its index
+// entry.
+func decodeBlockIndex(v []byte) (int64, int64, error) {
+	if len(v) != 12 {
+		return 0, 0, fmt.Errorf("invalid block index entry of %d "+
+			"bytes", len(v))
+	}
+	offset := int64(binary.LittleEndian.Uint64(v[:8]))
+	length := int64(binary.LittleEndian.Uint32(v[8:]))
+	return offset, length, nil
+}
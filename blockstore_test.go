@@ -0,0 +1,128 @@
+package neutrino
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// TestFlatBlockStore checks that stored blocks can be read back after the
+// block store is reopened, and that anything left in the file after the last
+// indexed block by an interrupted write is truncated.
+func TestFlatBlockStore(t *testing.T) {
+	var blocks []*wire.MsgBlock
+	for i := 0; i < 3; i++ {
+		msgBlock := wire.NewMsgBlock(&wire.BlockHeader{
+			Version: 1,
+			Nonce:   uint32(i),
+		})
+		msgBlock.AddTransaction(wire.NewMsgTx(1))
+		blocks = append(blocks, msgBlock)
+	}
+
+	tests := []struct {
+		name string
+
+		// garbage is the number of bytes appended to the file before
+		// it's reopened, as if a write had been interrupted.
+		garbage int
+	}{
+		{
+			name: "clean",
+		},
+		{
+			name:    "interrupted write",
+			garbage: 100,
+		},
+	}
+
+	for _, test := range tests {
+		db, dir, cleanup := newTestDB(t)
+		defer cleanup()
+		path := filepath.Join(dir, blockFileName)
+
+		store, err := newFlatBlockStore(path, db)
+		if err != nil {
+			t.Fatalf("%s: unable to open block store: %s",
+				test.name, err)
+		}
+
+		// Storing a block twice stores it once.
+		for _, msgBlock := range []*wire.MsgBlock{
+			blocks[0], blocks[1], blocks[0],
+		} {
+			if err := store.storeBlock(msgBlock); err != nil {
+				t.Fatalf("%s: unable to store block: %s",
+					test.name, err)
+			}
+		}
+		end := store.end
+		wantEnd := int64(blocks[0].SerializeSize() +
+			blocks[1].SerializeSize())
+		if end != wantEnd {
+			t.Errorf("%s: block file ends at %d, want %d",
+				test.name, end, wantEnd)
+		}
+		store.close()
+
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatalf("%s: unable to open block file: %s",
+				test.name, err)
+		}
+		_, err = file.Write(make([]byte, test.garbage))
+		file.Close()
+		if err != nil {
+			t.Fatalf("%s: unable to write to block file: %s",
+				test.name, err)
+		}
+
+		store, err = newFlatBlockStore(path, db)
+		if err != nil {
+			t.Fatalf("%s: unable to reopen block store: %s",
+				test.name, err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("%s: unable to stat block file: %s",
+				test.name, err)
+		}
+		if info.Size() != end || store.end != end {
+			t.Errorf("%s: block file is %d bytes and ends at %d "+
+				"after reopening, want %d", test.name,
+				info.Size(), store.end, end)
+		}
+
+		// The blocks stored before are still there, and blocks stored
+		// after reopening go where the leftovers were.
+		if err := store.storeBlock(blocks[2]); err != nil {
+			t.Fatalf("%s: unable to store block: %s", test.name,
+				err)
+		}
+		for i, msgBlock := range blocks {
+			got, err := store.fetchBlock(msgBlock.BlockHash())
+			if err != nil {
+				t.Errorf("%s: unable to fetch block %d: %s",
+					test.name, i, err)
+				continue
+			}
+			if got == nil ||
+				got.BlockHash() != msgBlock.BlockHash() {
+
+				t.Errorf("%s: block %d isn't stored", test.name,
+					i)
+			}
+		}
+
+		missing := wire.NewMsgBlock(&wire.BlockHeader{Nonce: 100})
+		got, err := store.fetchBlock(missing.BlockHash())
+		if err != nil || got != nil {
+			t.Errorf("%s: fetching a block that isn't stored "+
+				"returned %v, %v", test.name, got, err)
+		}
+
+		store.close()
+	}
+}
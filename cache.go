@@ -0,0 +1,202 @@
+// NOTE: THIS API IS UNSTABLE RIGHT NOW.
+
+package neutrino
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+var (
+	// DefaultFilterCacheSize is the total size in bytes of the filters and
+	// filter headers kept in memory if Config.FilterCacheSize isn't set.
+	DefaultFilterCacheSize uint64 = 4 * 1024 * 1024
+
+	// DefaultBlockCacheSize is the total size in bytes of the blocks kept
+	// in memory if Config.BlockCacheSize isn't set.
+	DefaultBlockCacheSize uint64 = 16 * 1024 * 1024
+)
+
+const (
+	// cacheEntryOverhead is roughly how many bytes of memory a cache entry
+	// takes up in addition to its value.
+	cacheEntryOverhead = 128
+)
+
+// cfheaderKey identifies the filter header of a given type for a block.
+type cfheaderKey struct {
+	blockHash  chainhash.Hash
+	filterType *FilterType
+}
+
+// cacheEntry is a value in an lruCache along with its key and size.
+type cacheEntry struct {
+	key   interface{}
+	value interface{}
+	size  uint64
+}
+
+// lruCache is a cache that holds values up to a total size in bytes, evicting
+// the least recently used values first when it's full. It's safe for
+// concurrent access.
+type lruCache struct {
+	mtx      sync.Mutex
+	capacity uint64
+	size     uint64
+	entries  map[interface{}]*list.Element
+	order    *list.List
+
+	// epoch is incremented whenever values are removed, so that values
+	// read from the database before a removal aren't put into the cache
+	// after it.
+	epoch uint64
+}
+
+// newLRUCache returns an empty cache that holds values up to a total size of
+// capacity bytes.
+func newLRUCache(capacity uint64) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		entries:  make(map[interface{}]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get returns the value with the passed key, if it's in the cache, and marks
+// it as the most recently used one.
+func (c *lruCache) get(key interface{}) (interface{}, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).value, true
+}
+
+// currentEpoch returns the epoch to pass to put for a value that's about to be
+// read from the database.
+func (c *lruCache) currentEpoch() uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.epoch
+}
+
+// put adds the passed value of the passed size to the cache, evicting the
+// least recently used values to make room for it. The value isn't added if
+// anything has been removed from the cache since the passed epoch, as it may
+// have been read before the removal.
+func (c *lruCache) put(key, value interface{}, size uint64, epoch uint64) {
+	size += cacheEntryOverhead
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if epoch != c.epoch || size > c.capacity {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+	for c.size+size > c.capacity {
+		c.removeElement(c.order.Back())
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{
+		key:   key,
+		value: value,
+		size:  size,
+	})
+	c.size += size
+}
+
+// remove removes the values with the passed keys from the cache.
+func (c *lruCache) remove(keys ...interface{}) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.epoch++
+	for _, key := range keys {
+		if elem, ok := c.entries[key]; ok {
+			c.removeElement(elem)
+		}
+	}
+}
+
+// removeElement removes an entry from the cache. The mutex must be held.
+func (c *lruCache) removeElement(elem *list.Element) {
+	entry := c.order.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// uncacheBlocks removes the passed blocks from the block cache, along with
+// their filters and filter headers of every type from the filter cache. It
+// must be called whenever the blocks are disconnected or their filters and
+// filter headers are deleted from the database.
+func (s *ChainService) uncacheBlocks(blockHashes ...chainhash.Hash) {
+	blockKeys := make([]interface{}, 0, len(blockHashes))
+	keys := make([]interface{}, 0, 2*len(blockHashes)*len(filterTypes))
+	for _, blockHash := range blockHashes {
+		blockKeys = append(blockKeys, blockHash)
+		for _, filterType := range filterTypes {
+			keys = append(keys, cfilterKey{
+				blockHash:  blockHash,
+				filterType: filterType,
+			}, cfheaderKey{
+				blockHash:  blockHash,
+				filterType: filterType,
+			})
+		}
+	}
+	s.filterCache.remove(keys...)
+	s.blockCache.remove(blockKeys...)
+}
+
+// cachedBlock is a block in the block cache. Only the message is kept, as a
+// btcutil.Block caches data lazily and mustn't be shared between callers.
+type cachedBlock struct {
+	msgBlock *wire.MsgBlock
+	height   int32
+}
+
+// getCachedBlock returns the block with the passed hash from the block cache,
+// or nil if it isn't there.
+func (s *ChainService) getCachedBlock(blockHash chainhash.Hash) *btcutil.Block {
+	value, ok := s.blockCache.get(blockHash)
+	if !ok {
+		return nil
+	}
+	atomic.AddUint64(&s.blockHits, 1)
+
+	cb := value.(*cachedBlock)
+	block := btcutil.NewBlock(cb.msgBlock)
+	block.SetHeight(cb.height)
+	return block
+}
+
+// cacheBlock adds the passed block to the block cache, unless a block has
+// been removed from it since the passed epoch.
+func (s *ChainService) cacheBlock(block *btcutil.Block, epoch uint64) {
+	msgBlock := block.MsgBlock()
+	s.blockCache.put(*block.Hash(), &cachedBlock{
+		msgBlock: msgBlock,
+		height:   block.Height(),
+	}, uint64(msgBlock.SerializeSize()), epoch)
+}
+
+// BlockCacheStats returns how many of the blocks requested from
+// GetBlockFromNetwork were served from the block cache, how many were read
+// from the blocks stored with Config.PersistMatchedBlocks and how many had to
+// be fetched from the network.
+func (s *ChainService) BlockCacheStats() (hits, storeHits, misses uint64) {
+	return atomic.LoadUint64(&s.blockHits),
+		atomic.LoadUint64(&s.blockStoreHits),
+		atomic.LoadUint64(&s.blockMisses)
+}
@@ -0,0 +1,255 @@
+package neutrino
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// TestLRUCache checks that the cache evicts the least recently used values to
+// stay within its capacity, and that values read before a removal aren't put
+// into it after the removal.
+func TestLRUCache(t *testing.T) {
+	const (
+		valueSize = 10
+		capacity  = 3 * (valueSize + cacheEntryOverhead)
+	)
+
+	type step struct {
+		// op is "put", "get" or "remove".
+		op  string
+		key int
+
+		// size is the size of the value to put, or valueSize if it's
+		// zero.
+		size uint64
+
+		// stale makes put pass the epoch from before the last
+		// removal.
+		stale bool
+
+		// found is whether get should find the key.
+		found bool
+	}
+	put := func(key int) step { return step{op: "put", key: key} }
+	get := func(key int, found bool) step {
+		return step{op: "get", key: key, found: found}
+	}
+	remove := func(key int) step { return step{op: "remove", key: key} }
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "evict least recently used",
+			steps: []step{
+				put(1), put(2), put(3), get(1, true), put(4),
+				get(1, true), get(2, false), get(3, true),
+				get(4, true),
+			},
+		},
+		{
+			name: "evict several for a big value",
+			steps: []step{
+				put(1), put(2), put(3),
+				{op: "put", key: 4, size: 2*valueSize +
+					cacheEntryOverhead},
+				get(1, false), get(2, false), get(3, true),
+				get(4, true),
+			},
+		},
+		{
+			name: "too big",
+			steps: []step{
+				put(1),
+				{op: "put", key: 2, size: capacity},
+				get(1, true), get(2, false),
+			},
+		},
+		{
+			name: "replace",
+			steps: []step{
+				put(1), put(2), put(1), put(3), get(1, true),
+				get(2, true), get(3, true),
+			},
+		},
+		{
+			name: "remove",
+			steps: []step{
+				put(1), put(2), remove(1), get(1, false),
+				get(2, true),
+			},
+		},
+		{
+			name: "put after removal",
+			steps: []step{
+				put(1), remove(2),
+				{op: "put", key: 2, stale: true},
+				get(2, false), put(2), get(1, true),
+				get(2, true),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		c := newLRUCache(capacity)
+		staleEpoch := c.currentEpoch()
+		for i, s := range test.steps {
+			switch s.op {
+			case "put":
+				size := s.size
+				if size == 0 {
+					size = valueSize
+				}
+				epoch := c.currentEpoch()
+				if s.stale {
+					epoch = staleEpoch
+				}
+				c.put(s.key, s.key, size, epoch)
+
+			case "get":
+				value, found := c.get(s.key)
+				if found != s.found {
+					t.Errorf("%s: step %d: found key %d: "+
+						"%v, want %v", test.name, i,
+						s.key, found, s.found)
+				}
+				if found && value != s.key {
+					t.Errorf("%s: step %d: got %v for "+
+						"key %d", test.name, i, value,
+						s.key)
+				}
+
+			case "remove":
+				staleEpoch = c.currentEpoch()
+				c.remove(s.key)
+			}
+
+			var size uint64
+			for _, elem := range c.entries {
+				size += elem.Value.(*cacheEntry).size
+			}
+			if size != c.size || c.size > capacity {
+				t.Errorf("%s: step %d: cache size is %d, "+
+					"entries add up to %d, capacity is %d",
+					test.name, i, c.size, size, capacity)
+			}
+		}
+	}
+}
+
+// TestReorgChainUncaches checks that the blocks, filters and filter headers of
+// the blocks that reorgChain disconnects are removed from the caches, that
+// those of the blocks it keeps stay, and that values read from the database
+// before the reorg aren't put into the caches after it.
+func TestReorgChainUncaches(t *testing.T) {
+	const numHeaders = 6
+
+	tests := []struct {
+		name       string
+		forkHeight int32
+	}{
+		{
+			name:       "disconnect the tip",
+			forkHeight: 5,
+		},
+		{
+			name:       "disconnect several blocks",
+			forkHeight: 3,
+		},
+		{
+			name:       "disconnect every block",
+			forkHeight: 0,
+		},
+	}
+
+	for _, test := range tests {
+		s, cleanup := newTestChainService(t)
+		nodes, filters := writeTestFilterChain(t, s, numHeaders,
+			numHeaders)
+
+		// Read every filter and filter header into the filter cache,
+		// and put every block into the block cache.
+		for i, node := range nodes {
+			blockHash := node.header.BlockHash()
+			err := s.putFilter(blockHash, BasicFilter, filters[i])
+			if err != nil {
+				t.Fatalf("%s: unable to store filter: %s",
+					test.name, err)
+			}
+			_, err = s.GetFilter(blockHash, BasicFilter)
+			if err != nil {
+				t.Fatalf("%s: unable to get filter: %s",
+					test.name, err)
+			}
+			_, err = s.GetFilterHeader(blockHash, BasicFilter)
+			if err != nil {
+				t.Fatalf("%s: unable to get filter header: %s",
+					test.name, err)
+			}
+			block := btcutil.NewBlock(testFilterBlock(node))
+			block.SetHeight(node.height)
+			s.cacheBlock(block, s.blockCache.currentEpoch())
+		}
+		filterEpoch := s.filterCache.currentEpoch()
+		blockEpoch := s.blockCache.currentEpoch()
+
+		forkHeader := testGenesis
+		if test.forkHeight > 0 {
+			forkHeader = nodes[test.forkHeight-1].header
+		}
+		newNodes := makeTestHeaders(forkHeader, test.forkHeight, 2, 1)
+		_, err := s.reorgChain(uint32(test.forkHeight), newNodes)
+		if err != nil {
+			t.Fatalf("%s: unable to reorg chain: %s", test.name,
+				err)
+		}
+
+		for i, node := range nodes {
+			blockHash := node.header.BlockHash()
+			filterKey := cfilterKey{
+				blockHash:  blockHash,
+				filterType: BasicFilter,
+			}
+			headerKey := cfheaderKey{
+				blockHash:  blockHash,
+				filterType: BasicFilter,
+			}
+			connected := node.height <= test.forkHeight
+
+			_, filterCached := s.filterCache.get(filterKey)
+			_, headerCached := s.filterCache.get(headerKey)
+			blockCached := s.getCachedBlock(blockHash) != nil
+			if filterCached != connected ||
+				headerCached != connected ||
+				blockCached != connected {
+
+				t.Errorf("%s: block %d has filter cached %v, "+
+					"filter header cached %v and block "+
+					"cached %v, want %v", test.name,
+					node.height, filterCached,
+					headerCached, blockCached, connected)
+			}
+			if connected {
+				continue
+			}
+
+			// Anything read before the reorg may be out of date,
+			// so it mustn't make it into the caches.
+			s.filterCache.put(filterKey, filters[i], 0, filterEpoch)
+			if _, ok := s.filterCache.get(filterKey); ok {
+				t.Errorf("%s: filter of block %d read before "+
+					"the reorg was cached", test.name,
+					node.height)
+			}
+			block := btcutil.NewBlock(testFilterBlock(node))
+			s.cacheBlock(block, blockEpoch)
+			if s.getCachedBlock(blockHash) != nil {
+				t.Errorf("%s: block %d read before the reorg "+
+					"was cached", test.name, node.height)
+			}
+		}
+		cleanup()
+	}
+}
@@ -0,0 +1,190 @@
+// NOTE: THIS API IS UNSTABLE RIGHT NOW.
+
+package neutrino
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcutil/gcs/builder"
+)
+
+// cfHeaderCandidate is one of the versions of the filter headers for a
+// checkpoint interval that our peers sent us, along with the peers that sent
+// it.
+type cfHeaderCandidate struct {
+	checkpoint    chainhash.Hash
+	filterHeaders []*chainhash.Hash
+	peers         []*serverPeer
+}
+
+// resolveCFHeaderConflict works out which of the passed versions of the filter
+// headers of the passed type for the interval after startHeight is right. The
+// candidates end at the passed checkpoints, which are what our peers told us
+// the filter header for the block at endHeight is. They're narrowed down with
+// resolveCFHeaderCandidates, downloading the blocks it needs to compute the
+// correct filter headers, including the block at index check of the interval
+// unless check is negative. Peers that sent us wrong filter headers, or
+// vouched for a checkpoint none of whose filter headers turned out to be
+// right, are banned. It returns nil if the conflict couldn't be resolved.
+func (b *blockManager) resolveCFHeaderConflict(startHeight, endHeight int32,
+	startHash, endHash chainhash.Hash,
+	checkpoints map[chainhash.Hash][]*serverPeer,
+	candidates []*cfHeaderCandidate, check int,
+	filterType *FilterType) []*chainhash.Hash {
+
+	startHeader, err := b.server.GetFilterHeader(startHash, filterType)
+	if err != nil {
+		log.Errorf("Couldn't get filter header for block %s: %s",
+			startHash, err)
+		return nil
+	}
+
+	survivor, wrong, err := resolveCFHeaderCandidates(candidates,
+		*startHeader, check,
+		func(i int, prevHeader chainhash.Hash) (chainhash.Hash, error) {
+			height := startHeight + int32(i) + 1
+			return b.computeFilterHeader(height, prevHeader,
+				filterType)
+		},
+	)
+	for _, c := range wrong {
+		for _, sp := range c.peers {
+			sp.misbehaved(InvalidFilterHeader)
+		}
+	}
+	if err != nil {
+		log.Warnf("Couldn't resolve %s filter header conflict for "+
+			"block %d (%s): %s", filterType, endHeight, endHash,
+			err)
+		return nil
+	}
+
+	// Every candidate that's left out was shown to be wrong, so the
+	// peers that vouched for another checkpoint were wrong too.
+	for checkpoint, peers := range checkpoints {
+		if checkpoint == survivor.checkpoint {
+			continue
+		}
+		for _, sp := range peers {
+			sp.misbehaved(InvalidFilterHeader)
+		}
+	}
+
+	log.Infof("Checked %s filter headers for blocks %d to %d against "+
+		"the blocks, keeping the ones ending at %s", filterType,
+		startHeight+1, endHeight, survivor.checkpoint)
+	return survivor.filterHeaders
+}
+
+// resolveCFHeaderCandidates narrows the passed candidates for an interval
+// down to the one that's right. The filter header at the first index they
+// disagree on is computed by computeHeader from the filter header before it,
+// which is startHeader for the first index, and the candidates that got it
+// wrong are dropped. This is repeated until one candidate is left, whose
+// filter headers at index check, unless it's negative, and at the checkpoint
+// are then checked the same way, unless they already have been. It returns
+// the remaining candidate and the candidates that were shown to be wrong,
+// which are returned even if no candidate is left or computeHeader fails.
+func resolveCFHeaderCandidates(candidates []*cfHeaderCandidate,
+	startHeader chainhash.Hash, check int,
+	computeHeader func(int, chainhash.Hash) (chainhash.Hash, error)) (
+	*cfHeaderCandidate, []*cfHeaderCandidate, error) {
+
+	var wrong []*cfHeaderCandidate
+	checked := make(map[int]bool)
+
+	// checkAt drops the candidates that don't have the correct filter
+	// header at index i. All candidates must agree before it.
+	checkAt := func(i int) error {
+		prevHeader := startHeader
+		if i > 0 {
+			prevHeader = *candidates[0].filterHeaders[i-1]
+		}
+		correct, err := computeHeader(i, prevHeader)
+		if err != nil {
+			return err
+		}
+		checked[i] = true
+
+		var left []*cfHeaderCandidate
+		for _, c := range candidates {
+			if *c.filterHeaders[i] == correct {
+				left = append(left, c)
+				continue
+			}
+			wrong = append(wrong, c)
+		}
+		candidates = left
+		if len(candidates) == 0 {
+			return fmt.Errorf("no candidate has the right filter "+
+				"header %s at index %d", correct, i)
+		}
+		return nil
+	}
+
+	for len(candidates) > 1 {
+		i := firstDisagreement(candidates)
+		if i < 0 {
+			candidates = candidates[:1]
+			break
+		}
+		if err := checkAt(i); err != nil {
+			return nil, wrong, err
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, wrong, fmt.Errorf("no candidates")
+	}
+
+	last := len(candidates[0].filterHeaders) - 1
+	for _, i := range []int{check, last} {
+		if i < 0 || checked[i] {
+			continue
+		}
+		if err := checkAt(i); err != nil {
+			return nil, wrong, err
+		}
+	}
+	return candidates[0], wrong, nil
+}
+
+// firstDisagreement returns the first index of the interval at which the
+// candidates' filter headers differ, or -1 if they're all the same.
+func firstDisagreement(candidates []*cfHeaderCandidate) int {
+	for i, filterHeader := range candidates[0].filterHeaders {
+		for _, c := range candidates[1:] {
+			if *c.filterHeaders[i] != *filterHeader {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// computeFilterHeader downloads the block at the passed height, builds its
+// filter of the passed type and returns the filter header that follows
+// prevHeader. The filter is stored, as we've got it anyway.
+func (b *blockManager) computeFilterHeader(height int32,
+	prevHeader chainhash.Hash, filterType *FilterType) (chainhash.Hash,
+	error) {
+
+	blockHash, err := b.server.GetBlockHashByHeight(uint32(height))
+	if err != nil {
+		return chainhash.Hash{}, err
+	}
+	block, err := b.server.GetBlockFromNetwork(blockHash)
+	if err != nil {
+		return chainhash.Hash{}, err
+	}
+
+	filter, err := filterType.build(block.MsgBlock())
+	if err != nil {
+		return chainhash.Hash{}, err
+	}
+	if err := b.server.putFilter(blockHash, filterType, filter); err != nil {
+		log.Warnf("Couldn't store filter for block %s: %s", blockHash,
+			err)
+	}
+	return builder.MakeHeaderForFilter(filter, prevHeader), nil
+}
@@ -0,0 +1,258 @@
+package neutrino
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// testFilterHeaderLink stands in for building the filter of the block at
+// index i of an interval and computing its filter header from prevHeader.
+func testFilterHeaderLink(i int, prevHeader chainhash.Hash) chainhash.Hash {
+	return chainhash.DoubleHashH(append(prevHeader[:], byte(i)))
+}
+
+// makeTestCandidate returns a candidate for an interval of num blocks that
+// follows startHeader. From index forkAt on, its filter headers are derived
+// from a wrong filter header at that index, made up from the seed; a negative
+// forkAt gives the correct filter headers. If badLast is set, only the last
+// filter header is wrong.
+func makeTestCandidate(startHeader chainhash.Hash, num, forkAt int,
+	seed byte, badLast bool) *cfHeaderCandidate {
+
+	c := &cfHeaderCandidate{}
+	prevHeader := startHeader
+	for i := 0; i < num; i++ {
+		filterHeader := testFilterHeaderLink(i, prevHeader)
+		if i == forkAt || badLast && i == num-1 {
+			filterHeader = chainhash.DoubleHashH(
+				append(filterHeader[:], seed))
+		}
+		c.filterHeaders = append(c.filterHeaders, &filterHeader)
+		prevHeader = filterHeader
+	}
+	c.checkpoint = *c.filterHeaders[num-1]
+	return c
+}
+
+// TestResolveCFHeaderCandidates checks that conflicting filter headers are
+// narrowed down to the right ones by computing the filter headers at the
+// indexes they disagree on, at the checkpoint and at any index that's to be
+// checked in any case.
+func TestResolveCFHeaderCandidates(t *testing.T) {
+	const num = 10
+	startHeader := chainhash.DoubleHashH([]byte("start"))
+	correct := func() *cfHeaderCandidate {
+		return makeTestCandidate(startHeader, num, -1, 0, false)
+	}
+	forked := func(forkAt int, seed byte) *cfHeaderCandidate {
+		return makeTestCandidate(startHeader, num, forkAt, seed, false)
+	}
+
+	tests := []struct {
+		name       string
+		candidates []*cfHeaderCandidate
+
+		// check is the index of a filter header to check in any case,
+		// or -1.
+		check int
+
+		// computeErr makes computing the filter header at any index
+		// fail.
+		computeErr bool
+
+		// survivor is the index of the candidate that should be left,
+		// or -1 if none should be.
+		survivor int
+
+		// wrong is the indexes of the candidates that should be shown
+		// to be wrong.
+		wrong []int
+
+		// computed is the indexes of the interval whose filter headers
+		// should be computed, in order.
+		computed []int
+	}{
+		{
+			name:  "wrong checkpoint",
+			check: -1,
+			candidates: []*cfHeaderCandidate{
+				correct(),
+				forked(num-1, 1),
+			},
+			survivor: 0,
+			wrong:    []int{1},
+			computed: []int{num - 1},
+		},
+		{
+			name:  "wrong in the middle",
+			check: -1,
+			candidates: []*cfHeaderCandidate{
+				forked(3, 1),
+				correct(),
+			},
+			survivor: 1,
+			wrong:    []int{0},
+			computed: []int{3, num - 1},
+		},
+		{
+			name:  "three candidates",
+			check: -1,
+			candidates: []*cfHeaderCandidate{
+				forked(5, 1),
+				correct(),
+				forked(2, 2),
+			},
+			survivor: 1,
+			wrong:    []int{2, 0},
+			computed: []int{2, 5, num - 1},
+		},
+		{
+			name:  "same checkpoint",
+			check: -1,
+			candidates: []*cfHeaderCandidate{
+				correct(),
+				func() *cfHeaderCandidate {
+					c := forked(4, 1)
+					c.filterHeaders[num-1] =
+						correct().filterHeaders[num-1]
+					c.checkpoint = *c.filterHeaders[num-1]
+					return c
+				}(),
+			},
+			survivor: 0,
+			wrong:    []int{1},
+			computed: []int{4, num - 1},
+		},
+		{
+			name:  "all wrong",
+			check: -1,
+			candidates: []*cfHeaderCandidate{
+				forked(4, 1),
+				forked(4, 2),
+			},
+			survivor: -1,
+			wrong:    []int{0, 1},
+			computed: []int{4},
+		},
+		{
+			name:  "survivor wrong at checkpoint",
+			check: -1,
+			candidates: []*cfHeaderCandidate{
+				makeTestCandidate(startHeader, num, -1, 1,
+					true),
+				forked(2, 2),
+			},
+			survivor: -1,
+			wrong:    []int{1, 0},
+			computed: []int{2, num - 1},
+		},
+		{
+			name:  "identical candidates",
+			check: -1,
+			candidates: []*cfHeaderCandidate{
+				correct(),
+				correct(),
+			},
+			survivor: 0,
+			computed: []int{num - 1},
+		},
+		{
+			name: "suspect wrong",
+			candidates: []*cfHeaderCandidate{
+				forked(4, 1),
+			},
+			check:    4,
+			survivor: -1,
+			wrong:    []int{0},
+			computed: []int{4},
+		},
+		{
+			name: "suspect right",
+			candidates: []*cfHeaderCandidate{
+				correct(),
+			},
+			check:    4,
+			survivor: 0,
+			computed: []int{4, num - 1},
+		},
+		{
+			name: "suspect already checked",
+			candidates: []*cfHeaderCandidate{
+				forked(3, 1),
+				correct(),
+			},
+			check:    3,
+			survivor: 1,
+			wrong:    []int{0},
+			computed: []int{3, num - 1},
+		},
+		{
+			name:  "computing fails",
+			check: -1,
+			candidates: []*cfHeaderCandidate{
+				correct(),
+				forked(6, 1),
+			},
+			computeErr: true,
+			survivor:   -1,
+		},
+	}
+
+	for _, test := range tests {
+		var computed []int
+		survivor, wrong, err := resolveCFHeaderCandidates(
+			test.candidates, startHeader, test.check,
+			func(i int, prevHeader chainhash.Hash) (chainhash.Hash,
+				error) {
+
+				if test.computeErr {
+					return chainhash.Hash{},
+						errors.New("no block")
+				}
+				computed = append(computed, i)
+				return testFilterHeaderLink(i, prevHeader), nil
+			},
+		)
+
+		if test.survivor < 0 {
+			if err == nil {
+				t.Errorf("%s: resolved conflict that has no "+
+					"right candidate", test.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unable to resolve conflict: %s",
+				test.name, err)
+		} else if survivor != test.candidates[test.survivor] {
+			t.Errorf("%s: wrong candidate left", test.name)
+		}
+
+		if len(wrong) != len(test.wrong) {
+			t.Errorf("%s: %d candidates shown wrong, want %d",
+				test.name, len(wrong), len(test.wrong))
+		} else {
+			for i, c := range wrong {
+				if c != test.candidates[test.wrong[i]] {
+					t.Errorf("%s: candidate %d shown "+
+						"wrong, want candidate %d",
+						test.name, i, test.wrong[i])
+				}
+			}
+		}
+
+		if len(computed) != len(test.computed) {
+			t.Errorf("%s: computed filter headers at %v, want %v",
+				test.name, computed, test.computed)
+			continue
+		}
+		for i := range computed {
+			if computed[i] != test.computed[i] {
+				t.Errorf("%s: computed filter headers at %v, "+
+					"want %v", test.name, computed,
+					test.computed)
+				break
+			}
+		}
+	}
+}
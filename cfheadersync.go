@@ -0,0 +1,853 @@
+// NOTE: THIS API IS UNSTABLE RIGHT NOW.
+
+package neutrino
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcwallet/walletdb"
+)
+
+const (
+	// cfCheckpointInterval is the number of blocks between filter header
+	// checkpoints. We ask all of our peers for the filter header at each
+	// checkpoint, and the peers that sent it for the filter headers in
+	// between.
+	cfCheckpointInterval = 1000
+
+	// cfHeaderRetryInterval is how long the cfheader sync waits before
+	// trying again when it couldn't catch up with the block headers.
+	cfHeaderRetryInterval = 10 * time.Second
+)
+
+var (
+	// MinCFHeaderPeers is the minimum number of peers that must agree on
+	// the filter header at a checkpoint before we accept it, unless it's
+	// pinned by a filter header checkpoint in the config. If fewer peers
+	// are connected, we accept the filter header once
+	// CFHeaderQuorumTimeout has passed, as long as all of them sent it to
+	// us. It can be increased for higher security.
+	MinCFHeaderPeers = 2
+
+	// CFHeaderQuorumTimeout is how long we wait for all of our peers to
+	// send us the filter header at a checkpoint. Once it's passed, we go
+	// with the answers we've got.
+	CFHeaderQuorumTimeout = 5 * time.Second
+)
+
+// cfHeaderQuorum tracks the filter headers our peers send us for a single
+// block, as they come in.
+type cfHeaderQuorum struct {
+	votes map[chainhash.Hash][]*serverPeer
+}
+
+// newCFHeaderQuorum returns an empty quorum tracker.
+func newCFHeaderQuorum() *cfHeaderQuorum {
+	return &cfHeaderQuorum{
+		votes: make(map[chainhash.Hash][]*serverPeer),
+	}
+}
+
+// add records the filter header sent by the passed peer.
+func (q *cfHeaderQuorum) add(sp *serverPeer, filterHeader chainhash.Hash) {
+	q.votes[filterHeader] = append(q.votes[filterHeader], sp)
+}
+
+// agreed returns the filter header if all peers that answered agree on it and
+// there are at least min of them.
+func (q *cfHeaderQuorum) agreed(min int) (chainhash.Hash, bool) {
+	if len(q.votes) != 1 {
+		return chainhash.Hash{}, false
+	}
+	for filterHeader, peers := range q.votes {
+		if len(peers) >= min {
+			return filterHeader, true
+		}
+	}
+	return chainhash.Hash{}, false
+}
+
+// conflicting returns whether our peers sent us different filter headers.
+func (q *cfHeaderQuorum) conflicting() bool {
+	return len(q.votes) > 1
+}
+
+// answered returns how many peers sent us a filter header.
+func (q *cfHeaderQuorum) answered() int {
+	n := 0
+	for _, peers := range q.votes {
+		n += len(peers)
+	}
+	return n
+}
+
+// signalCFHeaderSync wakes up the cfheader sync after new block headers have
+// been written. It never blocks.
+func (b *blockManager) signalCFHeaderSync() {
+	select {
+	case b.cfHeadersSignal <- struct{}{}:
+	default:
+	}
+}
+
+// cfHandler syncs the filter header chain of each filter type up to the block
+// header chain, starting over whenever new block headers have been written.
+// It must be run as a goroutine.
+func (b *blockManager) cfHandler() {
+	defer b.wg.Done()
+
+	for {
+		synced := true
+		for _, filterType := range b.server.syncedFilterTypes {
+			synced = b.syncCFHeaders(filterType) && synced
+		}
+
+		// If we couldn't get all the filter headers, try again in a
+		// while even if no new block headers come in.
+		var retry <-chan time.Time
+		if !synced {
+			retry = time.After(cfHeaderRetryInterval)
+		}
+
+		select {
+		case <-b.cfHeadersSignal:
+		case <-retry:
+		case <-b.quit:
+			log.Trace("Filter header handler done")
+			return
+		}
+	}
+}
+
+// syncCFHeaders syncs the filter header chain of the passed type up to the
+// block header chain, one checkpoint interval at a time. It returns false if
+// it couldn't get all of the filter headers it needs right now.
+func (b *blockManager) syncCFHeaders(filterType *FilterType) bool {
+	tipHeader, tipHeight, err := b.server.LatestBlock()
+	if err != nil {
+		log.Errorf("Failed to get latest block: %s", err)
+		return false
+	}
+
+	// The filter header chain may have been cut back by a reorg since we
+	// last looked, so we find where it ends every time.
+	filterTip, err := b.cfHeaderTip(filterType, int32(tipHeight))
+	if err != nil {
+		log.Errorf("Failed to find latest %s filter header: %s",
+			filterType, err)
+		return false
+	}
+	b.setLastCFHeaderHeight(filterType, filterTip)
+
+	// If a block turned out not to match our filter headers, we throw
+	// away the filter headers from the start of its checkpoint interval
+	// on, and check the ones we fetch again against the block.
+	suspect := b.suspectCFHeaderHeight(filterType)
+	if suspect != 0 && suspect <= filterTip {
+		start := (suspect - 1) / cfCheckpointInterval *
+			cfCheckpointInterval
+		log.Warnf("Fetching %s filter headers again from block %d to "+
+			"check block %d", filterType, start+1, suspect)
+		err := b.rollBackCFHeaders(filterType, start, filterTip)
+		if err != nil {
+			log.Errorf("Failed to roll back %s filter headers: %s",
+				filterType, err)
+			return false
+		}
+		filterTip = start
+		b.setLastCFHeaderHeight(filterType, filterTip)
+	}
+
+	for filterTip < int32(tipHeight) {
+		end := (filterTip/cfCheckpointInterval + 1) * cfCheckpointInterval
+		if end > int32(tipHeight) {
+			// While we're still catching up with the block headers,
+			// we only sync full checkpoint intervals rather than
+			// asking all of our peers for the filter header at
+			// every intermediate tip.
+			minus24Hours := b.server.timeSource.AdjustedTime().Add(
+				-24 * time.Hour)
+			if tipHeader.Timestamp.Before(minus24Hours) {
+				return true
+			}
+			end = int32(tipHeight)
+		}
+
+		checkHeight := int32(0)
+		if suspect > filterTip && suspect <= end {
+			checkHeight = suspect
+		}
+		if !b.syncCFHeaderInterval(filterTip, end, checkHeight,
+			filterType) {
+
+			return false
+		}
+		if checkHeight != 0 {
+			b.clearSuspectCFHeaders(filterType, checkHeight)
+		}
+		b.settleCFilterMismatches(filterType, filterTip, end)
+		filterTip = end
+		b.setLastCFHeaderHeight(filterType, filterTip)
+
+		select {
+		case <-b.quit:
+			return true
+		default:
+		}
+	}
+	return true
+}
+
+// syncCFHeaderInterval fetches the filter headers of the passed type for the
+// blocks after startHeight up to and including endHeight. The filter header
+// at endHeight is fetched from all of our peers first, and the whole interval
+// is then fetched with getCFHeaders and must end at that filter header. If
+// checkHeight isn't 0, the filter header of the block at that height is
+// checked against the block. It returns false if the filter headers couldn't
+// be fetched.
+func (b *blockManager) syncCFHeaderInterval(startHeight, endHeight,
+	checkHeight int32, filterType *FilterType) bool {
+
+	startHash, err := b.server.GetBlockHashByHeight(uint32(startHeight))
+	if err != nil {
+		log.Errorf("Failed to get block at height %d: %s", startHeight,
+			err)
+		return false
+	}
+	endHash, err := b.server.GetBlockHashByHeight(uint32(endHeight))
+	if err != nil {
+		log.Errorf("Failed to get block at height %d: %s", endHeight,
+			err)
+		return false
+	}
+	prevHash, err := b.server.GetBlockHashByHeight(uint32(endHeight - 1))
+	if err != nil {
+		log.Errorf("Failed to get block at height %d: %s",
+			endHeight-1, err)
+		return false
+	}
+
+	queryStart := time.Now()
+	quorum := b.fetchCFCheckpoint(prevHash, endHash, filterType)
+
+	var checkpoints map[chainhash.Hash][]*serverPeer
+	copies := cfHeaderCopies()
+	pinned, isPinned := b.server.filterHeaderCheckpoint(endHash,
+		filterType)
+	_, isAgreed := quorum.agreed(MinCFHeaderPeers)
+	switch {
+	// A filter header checkpoint from the config overrides whatever our
+	// peers tell us.
+	case isPinned:
+		checkpoints = map[chainhash.Hash][]*serverPeer{
+			pinned: quorum.votes[pinned],
+		}
+		n := len(quorum.votes[pinned])
+		if n < copies && b.allPeersAgreed(quorum, queryStart) {
+			copies = n
+		}
+
+	case isAgreed:
+		checkpoints = quorum.votes
+
+	// If our peers disagree, getCFHeaders works out who's right by
+	// checking the filter headers against the blocks.
+	case quorum.conflicting():
+		log.Warnf("Peers disagree on the %s filter header for block "+
+			"%d (%s)", filterType, endHeight, endHash)
+		checkpoints = quorum.votes
+
+	// With fewer than MinCFHeaderPeers peers connected, we'd never get
+	// a quorum, so we go with the peers we have once the deadline has
+	// passed, as long as all of them answered and agree.
+	case b.allPeersAgreed(quorum, queryStart):
+		log.Infof("Only %d peers are connected, accepting their %s "+
+			"filter header for block %d (%s)", quorum.answered(),
+			filterType, endHeight, endHash)
+		checkpoints = quorum.votes
+		if quorum.answered() < copies {
+			copies = quorum.answered()
+		}
+
+	default:
+		log.Warnf("Only %d peers sent us the %s filter header for "+
+			"block %d (%s), need %d", quorum.answered(),
+			filterType, endHeight, endHash, MinCFHeaderPeers)
+		return false
+	}
+	filterHeaders := b.getCFHeaders(startHeight, endHeight, checkHeight,
+		startHash, endHash, checkpoints, copies, filterType)
+	if filterHeaders == nil {
+		log.Warnf("Couldn't get %s filter headers for blocks %d to "+
+			"%d", filterType, startHeight+1, endHeight)
+		return false
+	}
+
+	// The block headers may have been reorganized while we were waiting
+	// for our peers, in which case we start over. We read the headers
+	// one by one, so we make sure they chain from startHash to endHash.
+	blockHeaders := make([]wire.BlockHeader, 0, len(filterHeaders))
+	prev := startHash
+	for height := startHeight + 1; height <= endHeight; height++ {
+		header, err := b.server.GetBlockByHeight(uint32(height))
+		if err != nil {
+			log.Errorf("Failed to get block at height %d: %s",
+				height, err)
+			return false
+		}
+		if header.PrevBlock != prev {
+			log.Debugf("Block headers changed while syncing filter "+
+				"headers for blocks %d to %d", startHeight+1,
+				endHeight)
+			return false
+		}
+		blockHeaders = append(blockHeaders, header)
+		prev = header.BlockHash()
+	}
+
+	// A reorg takes the blocks it disconnects out of the index in the
+	// same transaction, so if the last block is still indexed at its
+	// height when we write the filter headers, the blocks before it are
+	// still in the chain as well.
+	changed := false
+	err = b.server.dbUpdate(func(bucket walletdb.ReadWriteBucket) error {
+		var height uint32
+		err := getHeaderIndex(endHash, &height)(bucket)
+		if err != nil || height != uint32(endHeight) {
+			changed = true
+			return nil
+		}
+		for i, header := range blockHeaders {
+			err := putFilterHeader(header.BlockHash(), filterType,
+				*filterHeaders[i])(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Criticalf("Unable to write filter headers: %s", err)
+		return false
+	}
+	if changed {
+		log.Debugf("Block headers changed while syncing filter "+
+			"headers for blocks %d to %d", startHeight+1, endHeight)
+		return false
+	}
+
+	log.Debugf("Synced %s filter headers for blocks %d to %d", filterType,
+		startHeight+1, endHeight)
+
+	b.notifyCFHeadersConnected(blockHeaders, filterType)
+	return true
+}
+
+// fetchCFCheckpoint asks all of our peers for the filter header of the passed
+// type for the block with hash stopHash, whose parent is prevHash, and waits
+// for their answers until CFHeaderQuorumTimeout has passed. It returns the
+// peers that sent each filter header, leaving out the ones that don't match a
+// filter header checkpoint from the config.
+func (b *blockManager) fetchCFCheckpoint(prevHash, stopHash chainhash.Hash,
+	filterType *FilterType) *cfHeaderQuorum {
+
+	msg := wire.NewMsgGetCFHeaders()
+	msg.AddBlockLocatorHash(&prevHash)
+	msg.HashStop = stopHash
+	msg.Extended = filterType.extended
+
+	quorum := newCFHeaderQuorum()
+	b.server.queryAllPeers(
+		msg,
+		func(sp *serverPeer, resp wire.Message, quit chan<- struct{},
+			peerQuit chan<- struct{}) {
+
+			cfheaders, ok := resp.(*wire.MsgCFHeaders)
+			if !ok || cfheaders.StopHash != stopHash ||
+				cfheaders.Extended != filterType.extended ||
+				len(cfheaders.HeaderHashes) != 1 {
+				return
+			}
+			quorum.add(sp, *cfheaders.HeaderHashes[0])
+			close(peerQuit)
+		},
+		Timeout(CFHeaderQuorumTimeout),
+		NumRetries(1),
+	)
+
+	b.checkFilterHeaderVotes(stopHash, quorum.votes, filterType)
+	return quorum
+}
+
+// allPeersAgreed waits until CFHeaderQuorumTimeout has passed since we
+// started asking our peers for a checkpoint at queryStart, and then returns
+// whether all of the peers connected by then sent us the same filter header.
+func (b *blockManager) allPeersAgreed(quorum *cfHeaderQuorum,
+	queryStart time.Time) bool {
+
+	if _, ok := quorum.agreed(1); !ok {
+		return false
+	}
+
+	select {
+	case <-time.After(CFHeaderQuorumTimeout - time.Since(queryStart)):
+	case <-b.quit:
+		return false
+	}
+
+	connected := 0
+	for _, sp := range b.server.Peers() {
+		if sp.Connected() {
+			connected++
+		}
+	}
+	return quorum.answered() >= connected
+}
+
+// cfHeaderCopies returns how many peers must send us the same filter headers
+// for an interval before we take them without checking any of them against
+// the blocks. As we can only check the last of them against the checkpoint,
+// getting them from a single peer would let it make up the rest. It's two,
+// unless MinCFHeaderPeers has been lowered to accept a single peer.
+func cfHeaderCopies() int {
+	if MinCFHeaderPeers < 2 {
+		return 1
+	}
+	return 2
+}
+
+// getCFHeaders gets the filter headers of the passed type for the blocks
+// after startHeight up to and including endHeight, which must end at one of
+// the passed checkpoints. If the same filter headers are sent to us by copies
+// peers and nobody sends us others, they're returned as they are, unless
+// checkHeight isn't 0. Otherwise, every checkpoint must be backed
+// by filter headers that we got, and resolveCFHeaderConflict works out which
+// are right, checking the filter header at checkHeight against its block as
+// well. It returns nil if the filter headers couldn't be fetched or the
+// conflict couldn't be resolved.
+func (b *blockManager) getCFHeaders(startHeight, endHeight,
+	checkHeight int32, startHash, endHash chainhash.Hash,
+	checkpoints map[chainhash.Hash][]*serverPeer, copies int,
+	filterType *FilterType) []*chainhash.Hash {
+
+	count := int(endHeight - startHeight)
+	candidates := b.fetchCFHeaders(startHash, endHash, count,
+		checkpoints, copies, filterType)
+
+	check := -1
+	if checkHeight != 0 {
+		check = int(checkHeight - startHeight - 1)
+	}
+
+	if len(candidates) == 1 && len(checkpoints) == 1 {
+		c := candidates[0]
+		if count > 1 && len(c.peers) < copies {
+			log.Debugf("Only %d peers sent us the %s filter "+
+				"headers for blocks %d to %d, need %d",
+				len(c.peers), filterType, startHeight+1,
+				endHeight, copies)
+			return nil
+		}
+		if check < 0 {
+			return c.filterHeaders
+		}
+		return b.resolveCFHeaderConflict(startHeight, endHeight,
+			startHash, endHash, checkpoints, candidates, check,
+			filterType)
+	}
+
+	for checkpoint := range checkpoints {
+		found := false
+		for _, c := range candidates {
+			if c.checkpoint == checkpoint {
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Warnf("Couldn't get %s filter headers ending at "+
+				"%s for block %s", filterType, checkpoint,
+				endHash)
+			return nil
+		}
+	}
+
+	log.Warnf("Peers sent us %d versions of the %s filter headers for "+
+		"blocks %d to %d", len(candidates), filterType, startHeight+1,
+		endHeight)
+	return b.resolveCFHeaderConflict(startHeight, endHeight, startHash,
+		endHash, checkpoints, candidates, check, filterType)
+}
+
+// fetchCFHeaders fetches the count filter headers of the passed type for the
+// blocks following startHash up to and including stopHash. They're asked for
+// from all of the peers that sent us one of the passed checkpoints at once,
+// or from all of our peers if nobody did, which can only happen with a
+// checkpoint pinned in the config. We stop waiting once copies peers have
+// sent us the same filter headers ending at each of the checkpoints, or all
+// of them have answered. It returns each version of the filter headers we
+// got, along with the peers that sent it. Peers whose filter headers don't
+// end at one of the checkpoints are penalized.
+func (b *blockManager) fetchCFHeaders(startHash, stopHash chainhash.Hash,
+	count int, checkpoints map[chainhash.Hash][]*serverPeer, copies int,
+	filterType *FilterType) []*cfHeaderCandidate {
+
+	var candidates []*cfHeaderCandidate
+
+	// We already have the only filter header in an interval of one block.
+	if count == 1 {
+		for checkpoint, peers := range checkpoints {
+			filterHeader := checkpoint
+			candidates = append(candidates, &cfHeaderCandidate{
+				checkpoint:    checkpoint,
+				filterHeaders: []*chainhash.Hash{&filterHeader},
+				peers:         peers,
+			})
+		}
+		return candidates
+	}
+
+	var peers []*serverPeer
+	for _, voters := range checkpoints {
+		peers = append(peers, voters...)
+	}
+	if len(peers) == 0 {
+		peers = b.server.queryablePeers()
+	}
+
+	msg := wire.NewMsgGetCFHeaders()
+	msg.AddBlockLocatorHash(&startHash)
+	msg.HashStop = stopHash
+	msg.Extended = filterType.extended
+
+	// done returns whether enough peers have sent us filter headers
+	// ending at each of the checkpoints.
+	done := func() bool {
+		for checkpoint := range checkpoints {
+			confirmed := false
+			for _, c := range candidates {
+				if c.checkpoint == checkpoint &&
+					len(c.peers) >= copies {
+					confirmed = true
+					break
+				}
+			}
+			if !confirmed {
+				return false
+			}
+		}
+		return true
+	}
+
+	b.server.queryPeerSet(
+		peers,
+		msg,
+		func(sp *serverPeer, resp wire.Message, quit chan<- struct{},
+			peerQuit chan<- struct{}) {
+
+			cfheaders, ok := resp.(*wire.MsgCFHeaders)
+			if !ok || cfheaders.StopHash != stopHash ||
+				cfheaders.Extended != filterType.extended {
+				return
+			}
+
+			// The filter headers must fill the whole interval and
+			// end at one of the checkpoints. We can't tell whether
+			// the ones before it chain up to it without the
+			// filters, which is why we compare them between peers.
+			if len(cfheaders.HeaderHashes) != count {
+				return
+			}
+			close(peerQuit)
+			last := *cfheaders.HeaderHashes[count-1]
+			if _, ok := checkpoints[last]; !ok {
+				log.Warnf("%s filter headers from peer %s "+
+					"don't end at a checkpoint for block "+
+					"%s", filterType, sp.Addr(), stopHash)
+				sp.misbehaved(InvalidFilterHeader)
+				return
+			}
+
+			candidates = addCFHeaderCandidate(candidates, sp,
+				cfheaders.HeaderHashes)
+			if done() {
+				close(quit)
+			}
+		},
+	)
+	return candidates
+}
+
+// addCFHeaderCandidate records that the passed peer sent us the passed filter
+// headers, adding them to the candidates if nobody has sent them before. A
+// peer is only counted once for the same filter headers.
+func addCFHeaderCandidate(candidates []*cfHeaderCandidate, sp *serverPeer,
+	filterHeaders []*chainhash.Hash) []*cfHeaderCandidate {
+
+	for _, c := range candidates {
+		if !sameFilterHeaders(c.filterHeaders, filterHeaders) {
+			continue
+		}
+		for _, peer := range c.peers {
+			if peer == sp {
+				return candidates
+			}
+		}
+		c.peers = append(c.peers, sp)
+		return candidates
+	}
+	return append(candidates, &cfHeaderCandidate{
+		checkpoint:    *filterHeaders[len(filterHeaders)-1],
+		filterHeaders: filterHeaders,
+		peers:         []*serverPeer{sp},
+	})
+}
+
+// sameFilterHeaders returns whether the two runs of filter headers are the
+// same.
+func sameFilterHeaders(a, b []*chainhash.Hash) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// markCFHeadersSuspect records that the block at the passed height doesn't
+// match our filter headers of the passed type, and wakes up the cfheader sync
+// to fetch them again.
+func (b *blockManager) markCFHeadersSuspect(filterType *FilterType,
+	height int32) {
+
+	b.suspectMtx.Lock()
+	suspect, ok := b.suspectCFHeaders[filterType]
+	if !ok || height < suspect {
+		b.suspectCFHeaders[filterType] = height
+	}
+	b.suspectMtx.Unlock()
+
+	b.signalCFHeaderSync()
+}
+
+// cfilterMismatch is a filter a peer sent us that didn't match the filter
+// header we have for its block. Either the peer or our filter header is
+// wrong, so we only hold it against the peer once we've fetched the filter
+// header again and it's still the same.
+type cfilterMismatch struct {
+	sp           *serverPeer
+	blockHash    chainhash.Hash
+	height       int32
+	filterHeader chainhash.Hash
+}
+
+// reportCFilterMismatch records that the peer sent us a filter of the passed
+// type for the block at the passed height that doesn't match filterHeader,
+// our filter header for the block, and has our filter headers checked again
+// from that block on.
+func (b *blockManager) reportCFilterMismatch(sp *serverPeer,
+	filterType *FilterType, blockHash chainhash.Hash, height int32,
+	filterHeader chainhash.Hash) {
+
+	log.Warnf("%s filter for block %s received from %s doesn't match "+
+		"our filter header -- checking it again", filterType,
+		blockHash, sp)
+
+	b.suspectMtx.Lock()
+	b.cfilterMismatches[filterType] = append(
+		b.cfilterMismatches[filterType], &cfilterMismatch{
+			sp:           sp,
+			blockHash:    blockHash,
+			height:       height,
+			filterHeader: filterHeader,
+		})
+	b.suspectMtx.Unlock()
+
+	b.markCFHeadersSuspect(filterType, height)
+}
+
+// settleCFilterMismatches settles the mismatched filters of the passed type
+// for the blocks after startHeight up to and including endHeight, now that
+// their filter headers have been synced again. The peers that sent them are
+// penalized if our filter headers haven't changed, and forgiven if they have.
+func (b *blockManager) settleCFilterMismatches(filterType *FilterType,
+	startHeight, endHeight int32) {
+
+	var settled []*cfilterMismatch
+	b.suspectMtx.Lock()
+	mismatches := b.cfilterMismatches[filterType]
+	kept := mismatches[:0]
+	for _, m := range mismatches {
+		if m.height > startHeight && m.height <= endHeight {
+			settled = append(settled, m)
+		} else {
+			kept = append(kept, m)
+		}
+	}
+	if len(kept) == 0 {
+		delete(b.cfilterMismatches, filterType)
+	} else {
+		b.cfilterMismatches[filterType] = kept
+	}
+	b.suspectMtx.Unlock()
+
+	for _, m := range settled {
+		filterHeader, err := b.server.GetFilterHeader(m.blockHash,
+			filterType)
+		if err != nil || *filterHeader != m.filterHeader {
+			log.Debugf("Our %s filter header for block %s was "+
+				"wrong, not holding the filter from %s "+
+				"against it", filterType, m.blockHash, m.sp)
+			continue
+		}
+		m.sp.misbehaved(InvalidFilter)
+	}
+}
+
+// suspectCFHeaderHeight returns the lowest height of a block that doesn't
+// match our filter headers of the passed type, or 0 if there's none.
+func (b *blockManager) suspectCFHeaderHeight(filterType *FilterType) int32 {
+	b.suspectMtx.Lock()
+	defer b.suspectMtx.Unlock()
+
+	return b.suspectCFHeaders[filterType]
+}
+
+// clearSuspectCFHeaders forgets about the block at the passed height not
+// matching our filter headers of the passed type, now that they've been
+// checked against it, unless a lower block has turned up since.
+func (b *blockManager) clearSuspectCFHeaders(filterType *FilterType,
+	height int32) {
+
+	b.suspectMtx.Lock()
+	defer b.suspectMtx.Unlock()
+
+	if b.suspectCFHeaders[filterType] == height {
+		delete(b.suspectCFHeaders, filterType)
+	}
+}
+
+// rollBackCFHeaders deletes the filter headers and filters of the passed type
+// for the blocks after startHeight up to and including endHeight, so that
+// they're synced again.
+func (b *blockManager) rollBackCFHeaders(filterType *FilterType,
+	startHeight, endHeight int32) error {
+
+	blockHashes := make([]chainhash.Hash, 0, endHeight-startHeight)
+	keys := make([]interface{}, 0, 2*(endHeight-startHeight))
+	for height := startHeight + 1; height <= endHeight; height++ {
+		blockHash, err := b.server.GetBlockHashByHeight(uint32(height))
+		if err != nil {
+			return err
+		}
+		blockHashes = append(blockHashes, blockHash)
+		keys = append(keys, cfilterKey{
+			blockHash:  blockHash,
+			filterType: filterType,
+		}, cfheaderKey{
+			blockHash:  blockHash,
+			filterType: filterType,
+		})
+	}
+
+	err := b.server.dbUpdate(deleteFromBuckets(blockHashes,
+		filterType.headerBucket, filterType.filterBucket))
+	if err != nil {
+		return err
+	}
+	b.server.filterCache.remove(keys...)
+	return nil
+}
+
+// cfHeaderTip returns the height of the last block up to tipHeight that we
+// have a filter header of the passed type for. As filter headers are always
+// written in order, this is found with a binary search.
+func (b *blockManager) cfHeaderTip(filterType *FilterType,
+	tipHeight int32) (int32, error) {
+
+	var searchErr error
+	missing := sort.Search(int(tipHeight)+1, func(height int) bool {
+		blockHash, err := b.server.GetBlockHashByHeight(uint32(height))
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		_, err = b.server.GetFilterHeader(blockHash, filterType)
+		return err != nil
+	})
+	if searchErr != nil {
+		return 0, searchErr
+	}
+
+	// We always have the filter headers for the genesis block.
+	if missing == 0 {
+		return 0, nil
+	}
+	return int32(missing - 1), nil
+}
+
+// setLastCFHeaderHeight records the height up to which the filter header
+// chain of the passed type has been synced.
+func (b *blockManager) setLastCFHeaderHeight(filterType *FilterType,
+	height int32) {
+
+	atomic.StoreInt32(b.lastCFHeaderHeights[filterType], height)
+}
+
+// lastCFHeaderHeight returns the height up to which the filter header chain
+// of the passed type has been synced.
+func (b *blockManager) lastCFHeaderHeight(filterType *FilterType) int32 {
+	return atomic.LoadInt32(b.lastCFHeaderHeights[filterType])
+}
+
+// notifyCFHeadersConnected notifies block subscribers of the blocks we've
+// just written filter headers of the passed type for, in order.
+func (b *blockManager) notifyCFHeadersConnected(headers []wire.BlockHeader,
+	filterType *FilterType) {
+
+	b.server.mtxSubscribers.RLock()
+	defer b.server.mtxSubscribers.RUnlock()
+
+	for _, header := range headers {
+		for sub := range b.server.blockSubscribers {
+			if sub.filterType != filterType ||
+				sub.onConnect == nil {
+				continue
+			}
+			select {
+			case sub.onConnect <- header:
+			case <-sub.quit:
+			case <-b.quit:
+				return
+			}
+		}
+	}
+}
+
+// checkFilterHeaderVotes removes the filter headers for the passed block that
+// don't match its filter header checkpoint, if it has one, from the passed
+// map, and disconnects the peers that sent them.
+func (b *blockManager) checkFilterHeaderVotes(blockHash chainhash.Hash,
+	votes map[chainhash.Hash][]*serverPeer, filterType *FilterType) {
+
+	for filterHeader, peers := range votes {
+		err := b.server.checkFilterHeaderCheckpoint(blockHash,
+			filterHeader, filterType)
+		if err == nil {
+			continue
+		}
+		for _, sp := range peers {
+			log.Warnf("Peer %s sent a bad filter header: %s -- "+
+				"disconnecting", sp.Addr(), err)
+			sp.Disconnect()
+		}
+		delete(votes, filterHeader)
+	}
+}
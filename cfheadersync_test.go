@@ -0,0 +1,267 @@
+package neutrino
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcwallet/walletdb"
+)
+
+// TestCFHeaderQuorum checks that a filter header is only agreed on once
+// enough peers sent it and no peer sent another one.
+func TestCFHeaderQuorum(t *testing.T) {
+	peers := []*serverPeer{{}, {}, {}}
+	header1 := chainhash.Hash{1}
+	header2 := chainhash.Hash{2}
+
+	type vote struct {
+		peer         int
+		filterHeader chainhash.Hash
+	}
+	tests := []struct {
+		name  string
+		votes []vote
+		min   int
+
+		agreed      bool
+		conflicting bool
+		answered    int
+	}{
+		{
+			name: "no answers",
+			min:  1,
+		},
+		{
+			name:     "one answer",
+			votes:    []vote{{0, header1}},
+			min:      1,
+			agreed:   true,
+			answered: 1,
+		},
+		{
+			name:     "too few answers",
+			votes:    []vote{{0, header1}},
+			min:      2,
+			answered: 1,
+		},
+		{
+			name:     "enough answers",
+			votes:    []vote{{0, header1}, {1, header1}},
+			min:      2,
+			agreed:   true,
+			answered: 2,
+		},
+		{
+			name: "conflict",
+			votes: []vote{
+				{0, header1}, {1, header1}, {2, header2},
+			},
+			min:         2,
+			conflicting: true,
+			answered:    3,
+		},
+	}
+
+	for _, test := range tests {
+		quorum := newCFHeaderQuorum()
+		for _, v := range test.votes {
+			quorum.add(peers[v.peer], v.filterHeader)
+		}
+
+		filterHeader, agreed := quorum.agreed(test.min)
+		if agreed != test.agreed {
+			t.Errorf("%s: agreed is %v, want %v", test.name,
+				agreed, test.agreed)
+		}
+		if agreed && filterHeader != header1 {
+			t.Errorf("%s: agreed on %s, want %s", test.name,
+				filterHeader, header1)
+		}
+		if quorum.conflicting() != test.conflicting {
+			t.Errorf("%s: conflicting is %v, want %v", test.name,
+				quorum.conflicting(), test.conflicting)
+		}
+		if quorum.answered() != test.answered {
+			t.Errorf("%s: %d peers answered, want %d", test.name,
+				quorum.answered(), test.answered)
+		}
+	}
+}
+
+// TestAddCFHeaderCandidate checks that the filter headers our peers send us
+// are grouped by version, counting each peer once per version.
+func TestAddCFHeaderCandidate(t *testing.T) {
+	peers := []*serverPeer{{}, {}, {}}
+	headers := func(seeds ...byte) []*chainhash.Hash {
+		var filterHeaders []*chainhash.Hash
+		for _, seed := range seeds {
+			filterHeaders = append(filterHeaders,
+				&chainhash.Hash{seed})
+		}
+		return filterHeaders
+	}
+
+	type response struct {
+		peer          int
+		filterHeaders []*chainhash.Hash
+	}
+	tests := []struct {
+		name      string
+		responses []response
+
+		// peers is the number of peers that sent each candidate, in
+		// the order they were first sent.
+		peers []int
+	}{
+		{
+			name: "same filter headers",
+			responses: []response{
+				{0, headers(1, 2, 3)},
+				{1, headers(1, 2, 3)},
+			},
+			peers: []int{2},
+		},
+		{
+			name: "sent twice",
+			responses: []response{
+				{0, headers(1, 2, 3)},
+				{0, headers(1, 2, 3)},
+			},
+			peers: []int{1},
+		},
+		{
+			name: "same checkpoint",
+			responses: []response{
+				{0, headers(1, 2, 3)},
+				{1, headers(1, 4, 3)},
+				{2, headers(1, 2, 3)},
+			},
+			peers: []int{2, 1},
+		},
+		{
+			name: "different checkpoints",
+			responses: []response{
+				{0, headers(1, 2, 3)},
+				{1, headers(1, 2, 4)},
+			},
+			peers: []int{1, 1},
+		},
+	}
+
+	for _, test := range tests {
+		var candidates []*cfHeaderCandidate
+		for _, resp := range test.responses {
+			candidates = addCFHeaderCandidate(candidates,
+				peers[resp.peer], resp.filterHeaders)
+		}
+		if len(candidates) != len(test.peers) {
+			t.Errorf("%s: got %d candidates, want %d", test.name,
+				len(candidates), len(test.peers))
+			continue
+		}
+		for i, c := range candidates {
+			if len(c.peers) != test.peers[i] {
+				t.Errorf("%s: candidate %d sent by %d peers, "+
+					"want %d", test.name, i, len(c.peers),
+					test.peers[i])
+			}
+			last := c.filterHeaders[len(c.filterHeaders)-1]
+			if c.checkpoint != *last {
+				t.Errorf("%s: candidate %d ends at %s, not "+
+					"its checkpoint %s", test.name, i,
+					last, c.checkpoint)
+			}
+		}
+	}
+}
+
+// TestSettleCFilterMismatches checks that a peer that sent us a filter that
+// doesn't match our filter header is only penalized once the filter headers
+// of its block have been synced again, and only if our filter header hasn't
+// changed.
+func TestSettleCFilterMismatches(t *testing.T) {
+	s, cleanup := newTestChainService(t)
+	defer cleanup()
+	b := s.blockManager
+	filterType := filterTypes[0]
+
+	nodes := makeTestHeaders(testGenesis, 0, 10, 0)
+	putFilterHeaders := func(bucket walletdb.ReadWriteBucket) error {
+		for _, node := range nodes {
+			err := putFilterHeader(node.header.BlockHash(),
+				filterType, testFilterHeader(node.height,
+					filterType))(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := s.headers.writeHeaders(nodes, putFilterHeaders); err != nil {
+		t.Fatalf("unable to write headers: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		height int32
+
+		// changed is whether our filter header for the block is
+		// different once it has been synced again.
+		changed bool
+	}{
+		{
+			name:   "invalid filter",
+			height: 3,
+		},
+		{
+			name:    "wrong filter header",
+			height:  5,
+			changed: true,
+		},
+		{
+			name:   "not synced again yet",
+			height: 8,
+		},
+	}
+
+	peers := make([]*serverPeer, len(tests))
+	for i, test := range tests {
+		peers[i] = &serverPeer{}
+		node := nodes[test.height-1]
+		filterHeader := testFilterHeader(test.height, filterType)
+		if test.changed {
+			filterHeader = chainhash.Hash{1}
+		}
+		b.reportCFilterMismatch(peers[i], filterType,
+			node.header.BlockHash(), test.height, filterHeader)
+	}
+	if suspect := b.suspectCFHeaderHeight(filterType); suspect != 3 {
+		t.Errorf("filter headers suspect from block %d, want 3",
+			suspect)
+	}
+
+	b.settleCFilterMismatches(filterType, 0, 6)
+	for i, test := range tests {
+		want := uint32(0)
+		if test.height <= 6 && !test.changed {
+			want = 1
+		}
+		got := peers[i].MisbehaviorCount(InvalidFilter)
+		if got != want {
+			t.Errorf("%s: peer sent %d invalid filters, want %d",
+				test.name, got, want)
+		}
+	}
+	if n := len(b.cfilterMismatches[filterType]); n != 1 {
+		t.Errorf("%d mismatched filters left to settle, want 1", n)
+	}
+
+	b.settleCFilterMismatches(filterType, 6, 10)
+	if got := peers[2].MisbehaviorCount(InvalidFilter); got != 1 {
+		t.Errorf("%s: peer sent %d invalid filters, want 1",
+			tests[2].name, got)
+	}
+	if _, ok := b.cfilterMismatches[filterType]; ok {
+		t.Errorf("mismatched filters left after settling all of them")
+	}
+}
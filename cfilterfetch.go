@@ -0,0 +1,57 @@
+// NOTE: THIS API IS UNSTABLE RIGHT NOW.
+
+package neutrino
+
+import (
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcutil/gcs"
+)
+
+// cfilterKey identifies the filter of a given type for a block.
+type cfilterKey struct {
+	blockHash  chainhash.Hash
+	filterType *FilterType
+}
+
+// cfilterFetch is a fetch of a filter from the network that's in progress.
+// Everyone else asking for the filter in the meantime waits for it to finish
+// and gets its filter, or fetches the filter on their own if it fails.
+type cfilterFetch struct {
+	// done is closed once filter and err are set.
+	done   chan struct{}
+	filter *gcs.Filter
+	err    error
+}
+
+// startCFilterFetch registers a fetch of the filter with the passed key and
+// returns it along with true, unless someone else is fetching the filter
+// already, in which case their fetch is returned along with false.
+func (s *ChainService) startCFilterFetch(key cfilterKey) (*cfilterFetch,
+	bool) {
+
+	s.mtxCFilterFetches.Lock()
+	defer s.mtxCFilterFetches.Unlock()
+
+	if fetch, ok := s.cfilterFetches[key]; ok {
+		return fetch, false
+	}
+	fetch := &cfilterFetch{
+		done: make(chan struct{}),
+	}
+	s.cfilterFetches[key] = fetch
+	return fetch, true
+}
+
+// finishCFilterFetch hands the result of a fetch started by startCFilterFetch
+// to everyone waiting for it.
+func (s *ChainService) finishCFilterFetch(key cfilterKey, fetch *cfilterFetch,
+	filter *gcs.Filter, err error) {
+
+	s.mtxCFilterFetches.Lock()
+	delete(s.cfilterFetches, key)
+	s.mtxCFilterFetches.Unlock()
+
+	fetch.filter = filter
+	fetch.err = err
+	close(fetch.done)
+}
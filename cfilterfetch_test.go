@@ -0,0 +1,119 @@
+package neutrino
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/gcs"
+)
+
+// TestGetCFilterSharedFetch checks that GetCFilter calls for a filter that's
+// being fetched already wait for that fetch and share its filter, that a
+// fetch of another filter goes ahead in the meantime, and that if the shared
+// fetch fails, the callers fetch the filter again rather than all getting its
+// error.
+func TestGetCFilterSharedFetch(t *testing.T) {
+	const (
+		numHeaders = 2
+		numCallers = 3
+	)
+
+	tests := []struct {
+		name string
+
+		// err is the error the shared fetch fails with, if any.
+		err error
+	}{
+		{
+			name: "shared fetch succeeds",
+		},
+		{
+			name: "shared fetch fails",
+			err:  errors.New("shared fetch failed"),
+		},
+	}
+
+	for _, test := range tests {
+		s, cleanup := newTestChainService(t)
+		nodes, filters := writeTestFilterChain(t, s, numHeaders,
+			numHeaders)
+
+		var responses []wire.Message
+		for i, node := range nodes {
+			responses = append(responses,
+				testCFilterMsg(node, filters[i]))
+		}
+		done := make(chan struct{})
+		sp := newTestFetchPeer(t, s, 0, numHeaders)
+		serveTestPeers(s, []*serverPeer{sp}, done)
+		go respondToQueries(sp, responses, done)
+
+		// Someone else is fetching the filter of the first block, so
+		// the callers asking for it wait for them.
+		blockHash := nodes[0].header.BlockHash()
+		key := cfilterKey{blockHash: blockHash, filterType: BasicFilter}
+		fetch, _ := s.startCFilterFetch(key)
+
+		type result struct {
+			filter *gcs.Filter
+			err    error
+		}
+		results := make(chan result, numCallers)
+		for i := 0; i < numCallers; i++ {
+			go func() {
+				filter, err := s.GetCFilter(blockHash,
+					BasicFilter, Timeout(time.Second))
+				results <- result{filter, err}
+			}()
+		}
+
+		// The filter of the other block doesn't have to wait.
+		filter, err := s.GetCFilter(nodes[1].header.BlockHash(),
+			BasicFilter, Timeout(time.Second))
+		if err != nil || filter == nil {
+			t.Errorf("%s: unable to get filter of another block: "+
+				"%v", test.name, err)
+		}
+
+		// Give the callers time to start waiting before the shared
+		// fetch finishes.
+		time.Sleep(100 * time.Millisecond)
+		var sharedFilter *gcs.Filter
+		if test.err == nil {
+			sharedFilter = filters[0]
+		}
+		s.finishCFilterFetch(key, fetch, sharedFilter, test.err)
+
+		for i := 0; i < numCallers; i++ {
+			var res result
+			select {
+			case res = <-results:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("%s: GetCFilter didn't return",
+					test.name)
+			}
+			if res.err != nil {
+				t.Errorf("%s: unable to get filter: %s",
+					test.name, res.err)
+				continue
+			}
+			if sharedFilter != nil && res.filter != sharedFilter {
+				t.Errorf("%s: caller didn't get the shared "+
+					"filter", test.name)
+				continue
+			}
+			if res.filter == nil || !bytes.Equal(
+				res.filter.NBytes(), filters[0].NBytes()) {
+
+				t.Errorf("%s: got wrong filter", test.name)
+			}
+		}
+
+		close(done)
+		sp.Disconnect()
+		cleanup()
+	}
+}
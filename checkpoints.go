@@ -0,0 +1,104 @@
+// NOTE: THIS API IS UNSTABLE RIGHT NOW.
+
+package neutrino
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// FilterHeaderCheckpoint pins the block at a given height along with its basic
+// and extended filter headers. Filter header checkpoints are also used as
+// block header checkpoints.
+type FilterHeaderCheckpoint struct {
+	Height      int32
+	Hash        chainhash.Hash
+	BasicHeader chainhash.Hash
+	ExtHeader   chainhash.Hash
+}
+
+// mergeCheckpoints combines the built-in checkpoints of the chain with the
+// user-supplied block header and filter header checkpoints into a single list
+// sorted by height. It returns an error if two checkpoints disagree about the
+// block at the same height.
+func mergeCheckpoints(builtin, extra []chaincfg.Checkpoint,
+	filterCheckpoints []FilterHeaderCheckpoint) ([]chaincfg.Checkpoint,
+	error) {
+
+	byHeight := make(map[int32]*chainhash.Hash)
+	add := func(height int32, hash *chainhash.Hash) error {
+		if known, ok := byHeight[height]; ok {
+			if *known != *hash {
+				return fmt.Errorf("checkpoints at height %d "+
+					"conflict: %s != %s", height, known,
+					hash)
+			}
+			return nil
+		}
+		byHeight[height] = hash
+		return nil
+	}
+
+	for _, cp := range builtin {
+		if err := add(cp.Height, cp.Hash); err != nil {
+			return nil, err
+		}
+	}
+	for _, cp := range extra {
+		if cp.Hash == nil {
+			return nil, fmt.Errorf("checkpoint at height %d has "+
+				"no hash", cp.Height)
+		}
+		if err := add(cp.Height, cp.Hash); err != nil {
+			return nil, err
+		}
+	}
+	for i := range filterCheckpoints {
+		cp := &filterCheckpoints[i]
+		if err := add(cp.Height, &cp.Hash); err != nil {
+			return nil, err
+		}
+	}
+
+	checkpoints := make([]chaincfg.Checkpoint, 0, len(byHeight))
+	for height, hash := range byHeight {
+		checkpoints = append(checkpoints, chaincfg.Checkpoint{
+			Height: height,
+			Hash:   hash,
+		})
+	}
+	sort.Slice(checkpoints, func(i, j int) bool {
+		return checkpoints[i].Height < checkpoints[j].Height
+	})
+	return checkpoints, nil
+}
+
+// filterHeaderCheckpoint returns the filter header of the passed type that the
+// filter header checkpoints pin for the passed block, if there is one.
+func (s *ChainService) filterHeaderCheckpoint(blockHash chainhash.Hash,
+	filterType *FilterType) (chainhash.Hash, bool) {
+
+	cp, ok := s.filterCheckpoints[blockHash]
+	if !ok {
+		return chainhash.Hash{}, false
+	}
+	return filterType.checkpointHeader(&cp), true
+}
+
+// checkFilterHeaderCheckpoint returns an error if there's a filter header
+// checkpoint for the passed block and the passed filter header doesn't match
+// it.
+func (s *ChainService) checkFilterHeaderCheckpoint(blockHash chainhash.Hash,
+	filterHeader chainhash.Hash, filterType *FilterType) error {
+
+	expected, ok := s.filterHeaderCheckpoint(blockHash, filterType)
+	if !ok || filterHeader == expected {
+		return nil
+	}
+	return fmt.Errorf("%s filter header %s for block %s at height %d "+
+		"doesn't match checkpoint %s", filterType, filterHeader,
+		blockHash, s.filterCheckpoints[blockHash].Height, expected)
+}
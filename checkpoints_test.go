@@ -0,0 +1,128 @@
+package neutrino
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// TestMergeCheckpoints checks that built-in, extra and filter header
+// checkpoints are merged into a single sorted list, and that conflicting or
+// incomplete checkpoints are rejected.
+func TestMergeCheckpoints(t *testing.T) {
+	hash := func(b byte) *chainhash.Hash {
+		return &chainhash.Hash{b}
+	}
+	builtin := []chaincfg.Checkpoint{
+		{Height: 100, Hash: hash(1)},
+		{Height: 300, Hash: hash(3)},
+	}
+
+	tests := []struct {
+		name              string
+		extra             []chaincfg.Checkpoint
+		filterCheckpoints []FilterHeaderCheckpoint
+
+		// want is the list of merged checkpoints, or nil if merging
+		// should fail.
+		want []chaincfg.Checkpoint
+	}{
+		{
+			name: "built-in only",
+			want: builtin,
+		},
+		{
+			name: "extra checkpoints",
+			extra: []chaincfg.Checkpoint{
+				{Height: 400, Hash: hash(4)},
+				{Height: 200, Hash: hash(2)},
+			},
+			want: []chaincfg.Checkpoint{
+				{Height: 100, Hash: hash(1)},
+				{Height: 200, Hash: hash(2)},
+				{Height: 300, Hash: hash(3)},
+				{Height: 400, Hash: hash(4)},
+			},
+		},
+		{
+			name: "filter header checkpoints",
+			filterCheckpoints: []FilterHeaderCheckpoint{
+				{Height: 50, Hash: *hash(5)},
+				{Height: 300, Hash: *hash(3)},
+			},
+			want: []chaincfg.Checkpoint{
+				{Height: 50, Hash: hash(5)},
+				{Height: 100, Hash: hash(1)},
+				{Height: 300, Hash: hash(3)},
+			},
+		},
+		{
+			name: "duplicates that agree",
+			extra: []chaincfg.Checkpoint{
+				{Height: 100, Hash: hash(1)},
+				{Height: 200, Hash: hash(2)},
+			},
+			filterCheckpoints: []FilterHeaderCheckpoint{
+				{Height: 200, Hash: *hash(2)},
+			},
+			want: []chaincfg.Checkpoint{
+				{Height: 100, Hash: hash(1)},
+				{Height: 200, Hash: hash(2)},
+				{Height: 300, Hash: hash(3)},
+			},
+		},
+		{
+			name: "extra conflicts with built-in",
+			extra: []chaincfg.Checkpoint{
+				{Height: 100, Hash: hash(9)},
+			},
+		},
+		{
+			name: "filter conflicts with extra",
+			extra: []chaincfg.Checkpoint{
+				{Height: 200, Hash: hash(2)},
+			},
+			filterCheckpoints: []FilterHeaderCheckpoint{
+				{Height: 200, Hash: *hash(9)},
+			},
+		},
+		{
+			name: "extra without hash",
+			extra: []chaincfg.Checkpoint{
+				{Height: 200},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := mergeCheckpoints(builtin, test.extra,
+			test.filterCheckpoints)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: merged invalid checkpoints",
+					test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unable to merge checkpoints: %s",
+				test.name, err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %d checkpoints, want %d", test.name,
+				len(got), len(test.want))
+			continue
+		}
+		for i, cp := range got {
+			want := test.want[i]
+			if cp.Height != want.Height || *cp.Hash != *want.Hash {
+				t.Errorf("%s: checkpoint %d is %s at height "+
+					"%d, want %s at height %d", test.name,
+					i, cp.Hash, cp.Height, want.Hash,
+					want.Height)
+			}
+		}
+	}
+}
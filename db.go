@@ -5,6 +5,7 @@ package neutrino
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"time"
 
@@ -19,7 +20,7 @@ import (
 
 const (
 	// LatestDBVersion is the most recent database version.
-	LatestDBVersion = 1
+	LatestDBVersion = 2
 )
 
 var (
@@ -28,6 +29,12 @@ var (
 	latestDBVersion uint32 = LatestDBVersion
 )
 
+var (
+	// ErrFilterHeaderNotFound is returned by GetFilterHeader if we don't
+	// have the filter header it's asked for.
+	ErrFilterHeaderNotFound = errors.New("filter header not found")
+)
+
 // Key names for various database fields.
 var (
 	// Bucket names.
@@ -38,10 +45,24 @@ var (
 	extHeaderBucketName   = []byte("efh")
 	extFilterBucketName   = []byte("ef")
 
+	// matchedFilterBucketName is the name of the bucket that holds the
+	// hashes of the blocks whose filters matched a rescan, for the
+	// KeepMatchedFilters storage policy.
+	matchedFilterBucketName = []byte("mf")
+
+	// matchedBlockBucketName is the name of the bucket that indexes the
+	// blocks stored with Config.PersistMatchedBlocks by block hash.
+	matchedBlockBucketName = []byte("mb")
+
 	// Db related key names (main bucket).
 	dbVersionName      = []byte("dbver")
 	dbCreateDateName   = []byte("dbcreated")
 	maxBlockHeightName = []byte("maxblockheight")
+
+	// filterPruneHeightName is the key of the height up to which the
+	// filters have been pruned, followed by the storage mode they were
+	// pruned for.
+	filterPruneHeightName = []byte("filterpruneheight")
 )
 
 // uint32ToBytes converts a 32 bit unsigned integer into a 4-byte slice in
@@ -117,48 +138,23 @@ func putMaxBlockHeight(maxBlockHeight uint32) dbUpdateOption {
 	}
 }
 
-// putBlock stores the provided block header and height, keyed to the block
-// hash, in the database.
-func (s *ChainService) putBlock(header wire.BlockHeader, height uint32) error {
-	return s.dbUpdate(putBlock(header, height))
-}
-
-func putBlock(header wire.BlockHeader, height uint32) dbUpdateOption {
-	return func(bucket walletdb.ReadWriteBucket) error {
-		var buf bytes.Buffer
-		err := header.Serialize(&buf)
-		if err != nil {
-			return err
-		}
-		_, err = buf.Write(uint32ToBytes(height))
-		if err != nil {
-			return err
-		}
-		blockHash := header.BlockHash()
-		bhBucket := bucket.NestedReadWriteBucket(blockHeaderBucketName)
-		err = bhBucket.Put(blockHash[:], buf.Bytes())
-		if err != nil {
-			return fmt.Errorf("failed to store SPV block info: %s",
-				err)
-		}
-		err = bhBucket.Put(uint32ToBytes(height), blockHash[:])
-		if err != nil {
-			return fmt.Errorf("failed to store block height info:"+
-				" %s", err)
-		}
-		return nil
-	}
+// putBlockBatch stores the provided block headers, which must be in order of
+// increasing height, and marks the last of them as the tip of the chain. This
+// is done in a single transaction so the entire batch is atomic.
+func (s *ChainService) putBlockBatch(batch []*headerNode) error {
+	return s.headers.writeHeaders(batch)
 }
 
 // putFilter stores the provided filter, keyed to the block hash, in the
-// appropriate filter bucket in the database.
-// TODO(roasbeef): no longer needed as putExtFilter and putBasicFilter exist
-func (s *ChainService) putFilter(blockHash chainhash.Hash, bucketName []byte,
-	filter *gcs.Filter) error {
-	return s.dbUpdate(putFilter(blockHash, bucketName, filter))
+// filter bucket of the passed filter type in the database. If the filters
+// have been pruned past the block, the prune height is lowered below it, so
+// that the filter is pruned again if the storage policy doesn't keep it.
+func (s *ChainService) putFilter(blockHash chainhash.Hash,
+	filterType *FilterType, filter *gcs.Filter) error {
+	return s.dbUpdate(putFilter(blockHash, filterType, filter))
 }
 
-func putFilter(blockHash chainhash.Hash, bucketName []byte,
+func putFilter(blockHash chainhash.Hash, filterType *FilterType,
 	filter *gcs.Filter) dbUpdateOption {
 	return func(bucket walletdb.ReadWriteBucket) error {
 		var buf bytes.Buffer
@@ -166,98 +162,103 @@ func putFilter(blockHash chainhash.Hash, bucketName []byte,
 		if err != nil {
 			return err
 		}
-		filterBucket := bucket.NestedReadWriteBucket(bucketName)
+		filterBucket := bucket.NestedReadWriteBucket(
+			filterType.filterBucket)
 		err = filterBucket.Put(blockHash[:], buf.Bytes())
 		if err != nil {
-			return fmt.Errorf("failed to store filter: %s", err)
+			return fmt.Errorf("failed to store %s filter: %s",
+				filterType, err)
 		}
-		return nil
+		return lowerFilterPruneHeight(blockHash)(bucket)
 	}
 }
 
-// putBasicFilter stores the provided filter, keyed to the block hash, in the
-// basic filter bucket in the database.
-func (s *ChainService) putBasicFilter(blockHash chainhash.Hash,
-	filter *gcs.Filter) error {
-	return s.dbUpdate(putBasicFilter(blockHash, filter))
-}
-
-func putBasicFilter(blockHash chainhash.Hash,
-	filter *gcs.Filter) dbUpdateOption {
-	return putFilter(blockHash, basicFilterBucketName, filter)
-}
-
-// putExtFilter stores the provided filter, keyed to the block hash, in the
-// extended filter bucket in the database.
-func (s *ChainService) putExtFilter(blockHash chainhash.Hash,
-	filter *gcs.Filter) error {
-	return s.dbUpdate(putExtFilter(blockHash, filter))
-}
-
-func putExtFilter(blockHash chainhash.Hash,
-	filter *gcs.Filter) dbUpdateOption {
-	return putFilter(blockHash, extFilterBucketName, filter)
+// putFilterHeader stores the provided header, keyed to the block hash, in the
+// filter header bucket of the passed filter type in the database.
+func (s *ChainService) putFilterHeader(blockHash chainhash.Hash,
+	filterType *FilterType, filterTip chainhash.Hash) error {
+	return s.dbUpdate(putFilterHeader(blockHash, filterType, filterTip))
 }
 
-// putHeader stores the provided header, keyed to the block hash, in the
-// appropriate filter header bucket in the database.
-func (s *ChainService) putHeader(blockHash chainhash.Hash, bucketName []byte,
-	filterTip chainhash.Hash) error {
-	return s.dbUpdate(putHeader(blockHash, bucketName, filterTip))
-}
-
-func putHeader(blockHash chainhash.Hash, bucketName []byte,
+func putFilterHeader(blockHash chainhash.Hash, filterType *FilterType,
 	filterTip chainhash.Hash) dbUpdateOption {
 	return func(bucket walletdb.ReadWriteBucket) error {
-		headerBucket := bucket.NestedReadWriteBucket(bucketName)
+		headerBucket := bucket.NestedReadWriteBucket(
+			filterType.headerBucket)
 		err := headerBucket.Put(blockHash[:], filterTip[:])
 		if err != nil {
-			return fmt.Errorf("failed to store filter header: %s", err)
+			return fmt.Errorf("failed to store %s filter header: "+
+				"%s", filterType, err)
 		}
 		return nil
 	}
 }
 
-// putBasicHeader stores the provided header, keyed to the block hash, in the
-// basic filter header bucket in the database.
-func (s *ChainService) putBasicHeader(blockHash chainhash.Hash,
-	filterTip chainhash.Hash) error {
-	return s.dbUpdate(putBasicHeader(blockHash, filterTip))
+// deleteFilterHeaders returns a database update that deletes the filter
+// headers of every type for the passed blocks.
+func deleteFilterHeaders(blockHashes []chainhash.Hash) dbUpdateOption {
+	bucketNames := make([][]byte, 0, len(filterTypes))
+	for _, filterType := range filterTypes {
+		bucketNames = append(bucketNames, filterType.headerBucket)
+	}
+	return deleteFromBuckets(blockHashes, bucketNames...)
 }
 
-func putBasicHeader(blockHash chainhash.Hash,
-	filterTip chainhash.Hash) dbUpdateOption {
-	return putHeader(blockHash, basicHeaderBucketName, filterTip)
+// deleteFilters returns a database update that deletes the filters of every
+// type stored for the passed blocks.
+func deleteFilters(blockHashes []chainhash.Hash) dbUpdateOption {
+	bucketNames := make([][]byte, 0, len(filterTypes))
+	for _, filterType := range filterTypes {
+		bucketNames = append(bucketNames, filterType.filterBucket)
+	}
+	return deleteFromBuckets(blockHashes, bucketNames...)
 }
 
-// putExtHeader stores the provided header, keyed to the block hash, in the
-// extended filter header bucket in the database.
-func (s *ChainService) putExtHeader(blockHash chainhash.Hash,
-	filterTip chainhash.Hash) error {
-	return s.dbUpdate(putExtHeader(blockHash, filterTip))
+// deleteFromBuckets returns a database update that deletes the entries keyed
+// to the passed block hashes from each of the named buckets.
+func deleteFromBuckets(blockHashes []chainhash.Hash,
+	bucketNames ...[]byte) dbUpdateOption {
+	return func(bucket walletdb.ReadWriteBucket) error {
+		for _, bucketName := range bucketNames {
+			nested := bucket.NestedReadWriteBucket(bucketName)
+			for _, blockHash := range blockHashes {
+				err := nested.Delete(blockHash[:])
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
 }
 
-func putExtHeader(blockHash chainhash.Hash,
-	filterTip chainhash.Hash) dbUpdateOption {
-	return putHeader(blockHash, extHeaderBucketName, filterTip)
-}
+// GetFilter retrieves the filter of the passed type, keyed to the provided
+// block hash, from the filter cache or the database. Unlike GetCFilter, it
+// never asks the network.
+func (s *ChainService) GetFilter(blockHash chainhash.Hash,
+	filterType *FilterType) (*gcs.Filter, error) {
+	key := cfilterKey{blockHash: blockHash, filterType: filterType}
+	if filter, ok := s.filterCache.get(key); ok {
+		return filter.(*gcs.Filter), nil
+	}
 
-// getFilter retreives the filter, keyed to the provided block hash, from the
-// appropriate filter bucket in the database.
-func (s *ChainService) getFilter(blockHash chainhash.Hash,
-	bucketName []byte) (*gcs.Filter, error) {
+	epoch := s.filterCache.currentEpoch()
 	var filter gcs.Filter
-	err := s.dbView(getFilter(blockHash, bucketName, &filter))
+	err := s.dbView(getFilter(blockHash, filterType, &filter))
+	if err == nil {
+		s.filterCache.put(key, &filter, uint64(len(filter.NBytes())),
+			epoch)
+	}
 	return &filter, err
 }
 
-func getFilter(blockHash chainhash.Hash, bucketName []byte,
+func getFilter(blockHash chainhash.Hash, filterType *FilterType,
 	filter *gcs.Filter) dbViewOption {
 	return func(bucket walletdb.ReadBucket) error {
-		filterBucket := bucket.NestedReadBucket(bucketName)
+		filterBucket := bucket.NestedReadBucket(filterType.filterBucket)
 		filterBytes := filterBucket.Get(blockHash[:])
 		if len(filterBytes) == 0 {
-			return fmt.Errorf("failed to get filter")
+			return fmt.Errorf("failed to get %s filter", filterType)
 		}
 		calcFilter, err := gcs.FromNBytes(builder.DefaultP, filterBytes)
 		if calcFilter != nil {
@@ -267,48 +268,36 @@ func getFilter(blockHash chainhash.Hash, bucketName []byte,
 	}
 }
 
-// GetBasicFilter retrieves the filter, keyed to the provided block hash, from
-// the basic filter bucket in the database.
-func (s *ChainService) GetBasicFilter(blockHash chainhash.Hash) (*gcs.Filter,
-	error) {
-	var filter gcs.Filter
-	err := s.dbView(getBasicFilter(blockHash, &filter))
-	return &filter, err
-}
-
-func getBasicFilter(blockHash chainhash.Hash, filter *gcs.Filter) dbViewOption {
-	return getFilter(blockHash, basicFilterBucketName, filter)
-}
-
-// GetExtFilter retrieves the filter, keyed to the provided block hash, from
-// the extended filter bucket in the database.
-func (s *ChainService) GetExtFilter(blockHash chainhash.Hash) (*gcs.Filter,
-	error) {
-	var filter gcs.Filter
-	err := s.dbView(getExtFilter(blockHash, &filter))
-	return &filter, err
-}
-
-func getExtFilter(blockHash chainhash.Hash, filter *gcs.Filter) dbViewOption {
-	return getFilter(blockHash, extFilterBucketName, filter)
-}
+// GetFilterHeader retrieves the filter header of the passed type, keyed to the
+// provided block hash, from the filter cache or the database. It returns
+// ErrFilterHeaderNotFound if we don't have the filter header.
+func (s *ChainService) GetFilterHeader(blockHash chainhash.Hash,
+	filterType *FilterType) (*chainhash.Hash, error) {
+	key := cfheaderKey{blockHash: blockHash, filterType: filterType}
+	if filterTip, ok := s.filterCache.get(key); ok {
+		// Callers may modify the hash we return, so they get a copy.
+		filterTipCopy := *filterTip.(*chainhash.Hash)
+		return &filterTipCopy, nil
+	}
 
-// getHeader retrieves the header, keyed to the provided block hash, from the
-// appropriate filter header bucket in the database.
-func (s *ChainService) getHeader(blockHash chainhash.Hash,
-	bucketName []byte) (*chainhash.Hash, error) {
+	epoch := s.filterCache.currentEpoch()
 	var filterTip chainhash.Hash
-	err := s.dbView(getHeader(blockHash, bucketName, &filterTip))
+	err := s.dbView(getFilterHeader(blockHash, filterType, &filterTip))
+	if err == nil {
+		filterTipCopy := filterTip
+		s.filterCache.put(key, &filterTipCopy, chainhash.HashSize,
+			epoch)
+	}
 	return &filterTip, err
 }
 
-func getHeader(blockHash chainhash.Hash, bucketName []byte,
+func getFilterHeader(blockHash chainhash.Hash, filterType *FilterType,
 	filterTip *chainhash.Hash) dbViewOption {
 	return func(bucket walletdb.ReadBucket) error {
-		headerBucket := bucket.NestedReadBucket(bucketName)
+		headerBucket := bucket.NestedReadBucket(filterType.headerBucket)
 		headerBytes := headerBucket.Get(blockHash[:])
 		if headerBytes == nil {
-			return fmt.Errorf("failed to get filter header")
+			return ErrFilterHeaderNotFound
 		}
 		calcFilterTip, err := chainhash.NewHash(headerBytes)
 		if calcFilterTip != nil {
@@ -318,153 +307,44 @@ func getHeader(blockHash chainhash.Hash, bucketName []byte,
 	}
 }
 
-// GetBasicHeader retrieves the header, keyed to the provided block hash, from
-// the basic filter header bucket in the database.
-func (s *ChainService) GetBasicHeader(blockHash chainhash.Hash) (
-	*chainhash.Hash, error) {
-	var filterTip chainhash.Hash
-	err := s.dbView(getBasicHeader(blockHash, &filterTip))
-	return &filterTip, err
-}
-
-func getBasicHeader(blockHash chainhash.Hash,
-	filterTip *chainhash.Hash) dbViewOption {
-	return getHeader(blockHash, basicHeaderBucketName, filterTip)
-}
-
-// GetExtHeader retrieves the header, keyed to the provided block hash, from the
-// extended filter header bucket in the database.
-func (s *ChainService) GetExtHeader(blockHash chainhash.Hash) (*chainhash.Hash,
-	error) {
-	var filterTip chainhash.Hash
-	err := s.dbView(getExtHeader(blockHash, &filterTip))
-	return &filterTip, err
-}
-
-func getExtHeader(blockHash chainhash.Hash,
-	filterTip *chainhash.Hash) dbViewOption {
-	return getHeader(blockHash, extHeaderBucketName, filterTip)
-}
-
 // rollBackLastBlock rolls back the last known block and returns the BlockStamp
 // representing the new last known block.
 func (s *ChainService) rollBackLastBlock() (*waddrmgr.BlockStamp, error) {
-	var bs waddrmgr.BlockStamp
-	err := s.dbUpdate(rollBackLastBlock(&bs))
-	return &bs, err
-}
-
-func rollBackLastBlock(bs *waddrmgr.BlockStamp) dbUpdateOption {
-	return func(bucket walletdb.ReadWriteBucket) error {
-		headerBucket := bucket.NestedReadWriteBucket(
-			blockHeaderBucketName)
-		var sync waddrmgr.BlockStamp
-		err := syncedTo(&sync)(bucket)
-		if err != nil {
-			return err
-		}
-		err = headerBucket.Delete(sync.Hash[:])
-		if err != nil {
-			return err
-		}
-		err = headerBucket.Delete(uint32ToBytes(uint32(sync.Height)))
-		if err != nil {
-			return err
-		}
-		err = putMaxBlockHeight(uint32(sync.Height - 1))(bucket)
-		if err != nil {
-			return err
-		}
-		sync = waddrmgr.BlockStamp{}
-		err = syncedTo(&sync)(bucket)
-		if sync != (waddrmgr.BlockStamp{}) {
-			*bs = sync
-		}
-		return err
+	header, _, err := s.headers.chainTip()
+	if err != nil {
+		return nil, err
+	}
+	bs, err := s.headers.rollbackLastBlock()
+	if err != nil {
+		return nil, err
 	}
+	s.uncacheBlocks(header.BlockHash())
+	return bs, nil
 }
 
-// GetBlockByHash retrieves the block header, filter, and filter tip, based on
-// the provided block hash, from the database.
+// GetBlockByHash retrieves the block header and height, based on the provided
+// block hash, from the header store.
 //
 // TODO(roasbeef): should be renamed, actually gets header
 func (s *ChainService) GetBlockByHash(blockHash chainhash.Hash) (
 	wire.BlockHeader, uint32, error) {
-	var header wire.BlockHeader
-	var height uint32
-	err := s.dbView(getBlockByHash(blockHash, &header, &height))
-	return header, height, err
-}
-
-func getBlockByHash(blockHash chainhash.Hash, header *wire.BlockHeader,
-	height *uint32) dbViewOption {
-	return func(bucket walletdb.ReadBucket) error {
-		headerBucket := bucket.NestedReadBucket(blockHeaderBucketName)
-		blockBytes := headerBucket.Get(blockHash[:])
-		if len(blockBytes) < wire.MaxBlockHeaderPayload+4 {
-			return fmt.Errorf("failed to retrieve block info for"+
-				" hash %s: want %d bytes, got %d.", blockHash,
-				wire.MaxBlockHeaderPayload+4, len(blockBytes))
-		}
-		buf := bytes.NewReader(blockBytes[:wire.MaxBlockHeaderPayload])
-		err := header.Deserialize(buf)
-		if err != nil {
-			return fmt.Errorf("failed to deserialize block header "+
-				"for hash: %s", blockHash)
-		}
-		*height = binary.LittleEndian.Uint32(
-			blockBytes[wire.MaxBlockHeaderPayload : wire.MaxBlockHeaderPayload+4])
-		return nil
-	}
+	return s.headers.fetchHeader(blockHash)
 }
 
 // GetBlockHashByHeight retrieves the hash of a block by its height.
 func (s *ChainService) GetBlockHashByHeight(height uint32) (chainhash.Hash,
 	error) {
-	var blockHash chainhash.Hash
-	err := s.dbView(getBlockHashByHeight(height, &blockHash))
-	return blockHash, err
-}
-
-func getBlockHashByHeight(height uint32,
-	blockHash *chainhash.Hash) dbViewOption {
-	return func(bucket walletdb.ReadBucket) error {
-		headerBucket := bucket.NestedReadBucket(blockHeaderBucketName)
-		hashBytes := headerBucket.Get(uint32ToBytes(height))
-		if hashBytes == nil {
-			return fmt.Errorf("no block hash for height %d", height)
-		}
-		blockHash.SetBytes(hashBytes)
-		return nil
+	header, err := s.headers.fetchHeaderByHeight(height)
+	if err != nil {
+		return chainhash.Hash{}, err
 	}
+	return header.BlockHash(), nil
 }
 
 // GetBlockByHeight retrieves a block's information by its height.
 func (s *ChainService) GetBlockByHeight(height uint32) (wire.BlockHeader,
 	error) {
-	var header wire.BlockHeader
-	err := s.dbView(getBlockByHeight(height, &header))
-	return header, err
-}
-
-func getBlockByHeight(height uint32, header *wire.BlockHeader) dbViewOption {
-	return func(bucket walletdb.ReadBucket) error {
-		var blockHash chainhash.Hash
-		err := getBlockHashByHeight(height, &blockHash)(bucket)
-		if err != nil {
-			return err
-		}
-		var gotHeight uint32
-		err = getBlockByHash(blockHash, header, &gotHeight)(bucket)
-		if err != nil {
-			return err
-		}
-		if gotHeight != height {
-			return fmt.Errorf("Got height %d for block at "+
-				"requested height %d", gotHeight, height)
-		}
-		return nil
-	}
+	return s.headers.fetchHeaderByHeight(height)
 }
 
 // BestSnapshot is a synonym for SyncedTo
@@ -474,153 +354,97 @@ func (s *ChainService) BestSnapshot() (*waddrmgr.BlockStamp, error) {
 
 // SyncedTo retrieves the most recent block's height and hash.
 func (s *ChainService) SyncedTo() (*waddrmgr.BlockStamp, error) {
-	var bs waddrmgr.BlockStamp
-	err := s.dbView(syncedTo(&bs))
-	return &bs, err
-}
-
-func syncedTo(bs *waddrmgr.BlockStamp) dbViewOption {
-	return func(bucket walletdb.ReadBucket) error {
-		var header wire.BlockHeader
-		var height uint32
-		err := latestBlock(&header, &height)(bucket)
-		if err != nil {
-			return err
-		}
-		bs.Hash = header.BlockHash()
-		bs.Height = int32(height)
-		return nil
+	header, height, err := s.headers.chainTip()
+	if err != nil {
+		return nil, err
 	}
+	return &waddrmgr.BlockStamp{
+		Hash:   header.BlockHash(),
+		Height: int32(height),
+	}, nil
 }
 
 // LatestBlock retrieves latest stored block's header and height.
 func (s *ChainService) LatestBlock() (wire.BlockHeader, uint32, error) {
-	var bh wire.BlockHeader
-	var h uint32
-	err := s.dbView(latestBlock(&bh, &h))
-	return bh, h, err
-}
-
-func latestBlock(header *wire.BlockHeader, height *uint32) dbViewOption {
-	return func(bucket walletdb.ReadBucket) error {
-		maxBlockHeightBytes := bucket.Get(maxBlockHeightName)
-		if maxBlockHeightBytes == nil {
-			return fmt.Errorf("no max block height stored")
-		}
-		*height = binary.LittleEndian.Uint32(maxBlockHeightBytes)
-		return getBlockByHeight(*height, header)(bucket)
-	}
+	return s.headers.chainTip()
 }
 
 // BlockLocatorFromHash returns a block locator based on the provided hash.
 func (s *ChainService) BlockLocatorFromHash(hash chainhash.Hash) (
 	blockchain.BlockLocator, error) {
-	var locator blockchain.BlockLocator
-	err := s.dbView(blockLocatorFromHash(hash, &locator))
-	return locator, err
-}
+	// Append the initial hash
+	locator := blockchain.BlockLocator{&hash}
 
-func blockLocatorFromHash(hash chainhash.Hash,
-	locator *blockchain.BlockLocator) dbViewOption {
-	return func(bucket walletdb.ReadBucket) error {
-		// Append the initial hash
-		*locator = append(*locator, &hash)
-
-		// If hash isn't found in DB or this is the genesis block,
-		// return the locator as is
-		var header wire.BlockHeader
-		var height uint32
-		err := getBlockByHash(hash, &header, &height)(bucket)
-		if err != nil || height == 0 {
-			return nil
-		}
-
-		decrement := uint32(1)
-		for height > 0 && len(*locator) < wire.MaxBlockLocatorsPerMsg {
-			// Decrement by 1 for the first 10 blocks, then double
-			// the jump until we get to the genesis hash
-			if len(*locator) > 10 {
-				decrement *= 2
-			}
+	// If hash isn't found in the store or this is the genesis block,
+	// return the locator as is
+	_, height, err := s.headers.fetchHeader(hash)
+	if err != nil || height == 0 {
+		return locator, nil
+	}
 
-			if decrement > height {
-				height = 0
-			} else {
-				height -= decrement
-			}
+	decrement := uint32(1)
+	for height > 0 && len(locator) < wire.MaxBlockLocatorsPerMsg {
+		// Decrement by 1 for the first 10 blocks, then double the
+		// jump until we get to the genesis hash
+		if len(locator) > 10 {
+			decrement *= 2
+		}
 
-			var blockHash chainhash.Hash
-			err := getBlockHashByHeight(height, &blockHash)(bucket)
-			if err != nil {
-				return nil
-			}
+		if decrement > height {
+			height = 0
+		} else {
+			height -= decrement
+		}
 
-			*locator = append(*locator, &blockHash)
+		header, err := s.headers.fetchHeaderByHeight(height)
+		if err != nil {
+			return locator, nil
 		}
-		return nil
+		blockHash := header.BlockHash()
+
+		locator = append(locator, &blockHash)
 	}
+	return locator, nil
 }
 
 // LatestBlockLocator returns the block locator for the latest known block
-// stored in the database.
+// stored in the header store.
 func (s *ChainService) LatestBlockLocator() (blockchain.BlockLocator, error) {
-	var locator blockchain.BlockLocator
-	err := s.dbView(latestBlockLocator(&locator))
-	return locator, err
-}
-
-func latestBlockLocator(locator *blockchain.BlockLocator) dbViewOption {
-	return func(bucket walletdb.ReadBucket) error {
-		var best waddrmgr.BlockStamp
-		err := syncedTo(&best)(bucket)
-		if err != nil {
-			return err
-		}
-		return blockLocatorFromHash(best.Hash, locator)(bucket)
+	best, err := s.SyncedTo()
+	if err != nil {
+		return nil, err
 	}
+	return s.BlockLocatorFromHash(best.Hash)
 }
 
 // CheckConnectivity cycles through all of the block headers, from last to
 // first, and makes sure they all connect to each other.
 func (s *ChainService) CheckConnectivity() error {
-	return s.dbView(checkConnectivity())
-}
-
-func checkConnectivity() dbViewOption {
-	return func(bucket walletdb.ReadBucket) error {
-		var header wire.BlockHeader
-		var height uint32
-		err := latestBlock(&header, &height)(bucket)
+	header, height, err := s.headers.chainTip()
+	if err != nil {
+		return fmt.Errorf("Couldn't retrieve latest block: %s", err)
+	}
+	for height > 0 {
+		newHeader, newHeight, err := s.headers.fetchHeader(
+			header.PrevBlock)
 		if err != nil {
-			return fmt.Errorf("Couldn't retrieve latest block: %s",
-				err)
+			return fmt.Errorf("Couldn't retrieve block %s: %s",
+				header.PrevBlock, err)
 		}
-		for height > 0 {
-			var newHeader wire.BlockHeader
-			var newHeight uint32
-			err := getBlockByHash(header.PrevBlock, &newHeader,
-				&newHeight)(bucket)
-			if err != nil {
-				return fmt.Errorf("Couldn't retrieve block %s:"+
-					" %s", header.PrevBlock, err)
-			}
-			if newHeader.BlockHash() != header.PrevBlock {
-				return fmt.Errorf("Block %s doesn't match "+
-					"block %s's PrevBlock (%s)",
-					newHeader.BlockHash(),
-					header.BlockHash(), header.PrevBlock)
-			}
-			if newHeight != height-1 {
-				return fmt.Errorf("Block %s doesn't have "+
-					"correct height: want %d, got %d",
-					newHeader.BlockHash(), height-1,
-					newHeight)
-			}
-			header = newHeader
-			height = newHeight
+		if newHeader.BlockHash() != header.PrevBlock {
+			return fmt.Errorf("Block %s doesn't match block %s's "+
+				"PrevBlock (%s)", newHeader.BlockHash(),
+				header.BlockHash(), header.PrevBlock)
 		}
-		return nil
+		if newHeight != height-1 {
+			return fmt.Errorf("Block %s doesn't have correct "+
+				"height: want %d, got %d",
+				newHeader.BlockHash(), height-1, newHeight)
+		}
+		header = newHeader
+		height = newHeight
 	}
+	return nil
 }
 
 // createSPVNS creates the initial namespace structure needed for all of the
@@ -656,72 +480,45 @@ func (s *ChainService) createSPVNS() error {
 			err)
 	}
 
-	_, err = spvBucket.CreateBucketIfNotExists(basicFilterBucketName)
-	if err != nil {
-		return fmt.Errorf("failed to create basic filter "+
-			"bucket: %s", err)
-	}
-
-	_, err = spvBucket.CreateBucketIfNotExists(basicHeaderBucketName)
-	if err != nil {
-		return fmt.Errorf("failed to create basic header "+
-			"bucket: %s", err)
-	}
-
-	_, err = spvBucket.CreateBucketIfNotExists(extFilterBucketName)
-	if err != nil {
-		return fmt.Errorf("failed to create extended filter "+
-			"bucket: %s", err)
-	}
-
-	_, err = spvBucket.CreateBucketIfNotExists(extHeaderBucketName)
-	if err != nil {
-		return fmt.Errorf("failed to create extended header "+
-			"bucket: %s", err)
-	}
-
-	basicFilter, err := builder.BuildBasicFilter(
-		s.chainParams.GenesisBlock)
+	err = putHeaderIndex(*s.chainParams.GenesisHash, 0)(spvBucket)
 	if err != nil {
 		return err
 	}
 
-	basicFilterTip := builder.MakeHeaderForFilter(basicFilter,
-		s.chainParams.GenesisBlock.Header.PrevBlock)
-
-	extFilter, err := builder.BuildExtFilter(
-		s.chainParams.GenesisBlock)
-	if err != nil {
-		return err
-	}
-
-	extFilterTip := builder.MakeHeaderForFilter(extFilter,
-		s.chainParams.GenesisBlock.Header.PrevBlock)
+	for _, filterType := range filterTypes {
+		_, err = spvBucket.CreateBucketIfNotExists(
+			filterType.filterBucket)
+		if err != nil {
+			return fmt.Errorf("failed to create %s filter "+
+				"bucket: %s", filterType, err)
+		}
 
-	err = putBlock(s.chainParams.GenesisBlock.Header, 0)(spvBucket)
-	if err != nil {
-		return err
-	}
+		_, err = spvBucket.CreateBucketIfNotExists(
+			filterType.headerBucket)
+		if err != nil {
+			return fmt.Errorf("failed to create %s header "+
+				"bucket: %s", filterType, err)
+		}
 
-	err = putBasicFilter(*s.chainParams.GenesisHash, basicFilter)(spvBucket)
-	if err != nil {
-		return err
-	}
+		filter, err := filterType.build(s.chainParams.GenesisBlock)
+		if err != nil {
+			return err
+		}
 
-	err = putBasicHeader(*s.chainParams.GenesisHash, basicFilterTip)(
-		spvBucket)
-	if err != nil {
-		return err
-	}
+		filterTip := builder.MakeHeaderForFilter(filter,
+			s.chainParams.GenesisBlock.Header.PrevBlock)
 
-	err = putExtFilter(*s.chainParams.GenesisHash, extFilter)(spvBucket)
-	if err != nil {
-		return err
-	}
+		err = putFilter(*s.chainParams.GenesisHash, filterType,
+			filter)(spvBucket)
+		if err != nil {
+			return err
+		}
 
-	err = putExtHeader(*s.chainParams.GenesisHash, extFilterTip)(spvBucket)
-	if err != nil {
-		return err
+		err = putFilterHeader(*s.chainParams.GenesisHash, filterType,
+			filterTip)(spvBucket)
+		if err != nil {
+			return err
+		}
 	}
 
 	err = putDBVersion(latestDBVersion)(spvBucket)
@@ -746,7 +543,18 @@ func (s *ChainService) createSPVNS() error {
 
 // dbUpdate allows the passed function to update the ChainService DB bucket.
 func (s *ChainService) dbUpdate(updateFunc dbUpdateOption) error {
-	tx, err := s.db.BeginReadWriteTx()
+	return dbUpdate(s.db, updateFunc)
+}
+
+// dbView allows the passed function to read the ChainService DB bucket.
+func (s *ChainService) dbView(viewFunc dbViewOption) error {
+	return dbView(s.db, viewFunc)
+}
+
+// dbUpdate runs the passed function on the ChainService bucket of the passed
+// database in a read-write transaction.
+func dbUpdate(db walletdb.DB, updateFunc dbUpdateOption) error {
+	tx, err := db.BeginReadWriteTx()
 	if err != nil {
 		tx.Rollback()
 		return err
@@ -760,9 +568,10 @@ func (s *ChainService) dbUpdate(updateFunc dbUpdateOption) error {
 	return tx.Commit()
 }
 
-// dbView allows the passed function to read the ChainService DB bucket.
-func (s *ChainService) dbView(viewFunc dbViewOption) error {
-	tx, err := s.db.BeginReadTx()
+// dbView runs the passed function on the ChainService bucket of the passed
+// database in a read-only transaction.
+func dbView(db walletdb.DB, viewFunc dbViewOption) error {
+	tx, err := db.BeginReadTx()
 	defer tx.Rollback()
 	if err != nil {
 		return err
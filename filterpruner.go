@@ -0,0 +1,412 @@
+// NOTE: THIS API IS UNSTABLE RIGHT NOW.
+
+package neutrino
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcwallet/walletdb"
+)
+
+// FilterStorageMode selects which of the filters fetched from the network are
+// kept in the database. Filter headers are always kept, so pruned filters can
+// be fetched and verified again whenever they're needed.
+type FilterStorageMode uint8
+
+const (
+	// KeepAllFilters keeps every filter. This is the default.
+	KeepAllFilters FilterStorageMode = iota
+
+	// KeepRecentFilters keeps the filters of the last
+	// FilterStoragePolicy.Blocks blocks.
+	KeepRecentFilters
+
+	// KeepFilterBytes keeps the filters of the most recent blocks up to a
+	// total size of FilterStoragePolicy.Bytes.
+	KeepFilterBytes
+
+	// KeepMatchedFilters keeps only the filters that matched the watch
+	// list of a rescan.
+	KeepMatchedFilters
+)
+
+// FilterStoragePolicy describes which filters are kept in the database. The
+// filters that aren't are pruned in the background.
+type FilterStoragePolicy struct {
+	Mode FilterStorageMode
+
+	// Blocks is the number of blocks to keep the filters of with
+	// KeepRecentFilters.
+	Blocks uint32
+
+	// Bytes is the total size of the filters to keep with
+	// KeepFilterBytes.
+	Bytes uint64
+}
+
+var (
+	// FilterPruneInterval is how often the filters that the storage
+	// policy doesn't keep are pruned.
+	FilterPruneInterval = 10 * time.Minute
+)
+
+const (
+	// filterPruneBatchSize is the number of blocks whose filters are
+	// looked at in each database transaction while pruning.
+	filterPruneBatchSize = 2000
+)
+
+// filterPruner prunes the filters that the storage policy doesn't keep every
+// FilterPruneInterval. It must be run as a goroutine.
+func (s *ChainService) filterPruner() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(FilterPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.pruneFilters(); err != nil {
+			log.Errorf("Unable to prune filters: %s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// filterPruneRun is the state of a single run of pruneFilters.
+type filterPruneRun struct {
+	// pruneHeight is the height up to which the filters have been
+	// pruned so far.
+	pruneHeight uint32
+
+	// lowered is set if the prune height has been lowered by a filter
+	// stored since the run started, in which case the run stops.
+	lowered bool
+
+	stored int
+	pruned int
+
+	// prunedKeys is the filter cache keys of the filters pruned in the
+	// current batch.
+	prunedKeys []interface{}
+}
+
+// pruneFilters deletes the filters that the storage policy doesn't keep from
+// the database. The filters up to the prune height have been pruned by earlier
+// runs, so each run only looks at the blocks after it. The filters of blocks
+// that aren't in our chain anymore are deleted by reorgChain.
+func (s *ChainService) pruneFilters() error {
+	_, tipHeight, err := s.LatestBlock()
+	if err != nil {
+		return err
+	}
+	run := &filterPruneRun{}
+	err = s.dbView(func(bucket walletdb.ReadBucket) error {
+		run.pruneHeight = filterPruneHeight(bucket,
+			s.filterStorage.Mode)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	endHeight, err := s.filterPruneEnd(tipHeight, run.pruneHeight)
+	if err != nil {
+		return err
+	}
+
+	// We go up from the prune height, and raise it in the transaction
+	// that prunes each batch, so that a filter stored for a block we've
+	// gone past lowers it again. The genesis filters are needed to
+	// verify the filters after them, and we can't fetch them from the
+	// network, so they're never pruned.
+	for run.pruneHeight < endHeight {
+		select {
+		case <-s.quit:
+			return nil
+		default:
+		}
+
+		batchEnd := endHeight
+		if batchEnd-run.pruneHeight > filterPruneBatchSize {
+			batchEnd = run.pruneHeight + filterPruneBatchSize
+		}
+		startHeight := run.pruneHeight + 1
+		blockHashes := make([]chainhash.Hash, 0,
+			batchEnd-startHeight+1)
+		for height := startHeight; height <= batchEnd; height++ {
+			blockHash, err := s.GetBlockHashByHeight(height)
+			if err != nil {
+				return err
+			}
+			blockHashes = append(blockHashes, blockHash)
+		}
+
+		run.prunedKeys = nil
+		err := s.dbUpdate(s.pruneFilterBatch(run, blockHashes))
+		if err != nil {
+			return err
+		}
+		if run.lowered {
+			log.Debugf("Filters were stored while pruning, " +
+				"pruning them next time")
+			break
+		}
+
+		// The pruned filters mustn't be served from the cache either.
+		if len(run.prunedKeys) > 0 {
+			s.filterCache.remove(run.prunedKeys...)
+		}
+	}
+
+	if run.pruned > 0 {
+		log.Debugf("Pruned %d of %d stored filters", run.pruned,
+			run.stored)
+	}
+	return nil
+}
+
+// filterPruneEnd returns the height of the last block whose filters the
+// storage policy doesn't keep, as of the passed tip height. It's at most
+// pruneHeight if there are no filters to prune after the prune height.
+func (s *ChainService) filterPruneEnd(tipHeight,
+	pruneHeight uint32) (uint32, error) {
+
+	switch s.filterStorage.Mode {
+	case KeepRecentFilters:
+		if tipHeight <= s.filterStorage.Blocks {
+			return 0, nil
+		}
+		return tipHeight - s.filterStorage.Blocks, nil
+
+	case KeepFilterBytes:
+		return s.filterBytesPruneEnd(tipHeight, pruneHeight)
+
+	case KeepMatchedFilters:
+		return tipHeight, nil
+	}
+	return 0, nil
+}
+
+// filterBytesPruneEnd returns the height of the most recent block whose
+// filters don't fit into the KeepFilterBytes budget along with those of the
+// blocks after it, or pruneHeight if they all do. We add up the sizes of the
+// filters from the tip down, and stop at the prune height, as there are no
+// filters left to prune below it.
+func (s *ChainService) filterBytesPruneEnd(tipHeight,
+	pruneHeight uint32) (uint32, error) {
+
+	var totalSize uint64
+	for endHeight := tipHeight; endHeight > pruneHeight; {
+		select {
+		case <-s.quit:
+			return pruneHeight, nil
+		default:
+		}
+
+		startHeight := pruneHeight + 1
+		if endHeight-pruneHeight > filterPruneBatchSize {
+			startHeight = endHeight - filterPruneBatchSize + 1
+		}
+		blockHashes := make([]chainhash.Hash, 0,
+			endHeight-startHeight+1)
+		for height := endHeight; height >= startHeight; height-- {
+			blockHash, err := s.GetBlockHashByHeight(height)
+			if err != nil {
+				return 0, err
+			}
+			blockHashes = append(blockHashes, blockHash)
+		}
+
+		var overHeight uint32
+		err := s.dbView(func(bucket walletdb.ReadBucket) error {
+			for i, blockHash := range blockHashes {
+				for _, filterType := range filterTypes {
+					filterBytes := bucket.NestedReadBucket(
+						filterType.filterBucket).Get(
+						blockHash[:])
+					totalSize += uint64(len(filterBytes))
+				}
+				if totalSize > s.filterStorage.Bytes {
+					overHeight = endHeight - uint32(i)
+					return nil
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		if overHeight != 0 {
+			return overHeight, nil
+		}
+		endHeight = startHeight - 1
+	}
+	return pruneHeight, nil
+}
+
+// pruneFilterBatch returns a database update that deletes the filters of the
+// passed blocks, which go up from the block after the run's prune height, that
+// the storage policy doesn't keep, and raises the prune height past them.
+// Whether a filter matched is checked in the same transaction that deletes
+// it, so a filter that's marked as matched in the meantime is never pruned.
+func (s *ChainService) pruneFilterBatch(run *filterPruneRun,
+	blockHashes []chainhash.Hash) dbUpdateOption {
+
+	return func(bucket walletdb.ReadWriteBucket) error {
+		mode := s.filterStorage.Mode
+		if filterPruneHeight(bucket, mode) != run.pruneHeight {
+			run.lowered = true
+			return nil
+		}
+		matchedBucket := bucket.NestedReadBucket(
+			matchedFilterBucketName)
+
+		var prunedBlocks []chainhash.Hash
+		for _, blockHash := range blockHashes {
+			matched := matchedBucket != nil &&
+				matchedBucket.Get(blockHash[:]) != nil
+			keep := mode == KeepMatchedFilters && matched
+
+			prunedBlock := false
+			for _, filterType := range filterTypes {
+				filterBucket := bucket.NestedReadWriteBucket(
+					filterType.filterBucket)
+				if filterBucket.Get(blockHash[:]) == nil {
+					continue
+				}
+				run.stored++
+
+				if keep {
+					continue
+				}
+				err := filterBucket.Delete(blockHash[:])
+				if err != nil {
+					return err
+				}
+				run.pruned++
+				run.prunedKeys = append(run.prunedKeys,
+					cfilterKey{
+						blockHash:  blockHash,
+						filterType: filterType,
+					})
+				prunedBlock = true
+			}
+			if prunedBlock {
+				prunedBlocks = append(prunedBlocks, blockHash)
+			}
+		}
+
+		// Blocks whose filters are pruned don't need to be marked as
+		// matched anymore.
+		err := deleteMatchedFilters(prunedBlocks)(bucket)
+		if err != nil {
+			return err
+		}
+
+		run.pruneHeight += uint32(len(blockHashes))
+		return putFilterPruneHeight(run.pruneHeight, mode)(bucket)
+	}
+}
+
+// filterPruneHeight returns the height up to which the filters have been
+// pruned for the passed storage mode. None of the filters up to it that the
+// storage policy doesn't keep are left. It's 0 if the filters haven't been
+// pruned for the mode.
+func filterPruneHeight(bucket walletdb.ReadBucket,
+	mode FilterStorageMode) uint32 {
+
+	value := bucket.Get(filterPruneHeightName)
+	if len(value) != 5 || FilterStorageMode(value[4]) != mode {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(value[:4])
+}
+
+// putFilterPruneHeight returns a database update that stores the height up to
+// which the filters have been pruned for the passed storage mode.
+func putFilterPruneHeight(height uint32,
+	mode FilterStorageMode) dbUpdateOption {
+
+	return func(bucket walletdb.ReadWriteBucket) error {
+		value := make([]byte, 5)
+		binary.LittleEndian.PutUint32(value, height)
+		value[4] = byte(mode)
+		return bucket.Put(filterPruneHeightName, value)
+	}
+}
+
+// lowerFilterPruneHeight returns a database update that lowers the prune
+// height below the block with the passed hash if the filters have been pruned
+// past it, so that a filter stored for the block is looked at again.
+func lowerFilterPruneHeight(blockHash chainhash.Hash) dbUpdateOption {
+	return func(bucket walletdb.ReadWriteBucket) error {
+		value := bucket.Get(filterPruneHeightName)
+		if len(value) != 5 {
+			return nil
+		}
+		pruneHeight := binary.LittleEndian.Uint32(value[:4])
+		mode := FilterStorageMode(value[4])
+
+		// Blocks that aren't in our chain have their filters deleted
+		// by reorgChain instead.
+		var height uint32
+		if getHeaderIndex(blockHash, &height)(bucket) != nil {
+			return nil
+		}
+		if height == 0 || height > pruneHeight {
+			return nil
+		}
+		return putFilterPruneHeight(height-1, mode)(bucket)
+	}
+}
+
+// markFilterMatched records that the filters of the block with the passed
+// hash matched a rescan's watch list, if the storage policy keeps only those.
+func (s *ChainService) markFilterMatched(blockHash chainhash.Hash) {
+	if s.filterStorage.Mode != KeepMatchedFilters {
+		return
+	}
+	err := s.dbUpdate(putMatchedFilter(blockHash))
+	if err != nil {
+		log.Warnf("Unable to mark filter for block %s as matched: %s",
+			blockHash, err)
+	}
+}
+
+func putMatchedFilter(blockHash chainhash.Hash) dbUpdateOption {
+	return func(bucket walletdb.ReadWriteBucket) error {
+		// The bucket is created on demand, as databases created
+		// before it existed don't have it.
+		matchedBucket, err := bucket.CreateBucketIfNotExists(
+			matchedFilterBucketName)
+		if err != nil {
+			return err
+		}
+		return matchedBucket.Put(blockHash[:], []byte{})
+	}
+}
+
+// deleteMatchedFilters returns a database update that deletes the marks of
+// the filters of the passed blocks as matched.
+func deleteMatchedFilters(blockHashes []chainhash.Hash) dbUpdateOption {
+	return func(bucket walletdb.ReadWriteBucket) error {
+		matchedBucket := bucket.NestedReadWriteBucket(
+			matchedFilterBucketName)
+		if matchedBucket == nil {
+			return nil
+		}
+		for _, blockHash := range blockHashes {
+			err := matchedBucket.Delete(blockHash[:])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,233 @@
+package neutrino
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcwallet/walletdb"
+)
+
+// TestPruneFilters checks that pruning keeps the filters that each storage
+// policy asks for, evicts the filters it prunes from the cache and forgets
+// that they matched a rescan. It also checks that the prune height is
+// recorded, and that a filter stored below it is pruned by the next run.
+func TestPruneFilters(t *testing.T) {
+	const (
+		numHeaders = 10
+		filterSize = 10
+	)
+
+	// The filters of these blocks are marked as matched.
+	matched := map[int32]bool{3: true, 7: true}
+
+	tests := []struct {
+		name   string
+		policy FilterStoragePolicy
+
+		// kept is the heights of the blocks whose filters should be
+		// left.
+		kept []int32
+
+		// pruneHeight is the height the filters should be pruned up
+		// to.
+		pruneHeight uint32
+	}{
+		{
+			name:   "keep all",
+			policy: FilterStoragePolicy{Mode: KeepAllFilters},
+			kept:   []int32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+		},
+		{
+			name: "keep recent",
+			policy: FilterStoragePolicy{
+				Mode:   KeepRecentFilters,
+				Blocks: 3,
+			},
+			kept:        []int32{8, 9, 10},
+			pruneHeight: 7,
+		},
+		{
+			name: "keep bytes",
+			policy: FilterStoragePolicy{
+				Mode:  KeepFilterBytes,
+				Bytes: 4 * 2 * filterSize,
+			},
+			kept:        []int32{7, 8, 9, 10},
+			pruneHeight: 6,
+		},
+		{
+			name: "keep matched",
+			policy: FilterStoragePolicy{
+				Mode: KeepMatchedFilters,
+			},
+			kept:        []int32{3, 7},
+			pruneHeight: 10,
+		},
+	}
+
+	for _, test := range tests {
+		s, cleanup := newTestChainService(t)
+		s.filterStorage = test.policy
+
+		nodes := makeTestHeaders(testGenesis, 0, numHeaders, 0)
+		putFilters := func(bucket walletdb.ReadWriteBucket) error {
+			for _, node := range nodes {
+				blockHash := node.header.BlockHash()
+				for _, filterType := range filterTypes {
+					err := bucket.NestedReadWriteBucket(
+						filterType.filterBucket).Put(
+						blockHash[:],
+						make([]byte, filterSize))
+					if err != nil {
+						return err
+					}
+				}
+				if !matched[node.height] {
+					continue
+				}
+				err := putMatchedFilter(blockHash)(bucket)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		err := s.headers.writeHeaders(nodes, putFilters)
+		if err != nil {
+			cleanup()
+			t.Fatalf("%s: unable to write headers: %s", test.name,
+				err)
+		}
+
+		for _, node := range nodes {
+			for _, filterType := range filterTypes {
+				s.filterCache.put(cfilterKey{
+					blockHash:  node.header.BlockHash(),
+					filterType: filterType,
+				}, struct{}{}, filterSize,
+					s.filterCache.currentEpoch())
+			}
+		}
+
+		if err := s.pruneFilters(); err != nil {
+			cleanup()
+			t.Fatalf("%s: unable to prune filters: %s", test.name,
+				err)
+		}
+		checkFilterPruneHeight(t, s, test.name, test.pruneHeight)
+
+		// Storing a filter again for a block the filters have been
+		// pruned past lowers the prune height below it.
+		restored := nodes[1]
+		restoredHash := restored.header.BlockHash()
+		err = s.dbUpdate(func(bucket walletdb.ReadWriteBucket) error {
+			for _, filterType := range filterTypes {
+				err := bucket.NestedReadWriteBucket(
+					filterType.filterBucket).Put(
+					restoredHash[:],
+					make([]byte, filterSize))
+				if err != nil {
+					return err
+				}
+			}
+			return lowerFilterPruneHeight(restoredHash)(bucket)
+		})
+		if err != nil {
+			cleanup()
+			t.Fatalf("%s: unable to store filters again: %s",
+				test.name, err)
+		}
+		wantHeight := test.pruneHeight
+		if wantHeight >= uint32(restored.height) {
+			wantHeight = uint32(restored.height) - 1
+		}
+		checkFilterPruneHeight(t, s, test.name, wantHeight)
+
+		if err := s.pruneFilters(); err != nil {
+			cleanup()
+			t.Fatalf("%s: unable to prune filters again: %s",
+				test.name, err)
+		}
+		checkFilterPruneHeight(t, s, test.name, test.pruneHeight)
+
+		kept := make(map[int32]bool)
+		for _, height := range test.kept {
+			kept[height] = true
+		}
+		err = s.dbView(func(bucket walletdb.ReadBucket) error {
+			matchedBucket := bucket.NestedReadBucket(
+				matchedFilterBucketName)
+			for _, node := range nodes {
+				blockHash := node.header.BlockHash()
+				checkTestFilters(t, s, test.name,
+					bucket, node.height, blockHash,
+					kept[node.height])
+
+				isMatched := matchedBucket.Get(
+					blockHash[:]) != nil
+				want := matched[node.height] &&
+					kept[node.height]
+				if isMatched != want {
+					t.Errorf("%s: filters of block %d "+
+						"marked as matched: %v, want "+
+						"%v", test.name, node.height,
+						isMatched, want)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: unable to read filters: %s", test.name,
+				err)
+		}
+		cleanup()
+	}
+}
+
+// checkTestFilters checks whether the filters of every type are stored and
+// cached for a block in TestPruneFilters.
+func checkTestFilters(t *testing.T, s *ChainService, name string,
+	bucket walletdb.ReadBucket, height int32, blockHash chainhash.Hash,
+	want bool) {
+
+	t.Helper()
+
+	for _, filterType := range filterTypes {
+		stored := bucket.NestedReadBucket(filterType.filterBucket).Get(
+			blockHash[:]) != nil
+		if stored != want {
+			t.Errorf("%s: %s filter of block %d stored: %v, want "+
+				"%v", name, filterType, height, stored, want)
+		}
+
+		_, cached := s.filterCache.get(cfilterKey{
+			blockHash:  blockHash,
+			filterType: filterType,
+		})
+		if cached != want {
+			t.Errorf("%s: %s filter of block %d cached: %v, want "+
+				"%v", name, filterType, height, cached, want)
+		}
+	}
+}
+
+// checkFilterPruneHeight checks the height up to which the filters have been
+// pruned in TestPruneFilters.
+func checkFilterPruneHeight(t *testing.T, s *ChainService, name string,
+	want uint32) {
+
+	t.Helper()
+
+	var pruneHeight uint32
+	err := s.dbView(func(bucket walletdb.ReadBucket) error {
+		pruneHeight = filterPruneHeight(bucket, s.filterStorage.Mode)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%s: unable to read prune height: %s", name, err)
+	}
+	if pruneHeight != want {
+		t.Errorf("%s: filters pruned up to block %d, want %d", name,
+			pruneHeight, want)
+	}
+}
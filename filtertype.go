@@ -0,0 +1,87 @@
+// NOTE: THIS API IS UNSTABLE RIGHT NOW.
+
+package neutrino
+
+import (
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/gcs"
+	"github.com/btcsuite/btcutil/gcs/builder"
+)
+
+// FilterType describes a type of committed filter along with its filter
+// header chain: how it's requested from peers, how it's built from a block
+// and where its filters and filter headers are stored.
+//
+// The only filter types are BasicFilter and ExtFilter, and new ones can't be
+// defined outside this package: SyncProgress, header snapshots and filter
+// header checkpoints still have a field for each of the two.
+type FilterType struct {
+	// Name is a short, human-readable name for the filter type, used in
+	// log messages.
+	Name string
+
+	// extended is the value of the Extended flag in the getcfheaders,
+	// getcfilter and matching response messages for this filter type.
+	extended bool
+
+	// filterBucket and headerBucket are the names of the database
+	// buckets that the filters and filter headers of this type are stored
+	// in, keyed by block hash.
+	filterBucket []byte
+	headerBucket []byte
+
+	// build builds the filter of this type for a block.
+	build func(*wire.MsgBlock) (*gcs.Filter, error)
+
+	// checkpointHeader returns the filter header of this type pinned by a
+	// filter header checkpoint.
+	checkpointHeader func(*FilterHeaderCheckpoint) chainhash.Hash
+}
+
+// String returns the name of the filter type.
+func (ft *FilterType) String() string {
+	return ft.Name
+}
+
+var (
+	// BasicFilter is the basic filter type, which matches the outpoints
+	// spent and the data pushes in the output scripts of a block.
+	BasicFilter = &FilterType{
+		Name:         "basic",
+		filterBucket: basicFilterBucketName,
+		headerBucket: basicHeaderBucketName,
+		build:        builder.BuildBasicFilter,
+		checkpointHeader: func(cp *FilterHeaderCheckpoint) chainhash.Hash {
+			return cp.BasicHeader
+		},
+	}
+
+	// ExtFilter is the extended filter type, which matches the txids of
+	// a block and the data pushes in its input scripts and witnesses.
+	ExtFilter = &FilterType{
+		Name:         "extended",
+		extended:     true,
+		filterBucket: extFilterBucketName,
+		headerBucket: extHeaderBucketName,
+		build:        builder.BuildExtFilter,
+		checkpointHeader: func(cp *FilterHeaderCheckpoint) chainhash.Hash {
+			return cp.ExtHeader
+		},
+	}
+
+	// filterTypes lists all of the filter types we know about, in the
+	// order their filter header chains are synced.
+	filterTypes = []*FilterType{BasicFilter, ExtFilter}
+)
+
+// syncsFilterType returns whether the chain service syncs the filter header
+// chain of the passed filter type.
+func (s *ChainService) syncsFilterType(filterType *FilterType) bool {
+	for _, ft := range s.syncedFilterTypes {
+		if ft == filterType {
+			return true
+		}
+	}
+	return false
+}
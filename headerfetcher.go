@@ -0,0 +1,385 @@
+// NOTE: THIS API IS UNSTABLE RIGHT NOW.
+
+package neutrino
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcwallet/waddrmgr"
+)
+
+var (
+	// MaxParallelHeaderPeers is the maximum number of peers from which
+	// the header chain between checkpoints is downloaded concurrently
+	// during initial sync. Setting this to 1 or less disables parallel
+	// download, and headers are fetched serially from the sync peer.
+	MaxParallelHeaderPeers = 4
+
+	// HeaderRangeTimeout is how long a peer has to answer each getheaders
+	// request for a checkpoint range before the range is handed to
+	// another peer.
+	HeaderRangeTimeout = 10 * time.Second
+)
+
+// headerRange is a contiguous span of the header chain ending at a
+// checkpoint. It starts either at the previous checkpoint or at the latest
+// header we knew about when the fetch began.
+type headerRange struct {
+	index       int
+	startHeight int32
+	startHash   chainhash.Hash
+	endHeight   int32
+	endHash     chainhash.Hash
+
+	// msgs holds the headers messages for this range in the order they
+	// were received, once each has been checked to connect to the
+	// previous one. peer is the peer that delivered them.
+	msgs []*wire.MsgHeaders
+	peer *serverPeer
+}
+
+// headerFetchDoneMsg tells the block manager that the parallel header fetch
+// has finished, either because all ranges were delivered or because it ran
+// out of peers to ask.
+type headerFetchDoneMsg struct{}
+
+// rangeResult is sent from a range download goroutine back to the fetcher
+// once the range has been downloaded or the peer has failed to deliver it.
+type rangeResult struct {
+	hRange *headerRange
+	peer   *serverPeer
+	ok     bool
+}
+
+// headerFetcher downloads the checkpointed part of the header chain from
+// several peers at once. Each range between two checkpoints is fetched from a
+// single peer and verified to link up with the checkpoint hashes. Ranges are
+// then handed to the block manager strictly in order, so the block handler
+// goroutine still does full validation and writes the headers to the
+// database exactly as if they had been synced serially.
+type headerFetcher struct {
+	bm     *blockManager
+	ranges []*headerRange
+	peers  []*serverPeer
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newHeaderFetcher returns a header fetcher that will download the passed
+// ranges from the passed peers.
+func newHeaderFetcher(bm *blockManager, ranges []*headerRange,
+	peers []*serverPeer) *headerFetcher {
+
+	return &headerFetcher{
+		bm:     bm,
+		ranges: ranges,
+		peers:  peers,
+		quit:   make(chan struct{}),
+	}
+}
+
+// start launches the goroutine that coordinates the download.
+func (f *headerFetcher) start() {
+	f.bm.wg.Add(1)
+	go f.fetchHandler()
+}
+
+// stop signals the fetcher and all of its range downloads to quit.
+func (f *headerFetcher) stop() {
+	select {
+	case <-f.quit:
+	default:
+		close(f.quit)
+	}
+}
+
+// fetchHandler assigns ranges to idle peers, collects the results, and
+// delivers completed ranges to the block manager in order. It must be run as
+// a goroutine.
+func (f *headerFetcher) fetchHandler() {
+	defer f.bm.wg.Done()
+
+	results := make(chan *rangeResult)
+	queue := make([]*headerRange, len(f.ranges))
+	copy(queue, f.ranges)
+	idle := make([]*serverPeer, len(f.peers))
+	copy(idle, f.peers)
+	completed := make(map[int]*headerRange)
+	nextRange := 0
+	inFlight := 0
+
+out:
+	for nextRange < len(f.ranges) {
+		// Hand out as many queued ranges as we have idle peers able
+		// to serve them. A peer can only serve a range if it has
+		// told us it knows about the end of it.
+		for i := 0; i < len(queue); {
+			sp := f.takePeer(&idle, queue[i].endHeight)
+			if sp == nil {
+				i++
+				continue
+			}
+			hRange := queue[i]
+			queue = append(queue[:i], queue[i+1:]...)
+			inFlight++
+			go f.fetchRange(hRange, sp, results)
+		}
+
+		// If nothing is being fetched at this point, we've run out of
+		// usable peers. The block manager will pick up from wherever
+		// we got to by syncing serially.
+		if inFlight == 0 {
+			log.Warnf("Ran out of peers to fetch headers from "+
+				"in parallel; %d of %d ranges delivered",
+				nextRange, len(f.ranges))
+			break out
+		}
+
+		select {
+		case res := <-results:
+			inFlight--
+			if !res.ok {
+				// The peer didn't deliver, so we put the range
+				// back at the front of the queue for someone
+				// else and don't use this peer again.
+				res.hRange.msgs = nil
+				queue = append([]*headerRange{res.hRange},
+					queue...)
+				continue
+			}
+
+			idle = append(idle, res.peer)
+			completed[res.hRange.index] = res.hRange
+
+			// Deliver every range we can without leaving a gap.
+			for {
+				hRange, ok := completed[nextRange]
+				if !ok {
+					break
+				}
+				delete(completed, nextRange)
+				if !f.deliver(hRange) {
+					break out
+				}
+				nextRange++
+			}
+
+		case <-f.quit:
+			break out
+
+		case <-f.bm.quit:
+			break out
+		}
+	}
+
+	// Make sure any range downloads still running know to give up, then
+	// let the block manager know we're done.
+	f.stop()
+	select {
+	case f.bm.peerChan <- &headerFetchDoneMsg{}:
+	case <-f.bm.quit:
+	}
+}
+
+// takePeer removes and returns the first connected peer from the idle list
+// that claims to have a header at the passed height. It returns nil if there
+// is no such peer. Disconnected peers are dropped from the list.
+func (f *headerFetcher) takePeer(idle *[]*serverPeer,
+	height int32) *serverPeer {
+
+	for i := 0; i < len(*idle); {
+		sp := (*idle)[i]
+		if !sp.Connected() {
+			*idle = append((*idle)[:i], (*idle)[i+1:]...)
+			continue
+		}
+		if sp.LastBlock() >= height {
+			*idle = append((*idle)[:i], (*idle)[i+1:]...)
+			return sp
+		}
+		i++
+	}
+	return nil
+}
+
+// deliver queues the headers messages of a completed range to the block
+// handler. It returns false if we're shutting down.
+func (f *headerFetcher) deliver(hRange *headerRange) bool {
+	log.Debugf("Delivering headers %d to %d fetched from peer %s",
+		hRange.startHeight+1, hRange.endHeight, hRange.peer.Addr())
+
+	for _, msg := range hRange.msgs {
+		select {
+		case f.bm.peerChan <- &headersMsg{
+			headers:    msg,
+			peer:       hRange.peer,
+			prefetched: true,
+		}:
+		case <-f.quit:
+			return false
+		case <-f.bm.quit:
+			return false
+		}
+	}
+	return true
+}
+
+// fetchRange downloads a single range of headers from the passed peer,
+// checking that each header connects to the previous one, carries valid
+// proof of work for its own target, and that the range ends at the expected
+// checkpoint. The result is sent on the results channel. It must be run as a
+// goroutine.
+func (f *headerFetcher) fetchRange(hRange *headerRange, sp *serverPeer,
+	results chan<- *rangeResult) {
+
+	ok := f.downloadRange(hRange, sp)
+	if ok {
+		hRange.peer = sp
+	}
+	select {
+	case results <- &rangeResult{hRange: hRange, peer: sp, ok: ok}:
+	case <-f.quit:
+	case <-f.bm.quit:
+	}
+}
+
+// downloadRange does the actual work for fetchRange and returns whether the
+// peer delivered the whole range.
+func (f *headerFetcher) downloadRange(hRange *headerRange,
+	sp *serverPeer) bool {
+
+	// While we're fetching a range from this peer, the headers it sends
+	// us must not also be processed by the block handler as they won't
+	// connect to our current tip.
+	atomic.StoreInt32(&sp.fetchingHeaders, 1)
+	defer atomic.StoreInt32(&sp.fetchingHeaders, 0)
+
+	var subwg sync.WaitGroup
+	msgChan := make(chan spMsg)
+	subQuit := make(chan struct{})
+	subscription := spMsgSubscription{
+		msgChan:  msgChan,
+		quitChan: subQuit,
+		wg:       &subwg,
+	}
+	sp.subscribeRecvMsg(subscription)
+	defer func() {
+		sp.unsubscribeRecvMsgs(subscription)
+		close(subQuit)
+		subwg.Wait()
+	}()
+
+	powLimit := f.bm.server.chainParams.PowLimit
+	prevHash := hRange.startHash
+	height := hRange.startHeight
+	for height < hRange.endHeight {
+		locator := blockchain.BlockLocator([]*chainhash.Hash{&prevHash})
+		err := sp.PushGetHeadersMsg(locator, &hRange.endHash)
+		if err != nil {
+			log.Warnf("Failed to send getheaders message to peer "+
+				"%s: %s", sp.Addr(), err)
+			return false
+		}
+
+		// Wait for a headers message that continues from where we
+		// are.
+		var msg *wire.MsgHeaders
+		timeout := time.After(HeaderRangeTimeout)
+	waitForHeaders:
+		for {
+			select {
+			case sm := <-msgChan:
+				headers, ok := sm.msg.(*wire.MsgHeaders)
+				if !ok || len(headers.Headers) == 0 {
+					continue
+				}
+				if headers.Headers[0].PrevBlock != prevHash {
+					continue
+				}
+				msg = headers
+				break waitForHeaders
+
+			case <-timeout:
+				log.Debugf("Peer %s timed out fetching headers "+
+					"%d to %d", sp.Addr(), height+1,
+					hRange.endHeight)
+				return false
+
+			case <-f.quit:
+				return false
+
+			case <-f.bm.quit:
+				return false
+			}
+		}
+
+		for _, header := range msg.Headers {
+			if header.PrevBlock != prevHash {
+				sp.addBanScore(0, 50, "headers don't connect")
+				return false
+			}
+
+			height++
+			if height > hRange.endHeight {
+				sp.addBanScore(0, 50, "headers past checkpoint")
+				return false
+			}
+
+			stubBlock := btcutil.NewBlock(&wire.MsgBlock{
+				Header: *header,
+			})
+			err := blockchain.CheckProofOfWork(stubBlock, powLimit)
+			if err != nil {
+				log.Warnf("Header from peer %s doesn't pass "+
+					"sanity check: %s -- disconnecting",
+					sp.Addr(), err)
+				sp.Disconnect()
+				return false
+			}
+			prevHash = header.BlockHash()
+		}
+
+		if height == hRange.endHeight && prevHash != hRange.endHash {
+			log.Warnf("Block header at height %d/hash %s from "+
+				"peer %s does NOT match expected checkpoint "+
+				"hash of %s -- disconnecting", height, prevHash,
+				sp.Addr(), hRange.endHash)
+			sp.Disconnect()
+			return false
+		}
+
+		hRange.msgs = append(hRange.msgs, msg)
+	}
+
+	return true
+}
+
+// checkpointRanges splits the part of the header chain between the passed
+// best block and the final checkpoint into ranges that each end at a
+// checkpoint.
+func (b *blockManager) checkpointRanges(
+	best *waddrmgr.BlockStamp) []*headerRange {
+
+	var ranges []*headerRange
+	startHeight, startHash := best.Height, best.Hash
+	cp := b.findNextHeaderCheckpoint(best.Height)
+	for cp != nil {
+		ranges = append(ranges, &headerRange{
+			index:       len(ranges),
+			startHeight: startHeight,
+			startHash:   startHash,
+			endHeight:   cp.Height,
+			endHash:     *cp.Hash,
+		})
+		startHeight, startHash = cp.Height, *cp.Hash
+		cp = b.findNextHeaderCheckpoint(cp.Height)
+	}
+	return ranges
+}
@@ -0,0 +1,287 @@
+package neutrino
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/peer"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcwallet/waddrmgr"
+)
+
+// TestCheckpointRanges checks that the header chain from our best block up
+// to the final checkpoint is split into one range per checkpoint.
+func TestCheckpointRanges(t *testing.T) {
+	genesisHash := testGenesis.BlockHash()
+	checkpoints := []chaincfg.Checkpoint{
+		{Height: 10, Hash: &chainhash.Hash{10}},
+		{Height: 20, Hash: &chainhash.Hash{20}},
+		{Height: 30, Hash: &chainhash.Hash{30}},
+	}
+
+	tests := []struct {
+		name        string
+		checkpoints []chaincfg.Checkpoint
+		best        waddrmgr.BlockStamp
+
+		// ranges is the start and end height of each range. Ranges
+		// that start at a checkpoint must start at its hash, and the
+		// first one must start at the best block otherwise.
+		ranges [][2]int32
+	}{
+		{
+			name: "no checkpoints",
+			best: waddrmgr.BlockStamp{Hash: genesisHash},
+		},
+		{
+			name:        "from genesis",
+			checkpoints: checkpoints,
+			best:        waddrmgr.BlockStamp{Hash: genesisHash},
+			ranges:      [][2]int32{{0, 10}, {10, 20}, {20, 30}},
+		},
+		{
+			name:        "between checkpoints",
+			checkpoints: checkpoints,
+			best: waddrmgr.BlockStamp{
+				Height: 15,
+				Hash:   chainhash.Hash{15},
+			},
+			ranges: [][2]int32{{15, 20}, {20, 30}},
+		},
+		{
+			name:        "at a checkpoint",
+			checkpoints: checkpoints,
+			best: waddrmgr.BlockStamp{
+				Height: 20,
+				Hash:   *checkpoints[1].Hash,
+			},
+			ranges: [][2]int32{{20, 30}},
+		},
+		{
+			name:        "past the final checkpoint",
+			checkpoints: checkpoints,
+			best: waddrmgr.BlockStamp{
+				Height: 35,
+				Hash:   chainhash.Hash{35},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		b := &blockManager{server: &ChainService{}}
+		b.server.chainParams.Checkpoints = test.checkpoints
+
+		best := test.best
+		ranges := b.checkpointRanges(&best)
+		if len(ranges) != len(test.ranges) {
+			t.Errorf("%s: got %d ranges, want %d", test.name,
+				len(ranges), len(test.ranges))
+			continue
+		}
+
+		startHash := best.Hash
+		for i, hRange := range ranges {
+			want := test.ranges[i]
+			if hRange.index != i ||
+				hRange.startHeight != want[0] ||
+				hRange.endHeight != want[1] {
+
+				t.Errorf("%s: range %d is #%d from %d to %d, "+
+					"want from %d to %d", test.name, i,
+					hRange.index, hRange.startHeight,
+					hRange.endHeight, want[0], want[1])
+				continue
+			}
+			if hRange.startHash != startHash {
+				t.Errorf("%s: range %d starts at %s, want %s",
+					test.name, i, hRange.startHash,
+					startHash)
+			}
+			endHash := chainhash.Hash{byte(want[1])}
+			if hRange.endHash != endHash {
+				t.Errorf("%s: range %d ends at %s, want %s",
+					test.name, i, hRange.endHash, endHash)
+			}
+			startHash = endHash
+		}
+	}
+}
+
+// TestHeaderFetcher checks that the header fetcher delivers the ranges it
+// gets in order, hands the range of a peer that doesn't answer within
+// HeaderRangeTimeout to another peer, and stops once no peer is left that can
+// serve the remaining ranges.
+func TestHeaderFetcher(t *testing.T) {
+	defer func(timeout time.Duration) {
+		HeaderRangeTimeout = timeout
+	}(HeaderRangeTimeout)
+	HeaderRangeTimeout = 200 * time.Millisecond
+
+	const numHeaders = 20
+	nodes := mineTestHeaders(testGenesis, 0, numHeaders)
+
+	// The headers are split into two ranges at checkpoints, and each
+	// range is sent by a peer that answers in a single headers message.
+	var rangeMsgs []*wire.MsgHeaders
+	var responses []wire.Message
+	var checkpoints []chaincfg.Checkpoint
+	for _, end := range []int{10, 20} {
+		msg := wire.NewMsgHeaders()
+		for _, node := range nodes[end-10 : end] {
+			msg.AddBlockHeader(node.header)
+		}
+		rangeMsgs = append(rangeMsgs, msg)
+		responses = append(responses, msg)
+		blockHash := nodes[end-1].header.BlockHash()
+		checkpoints = append(checkpoints, chaincfg.Checkpoint{
+			Height: int32(end),
+			Hash:   &blockHash,
+		})
+	}
+
+	type testPeer struct {
+		height   int32
+		responds bool
+	}
+	tests := []struct {
+		name  string
+		peers []testPeer
+
+		// delivered is the number of ranges that should be delivered.
+		delivered int
+	}{
+		{
+			name:      "all peers answer",
+			peers:     []testPeer{{20, true}, {20, true}},
+			delivered: 2,
+		},
+		{
+			name:      "timed out range reassigned",
+			peers:     []testPeer{{20, false}, {20, true}},
+			delivered: 2,
+		},
+		{
+			name:  "no peer answers",
+			peers: []testPeer{{20, false}},
+		},
+		{
+			name:      "no peer left with the last range",
+			peers:     []testPeer{{10, true}, {20, false}},
+			delivered: 1,
+		},
+	}
+
+	for _, test := range tests {
+		s, cleanup := newTestChainService(t)
+		s.chainParams.Checkpoints = checkpoints
+		b := s.blockManager
+
+		done := make(chan struct{})
+		var peers []*serverPeer
+		responds := make(map[*serverPeer]bool)
+		for i, tp := range test.peers {
+			sp := newTestFetchPeer(t, s, i, tp.height)
+			peers = append(peers, sp)
+			responds[sp] = tp.responds
+			if tp.responds {
+				go respondToQueries(sp, responses, done)
+			}
+		}
+
+		ranges := b.checkpointRanges(&waddrmgr.BlockStamp{
+			Hash: testGenesis.BlockHash(),
+		})
+		f := newHeaderFetcher(b, ranges, peers)
+		f.start()
+
+		var delivered []*headersMsg
+		timeout := time.After(10 * time.Second)
+	collect:
+		for {
+			select {
+			case msg := <-b.peerChan:
+				switch msg := msg.(type) {
+				case *headersMsg:
+					delivered = append(delivered, msg)
+				case *headerFetchDoneMsg:
+					break collect
+				}
+			case <-timeout:
+				t.Errorf("%s: header fetch didn't finish",
+					test.name)
+				f.stop()
+				break collect
+			}
+		}
+		close(done)
+		for _, sp := range peers {
+			sp.Disconnect()
+		}
+		cleanup()
+
+		if len(delivered) != test.delivered {
+			t.Errorf("%s: %d ranges delivered, want %d", test.name,
+				len(delivered), test.delivered)
+			continue
+		}
+		for i, msg := range delivered {
+			if msg.headers != rangeMsgs[i] {
+				t.Errorf("%s: range %d delivered out of order",
+					test.name, i)
+			}
+			if !responds[msg.peer] || !msg.prefetched {
+				t.Errorf("%s: range %d delivered as sent by "+
+					"a peer that doesn't answer", test.name,
+					i)
+			}
+		}
+	}
+}
+
+// newTestFetchPeer returns a connected peer that advertises the passed height
+// for TestHeaderFetcher. Whatever is sent to the peer is discarded, and it
+// never finishes its handshake.
+func newTestFetchPeer(t *testing.T, s *ChainService, i int,
+	height int32) *serverPeer {
+
+	t.Helper()
+
+	sp := newServerPeer(s, false)
+	addr := net.JoinHostPort(net.IPv4(1, 2, 3, byte(i)).String(), "18444")
+	p, err := peer.NewOutboundPeer(&peer.Config{
+		ChainParams: &chaincfg.RegressionNetParams,
+	}, addr)
+	if err != nil {
+		t.Fatalf("unable to create peer: %s", err)
+	}
+	p.UpdateLastBlockHeight(height)
+	sp.Peer = p
+
+	local, remote := net.Pipe()
+	go io.Copy(ioutil.Discard, remote)
+	p.AssociateConnection(local)
+	return sp
+}
+
+// respondToQueries keeps sending the passed messages to the subscribers of
+// the peer until done is closed, as if the peer answered every query with
+// them. The subscribers ignore the messages that don't answer their queries.
+func respondToQueries(sp *serverPeer, msgs []wire.Message,
+	done <-chan struct{}) {
+
+	for {
+		for _, msg := range msgs {
+			sp.OnRead(nil, 0, msg, nil)
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-done:
+			return
+		}
+	}
+}
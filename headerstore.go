@@ -0,0 +1,645 @@
+// NOTE: THIS API IS UNSTABLE RIGHT NOW.
+
+package neutrino
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcwallet/waddrmgr"
+	"github.com/btcsuite/btcwallet/walletdb"
+)
+
+const (
+	// headerFileName is the name of the flat file holding the block
+	// headers, relative to the data directory.
+	headerFileName = "block_headers.bin"
+
+	// headerFileDBVersion is the database version that moved the block
+	// headers out of the database and into the header file.
+	headerFileDBVersion = 2
+)
+
+// reorgJournalName is the key under which the headers of a reorg are kept
+// until they've been written to the header file.
+var reorgJournalName = []byte("reorgjournal")
+
+// headerStore stores the block header chain. Headers can only be added at
+// the tip and removed from the tip, so every header is at a fixed height for
+// as long as it's stored.
+type headerStore interface {
+	// fetchHeader returns the header with the passed hash and its
+	// height.
+	fetchHeader(hash chainhash.Hash) (wire.BlockHeader, uint32, error)
+
+	// fetchHeaderByHeight returns the header at the passed height.
+	fetchHeaderByHeight(height uint32) (wire.BlockHeader, error)
+
+	// chainTip returns the last header in the chain and its height.
+	chainTip() (wire.BlockHeader, uint32, error)
+
+	// writeHeaders appends the passed headers, which must be in order of
+	// increasing height starting right after the current tip, to the
+	// chain. Any extra updates are applied to the database in the same
+	// transaction as the headers.
+	writeHeaders(headers []*headerNode, updates ...dbUpdateOption) error
+
+	// rollbackLastBlock removes the last header in the chain and returns
+	// the new tip.
+	rollbackLastBlock() (*waddrmgr.BlockStamp, error)
+
+	// reorg replaces the headers above forkHeight with the passed
+	// headers, which may be empty, and applies any extra updates to the
+	// database, all in a single transaction.
+	reorg(forkHeight uint32, headers []*headerNode,
+		updates ...dbUpdateOption) error
+
+	// close releases the resources held by the store.
+	close() error
+}
+
+// flatHeaderStore is a headerStore that keeps the serialized headers in an
+// append-only flat file, where the header at height h is at offset h * 80.
+// The bh bucket in the database is used as an index from block hash to
+// height, and the max block height key marks the tip of the chain. Older
+// versions kept the headers themselves in the bh bucket, along with an index
+// from height to block hash; they're moved to the file when the store is
+// opened.
+//
+// The database is always the authority on where the tip is: headers are
+// appended to the file before they're added to the database, and the
+// database is rolled back before the file is truncated. Anything in the file
+// past the database's tip is therefore left over from an interrupted write
+// and is truncated when the store is opened. A reorg overwrites headers in
+// the file, so the new headers are first journaled in the database in the
+// same transaction as the rest of the reorg, and written to the file from
+// the journal afterwards. If that's interrupted, the journal is replayed when
+// the store is opened.
+type flatHeaderStore struct {
+	mtx       sync.RWMutex
+	file      *os.File
+	db        walletdb.DB
+	tipHeight uint32
+
+	// journalErr is set if the headers of a committed reorg couldn't be
+	// written to the file. The file doesn't match the database then, so
+	// the store can't be used until it's reopened and the journal is
+	// replayed.
+	journalErr error
+}
+
+// A compile-time check to ensure flatHeaderStore satisfies the headerStore
+// interface.
+var _ headerStore = (*flatHeaderStore)(nil)
+
+// newFlatHeaderStore opens the header file at the passed path, creating it if
+// needed, and brings it in line with the database. Headers that were stored
+// in the database by older versions are moved into the file and removed from
+// the database.
+func newFlatHeaderStore(path string, db walletdb.DB,
+	genesis *wire.BlockHeader) (*flatHeaderStore, error) {
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	store := &flatHeaderStore{
+		file: file,
+		db:   db,
+	}
+	if err := store.init(genesis); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// init makes sure the header file ends at the database's tip.
+func (h *flatHeaderStore) init(genesis *wire.BlockHeader) error {
+	var dbTip uint32
+	err := dbView(h.db, func(bucket walletdb.ReadBucket) error {
+		maxBlockHeightBytes := bucket.Get(maxBlockHeightName)
+		if maxBlockHeightBytes == nil {
+			return fmt.Errorf("no max block height stored")
+		}
+		dbTip = binary.LittleEndian.Uint32(maxBlockHeightBytes)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Finish any reorg that was interrupted before the new headers made
+	// it to the file.
+	if err := h.replayJournal(); err != nil {
+		return err
+	}
+
+	info, err := h.file.Stat()
+	if err != nil {
+		return err
+	}
+	numHeaders := uint32(info.Size() / wire.MaxBlockHeaderPayload)
+
+	switch {
+	case numHeaders > dbTip+1:
+		log.Infof("Truncating %d headers past the tip at height %d "+
+			"from header file", numHeaders-dbTip-1, dbTip)
+
+	case numHeaders < dbTip+1:
+		if err := h.migrate(numHeaders, dbTip, genesis); err != nil {
+			return err
+		}
+	}
+
+	// Truncating also gets rid of any partial header at the end of the
+	// file.
+	err = h.file.Truncate(int64(dbTip+1) * wire.MaxBlockHeaderPayload)
+	if err != nil {
+		return err
+	}
+	h.tipHeight = dbTip
+
+	// Now that all of the headers are in the file, the database doesn't
+	// need its own copy anymore.
+	var version uint32
+	if err := dbView(h.db, fetchDBVersion(&version)); err != nil {
+		return err
+	}
+	if version < headerFileDBVersion {
+		return h.migrateIndex()
+	}
+	return nil
+}
+
+// migrate appends the headers from startHeight to endHeight, which were
+// written to the database by an older version, to the header file. The
+// genesis header is written from the passed one, taken from the chain
+// parameters, rather than read from the database, even though older
+// versions stored it there too. The headers are left in the database until
+// migrateIndex removes them.
+func (h *flatHeaderStore) migrate(startHeight, endHeight uint32,
+	genesis *wire.BlockHeader) error {
+
+	log.Infof("Moving headers %d to %d from database to header file",
+		startHeight, endHeight)
+
+	buf := bufio.NewWriter(h.file)
+	_, err := h.file.Seek(int64(startHeight)*wire.MaxBlockHeaderPayload,
+		io.SeekStart)
+	if err != nil {
+		return err
+	}
+	err = dbView(h.db, func(bucket walletdb.ReadBucket) error {
+		headerBucket := bucket.NestedReadBucket(blockHeaderBucketName)
+		for height := startHeight; height <= endHeight; height++ {
+			if height == 0 {
+				if err := genesis.Serialize(buf); err != nil {
+					return err
+				}
+				continue
+			}
+
+			hashBytes := headerBucket.Get(uint32ToBytes(height))
+			if hashBytes == nil {
+				return fmt.Errorf("no block hash for height "+
+					"%d", height)
+			}
+			blockBytes := headerBucket.Get(hashBytes)
+			if len(blockBytes) < wire.MaxBlockHeaderPayload {
+				return fmt.Errorf("no header stored for "+
+					"block at height %d", height)
+			}
+			_, err := buf.Write(
+				blockBytes[:wire.MaxBlockHeaderPayload])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to migrate headers: %s", err)
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	return h.file.Sync()
+}
+
+// migrateIndex rewrites the bh bucket written by older versions, which holds
+// the serialized header and height of each block keyed by its hash, along
+// with the hash of each block keyed by its height, so that it only holds the
+// height of each block keyed by its hash. This is done in a single
+// transaction along with updating the database version, so it's either done
+// entirely or redone the next time the store is opened.
+func (h *flatHeaderStore) migrateIndex() error {
+	log.Infof("Removing block headers from database")
+
+	return dbUpdate(h.db, func(bucket walletdb.ReadWriteBucket) error {
+		bhBucket := bucket.NestedReadWriteBucket(blockHeaderBucketName)
+
+		// The bucket can't be modified while we iterate over it, so we
+		// collect the changes first.
+		var (
+			heightKeys [][]byte
+			hashKeys   [][]byte
+			heights    [][]byte
+		)
+		err := bhBucket.ForEach(func(k, v []byte) error {
+			switch {
+			case len(k) == 4:
+				heightKeys = append(heightKeys,
+					append([]byte(nil), k...))
+
+			case len(v) == wire.MaxBlockHeaderPayload+4:
+				hashKeys = append(hashKeys,
+					append([]byte(nil), k...))
+				heights = append(heights, append([]byte(nil),
+					v[wire.MaxBlockHeaderPayload:]...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range heightKeys {
+			if err := bhBucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		for i, k := range hashKeys {
+			if err := bhBucket.Put(k, heights[i]); err != nil {
+				return err
+			}
+		}
+		return putDBVersion(latestDBVersion)(bucket)
+	})
+}
+
+// readHeader reads the header at the passed height from the file. The caller
+// must hold the mutex.
+func (h *flatHeaderStore) readHeader(height uint32) (wire.BlockHeader,
+	error) {
+
+	var header wire.BlockHeader
+	if h.journalErr != nil {
+		return header, h.journalErr
+	}
+	if height > h.tipHeight {
+		return header, fmt.Errorf("no block at height %d", height)
+	}
+	var raw [wire.MaxBlockHeaderPayload]byte
+	_, err := h.file.ReadAt(raw[:],
+		int64(height)*wire.MaxBlockHeaderPayload)
+	if err != nil {
+		return header, fmt.Errorf("failed to read block header at "+
+			"height %d: %s", height, err)
+	}
+	err = header.Deserialize(bytes.NewReader(raw[:]))
+	if err != nil {
+		return header, fmt.Errorf("failed to deserialize block "+
+			"header at height %d: %s", height, err)
+	}
+	return header, nil
+}
+
+// fetchHeader returns the header with the passed hash and its height.
+func (h *flatHeaderStore) fetchHeader(hash chainhash.Hash) (wire.BlockHeader,
+	uint32, error) {
+
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	var height uint32
+	err := dbView(h.db, getHeaderIndex(hash, &height))
+	if err != nil {
+		return wire.BlockHeader{}, 0, err
+	}
+	header, err := h.readHeader(height)
+	if err != nil {
+		return header, 0, err
+	}
+	if header.BlockHash() != hash {
+		return header, 0, fmt.Errorf("header at height %d is %s, "+
+			"but index has %s", height, header.BlockHash(), hash)
+	}
+	return header, height, nil
+}
+
+// fetchHeaderByHeight returns the header at the passed height.
+func (h *flatHeaderStore) fetchHeaderByHeight(height uint32) (
+	wire.BlockHeader, error) {
+
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	return h.readHeader(height)
+}
+
+// chainTip returns the last header in the chain and its height.
+func (h *flatHeaderStore) chainTip() (wire.BlockHeader, uint32, error) {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	header, err := h.readHeader(h.tipHeight)
+	return header, h.tipHeight, err
+}
+
+// writeHeaders appends the passed headers to the chain and applies the
+// passed updates in the same database transaction as the new index entries.
+func (h *flatHeaderStore) writeHeaders(headers []*headerNode,
+	updates ...dbUpdateOption) error {
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.journalErr != nil {
+		return h.journalErr
+	}
+
+	applyUpdates := func(bucket walletdb.ReadWriteBucket) error {
+		for _, update := range updates {
+			if err := update(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(headers) == 0 {
+		return dbUpdate(h.db, applyUpdates)
+	}
+
+	if uint32(headers[0].height) != h.tipHeight+1 {
+		return fmt.Errorf("header at height %d doesn't extend the "+
+			"tip at height %d", headers[0].height, h.tipHeight)
+	}
+	var buf bytes.Buffer
+	for i, node := range headers {
+		if i > 0 && node.height != headers[i-1].height+1 {
+			return fmt.Errorf("headers to write aren't " +
+				"consecutive")
+		}
+		if err := node.header.Serialize(&buf); err != nil {
+			return err
+		}
+	}
+
+	// The headers go to the file first, so the database never has an
+	// index entry for a header that isn't in the file.
+	offset := int64(h.tipHeight+1) * wire.MaxBlockHeaderPayload
+	if _, err := h.file.WriteAt(buf.Bytes(), offset); err != nil {
+		h.file.Truncate(offset)
+		return fmt.Errorf("failed to write block headers: %s", err)
+	}
+	if err := h.file.Sync(); err != nil {
+		h.file.Truncate(offset)
+		return fmt.Errorf("failed to write block headers: %s", err)
+	}
+
+	lastHeight := uint32(headers[len(headers)-1].height)
+	err := dbUpdate(h.db, func(bucket walletdb.ReadWriteBucket) error {
+		for _, node := range headers {
+			err := putHeaderIndex(node.header.BlockHash(),
+				uint32(node.height))(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		if err := putMaxBlockHeight(lastHeight)(bucket); err != nil {
+			return err
+		}
+		return applyUpdates(bucket)
+	})
+	if err != nil {
+		h.file.Truncate(offset)
+		return err
+	}
+
+	h.tipHeight = lastHeight
+	return nil
+}
+
+// rollbackLastBlock removes the last header in the chain and returns the new
+// tip.
+func (h *flatHeaderStore) rollbackLastBlock() (*waddrmgr.BlockStamp, error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.tipHeight == 0 {
+		return nil, fmt.Errorf("can't roll back the genesis block")
+	}
+	header, err := h.readHeader(h.tipHeight)
+	if err != nil {
+		return nil, err
+	}
+	prevHeader, err := h.readHeader(h.tipHeight - 1)
+	if err != nil {
+		return nil, err
+	}
+
+	// The database goes first, so it never has an index entry for a
+	// header that isn't in the file.
+	blockHash := header.BlockHash()
+	err = dbUpdate(h.db, func(bucket walletdb.ReadWriteBucket) error {
+		err := deleteHeaderIndex(blockHash)(bucket)
+		if err != nil {
+			return err
+		}
+		return putMaxBlockHeight(h.tipHeight - 1)(bucket)
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.tipHeight--
+
+	// If this fails, the extra header is truncated the next time the
+	// store is opened.
+	err = h.file.Truncate(int64(h.tipHeight+1) * wire.MaxBlockHeaderPayload)
+	if err != nil {
+		log.Warnf("Unable to truncate header file: %s", err)
+	}
+
+	return &waddrmgr.BlockStamp{
+		Hash:   prevHeader.BlockHash(),
+		Height: int32(h.tipHeight),
+	}, nil
+}
+
+// reorg replaces the headers above forkHeight with the passed headers and
+// applies the passed updates, all in a single database transaction. The new
+// headers are journaled in the same transaction and then written to the file.
+func (h *flatHeaderStore) reorg(forkHeight uint32, headers []*headerNode,
+	updates ...dbUpdateOption) error {
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.journalErr != nil {
+		return h.journalErr
+	}
+	if forkHeight > h.tipHeight {
+		return fmt.Errorf("fork height %d is past the tip at height "+
+			"%d", forkHeight, h.tipHeight)
+	}
+
+	// The journal holds the fork height followed by the serialized new
+	// headers.
+	var journal bytes.Buffer
+	journal.Write(uint32ToBytes(forkHeight))
+	for i, node := range headers {
+		if uint32(node.height) != forkHeight+uint32(i)+1 {
+			return fmt.Errorf("headers to write aren't " +
+				"consecutive from the fork point")
+		}
+		if err := node.header.Serialize(&journal); err != nil {
+			return err
+		}
+	}
+	newTip := forkHeight + uint32(len(headers))
+
+	err := dbUpdate(h.db, func(bucket walletdb.ReadWriteBucket) error {
+		for height := h.tipHeight; height > forkHeight; height-- {
+			header, err := h.readHeader(height)
+			if err != nil {
+				return err
+			}
+			err = deleteHeaderIndex(header.BlockHash())(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		for _, node := range headers {
+			err := putHeaderIndex(node.header.BlockHash(),
+				uint32(node.height))(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		if err := putMaxBlockHeight(newTip)(bucket); err != nil {
+			return err
+		}
+		if len(headers) != 0 {
+			err := bucket.Put(reorgJournalName, journal.Bytes())
+			if err != nil {
+				return fmt.Errorf("failed to store reorg "+
+					"journal: %s", err)
+			}
+		}
+		for _, update := range updates {
+			if err := update(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The reorg is committed at this point, so if we can't update the
+	// file now, it's done from the journal the next time the store is
+	// opened. Until then, the file holds the old headers at the new
+	// heights, so the store refuses to be used.
+	if err := h.replayJournal(); err != nil {
+		h.journalErr = fmt.Errorf("unable to write reorged headers: "+
+			"%s", err)
+		return h.journalErr
+	}
+	h.tipHeight = newTip
+	err = h.file.Truncate(int64(newTip+1) * wire.MaxBlockHeaderPayload)
+	if err != nil {
+		log.Warnf("Unable to truncate header file: %s", err)
+	}
+	return nil
+}
+
+// replayJournal writes the headers in the reorg journal, if there is one, to
+// the file and removes the journal.
+func (h *flatHeaderStore) replayJournal() error {
+	var journal []byte
+	err := dbView(h.db, func(bucket walletdb.ReadBucket) error {
+		journalBytes := bucket.Get(reorgJournalName)
+		if journalBytes == nil {
+			return nil
+		}
+		if len(journalBytes) < 4 || (len(journalBytes)-4)%
+			wire.MaxBlockHeaderPayload != 0 {
+			return fmt.Errorf("invalid reorg journal of %d bytes",
+				len(journalBytes))
+		}
+		journal = make([]byte, len(journalBytes))
+		copy(journal, journalBytes)
+		return nil
+	})
+	if err != nil || journal == nil {
+		return err
+	}
+
+	forkHeight := binary.LittleEndian.Uint32(journal[:4])
+	offset := int64(forkHeight+1) * wire.MaxBlockHeaderPayload
+	if _, err := h.file.WriteAt(journal[4:], offset); err != nil {
+		return err
+	}
+	if err := h.file.Sync(); err != nil {
+		return err
+	}
+	return dbUpdate(h.db, func(bucket walletdb.ReadWriteBucket) error {
+		return bucket.Delete(reorgJournalName)
+	})
+}
+
+// close closes the header file.
+func (h *flatHeaderStore) close() error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	return h.file.Close()
+}
+
+// putHeaderIndex stores the height of the block with the passed hash in the
+// header index.
+func putHeaderIndex(blockHash chainhash.Hash, height uint32) dbUpdateOption {
+	return func(bucket walletdb.ReadWriteBucket) error {
+		bhBucket := bucket.NestedReadWriteBucket(blockHeaderBucketName)
+		err := bhBucket.Put(blockHash[:], uint32ToBytes(height))
+		if err != nil {
+			return fmt.Errorf("failed to store block height info:"+
+				" %s", err)
+		}
+		return nil
+	}
+}
+
+// getHeaderIndex retrieves the height of the block with the passed hash from
+// the header index.
+func getHeaderIndex(blockHash chainhash.Hash, height *uint32) dbViewOption {
+	return func(bucket walletdb.ReadBucket) error {
+		bhBucket := bucket.NestedReadBucket(blockHeaderBucketName)
+		indexBytes := bhBucket.Get(blockHash[:])
+		if len(indexBytes) != 4 {
+			return fmt.Errorf("failed to retrieve block info for"+
+				" hash %s: got %d bytes", blockHash,
+				len(indexBytes))
+		}
+		*height = binary.LittleEndian.Uint32(indexBytes)
+		return nil
+	}
+}
+
+// deleteHeaderIndex removes the block with the passed hash from the header
+// index.
+func deleteHeaderIndex(blockHash chainhash.Hash) dbUpdateOption {
+	return func(bucket walletdb.ReadWriteBucket) error {
+		bhBucket := bucket.NestedReadWriteBucket(blockHeaderBucketName)
+		return bhBucket.Delete(blockHash[:])
+	}
+}
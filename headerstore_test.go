@@ -0,0 +1,439 @@
+package neutrino
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcwallet/walletdb"
+	_ "github.com/btcsuite/btcwallet/walletdb/bdb"
+)
+
+// testGenesis is the genesis header of the chain used by the header store
+// tests.
+var testGenesis = &chaincfg.RegressionNetParams.GenesisBlock.Header
+
+// newTestDB creates a database with the SPV namespace for the regression test
+// network in a temporary directory. The returned function closes and removes
+// it.
+func newTestDB(t *testing.T) (walletdb.DB, string, func()) {
+	dir, err := ioutil.TempDir("", "neutrino")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	db, err := walletdb.Create("bdb", filepath.Join(dir, "neutrino.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("unable to create database: %s", err)
+	}
+	s := &ChainService{
+		db:          db,
+		chainParams: chaincfg.RegressionNetParams,
+	}
+	if err := s.createSPVNS(); err != nil {
+		db.Close()
+		os.RemoveAll(dir)
+		t.Fatalf("unable to create SPV namespace: %s", err)
+	}
+	return db, dir, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// makeTestHeaders returns num headers that build on prev, which is at the
+// passed height. The seed makes the headers differ from those built on the
+// same header with another seed.
+func makeTestHeaders(prev *wire.BlockHeader, height int32, num int,
+	seed uint32) []*headerNode {
+
+	nodes := make([]*headerNode, 0, num)
+	for i := 0; i < num; i++ {
+		header := &wire.BlockHeader{
+			Version:   1,
+			PrevBlock: prev.BlockHash(),
+			Timestamp: prev.Timestamp.Add(600e9),
+			Bits:      prev.Bits,
+			Nonce:     seed,
+		}
+		height++
+		nodes = append(nodes, &headerNode{
+			header: header,
+			height: height,
+		})
+		prev = header
+	}
+	return nodes
+}
+
+// checkTestHeaders checks that the store's chain consists of the genesis
+// header followed by the passed headers.
+func checkTestHeaders(t *testing.T, store *flatHeaderStore,
+	nodes []*headerNode) {
+
+	t.Helper()
+
+	want := append([]*headerNode{{header: testGenesis}}, nodes...)
+	tip, tipHeight, err := store.chainTip()
+	if err != nil {
+		t.Fatalf("unable to get chain tip: %s", err)
+	}
+	if tipHeight != uint32(len(want)-1) {
+		t.Fatalf("tip at height %d, want %d", tipHeight, len(want)-1)
+	}
+	if tip.BlockHash() != want[len(want)-1].header.BlockHash() {
+		t.Fatalf("tip is %s, want %s", tip.BlockHash(),
+			want[len(want)-1].header.BlockHash())
+	}
+	for height, node := range want {
+		blockHash := node.header.BlockHash()
+		header, err := store.fetchHeaderByHeight(uint32(height))
+		if err != nil {
+			t.Fatalf("unable to fetch header at height %d: %s",
+				height, err)
+		}
+		if header.BlockHash() != blockHash {
+			t.Fatalf("header at height %d is %s, want %s", height,
+				header.BlockHash(), blockHash)
+		}
+		_, gotHeight, err := store.fetchHeader(blockHash)
+		if err != nil {
+			t.Fatalf("unable to fetch header %s: %s", blockHash,
+				err)
+		}
+		if gotHeight != uint32(height) {
+			t.Fatalf("header %s at height %d, want %d", blockHash,
+				gotHeight, height)
+		}
+	}
+	if _, err := store.fetchHeaderByHeight(tipHeight + 1); err == nil {
+		t.Fatalf("fetched header past the tip")
+	}
+}
+
+// openTestStore opens the header store in the passed directory.
+func openTestStore(t *testing.T, db walletdb.DB,
+	dir string) *flatHeaderStore {
+
+	t.Helper()
+
+	store, err := newFlatHeaderStore(filepath.Join(dir, headerFileName),
+		db, testGenesis)
+	if err != nil {
+		t.Fatalf("unable to open header store: %s", err)
+	}
+	return store
+}
+
+// TestFlatHeaderStoreWrite checks that written headers can be read back, also
+// after reopening the store, and that headers that don't extend the tip are
+// rejected.
+func TestFlatHeaderStoreWrite(t *testing.T) {
+	db, dir, cleanup := newTestDB(t)
+	defer cleanup()
+
+	store := openTestStore(t, db, dir)
+	nodes := makeTestHeaders(testGenesis, 0, 10, 0)
+	if err := store.writeHeaders(nodes[:4]); err != nil {
+		t.Fatalf("unable to write headers: %s", err)
+	}
+	if err := store.writeHeaders(nodes[4:]); err != nil {
+		t.Fatalf("unable to write headers: %s", err)
+	}
+	checkTestHeaders(t, store, nodes)
+
+	// Headers that skip a height or repeat the tip are rejected, and
+	// leave the chain as it was.
+	more := makeTestHeaders(nodes[9].header, 10, 2, 0)
+	if err := store.writeHeaders(more[1:]); err == nil {
+		t.Fatalf("wrote header that doesn't extend the tip")
+	}
+	if err := store.writeHeaders(nodes[9:]); err == nil {
+		t.Fatalf("wrote header at the tip's height")
+	}
+	checkTestHeaders(t, store, nodes)
+
+	if err := store.close(); err != nil {
+		t.Fatalf("unable to close header store: %s", err)
+	}
+	store = openTestStore(t, db, dir)
+	defer store.close()
+	checkTestHeaders(t, store, nodes)
+}
+
+// TestFlatHeaderStoreRollback checks that rolling back removes headers from
+// the tip, and that the genesis header can't be rolled back.
+func TestFlatHeaderStoreRollback(t *testing.T) {
+	db, dir, cleanup := newTestDB(t)
+	defer cleanup()
+
+	store := openTestStore(t, db, dir)
+	defer store.close()
+	nodes := makeTestHeaders(testGenesis, 0, 3, 0)
+	if err := store.writeHeaders(nodes); err != nil {
+		t.Fatalf("unable to write headers: %s", err)
+	}
+
+	for i := len(nodes) - 1; i >= 0; i-- {
+		bs, err := store.rollbackLastBlock()
+		if err != nil {
+			t.Fatalf("unable to roll back: %s", err)
+		}
+		want := testGenesis.BlockHash()
+		if i > 0 {
+			want = nodes[i-1].header.BlockHash()
+		}
+		if bs.Hash != want || bs.Height != int32(i) {
+			t.Fatalf("rolled back to %s at height %d, want %s at "+
+				"height %d", bs.Hash, bs.Height, want, i)
+		}
+		checkTestHeaders(t, store, nodes[:i])
+
+		rolledBack := nodes[i].header.BlockHash()
+		if _, _, err := store.fetchHeader(rolledBack); err == nil {
+			t.Fatalf("rolled back header %s still indexed",
+				rolledBack)
+		}
+	}
+	if _, err := store.rollbackLastBlock(); err == nil {
+		t.Fatalf("rolled back the genesis header")
+	}
+}
+
+// TestFlatHeaderStoreReorg checks that reorgs replace the headers above the
+// fork point, both when the file is written right away and when the write is
+// interrupted and the journal is replayed when the store is reopened.
+func TestFlatHeaderStoreReorg(t *testing.T) {
+	tests := []struct {
+		name       string
+		forkHeight int32
+		numNew     int
+	}{
+		{name: "longer", forkHeight: 5, numNew: 8},
+		{name: "shorter", forkHeight: 5, numNew: 2},
+		{name: "same length", forkHeight: 2, numNew: 8},
+		{name: "from genesis", forkHeight: 0, numNew: 3},
+		{name: "no new headers", forkHeight: 4, numNew: 0},
+	}
+
+	for _, test := range tests {
+		for _, interrupted := range []bool{false, true} {
+			name := test.name
+			if interrupted {
+				name += " interrupted"
+			}
+			t.Run(name, func(t *testing.T) {
+				testFlatHeaderStoreReorg(t, test.forkHeight,
+					test.numNew, interrupted)
+			})
+		}
+	}
+}
+
+func testFlatHeaderStoreReorg(t *testing.T, forkHeight int32, numNew int,
+	interrupted bool) {
+
+	db, dir, cleanup := newTestDB(t)
+	defer cleanup()
+
+	store := openTestStore(t, db, dir)
+	nodes := makeTestHeaders(testGenesis, 0, 10, 0)
+	if err := store.writeHeaders(nodes); err != nil {
+		t.Fatalf("unable to write headers: %s", err)
+	}
+
+	fork := testGenesis
+	if forkHeight > 0 {
+		fork = nodes[forkHeight-1].header
+	}
+	newNodes := makeTestHeaders(fork, forkHeight, numNew, 1)
+	want := append(append([]*headerNode(nil), nodes[:forkHeight]...),
+		newNodes...)
+
+	// A read-only file makes the reorg fail right after its database
+	// transaction has been committed, just like a crash would. The store
+	// must refuse to be used until it's reopened.
+	if interrupted {
+		store.file.Close()
+		file, err := os.Open(filepath.Join(dir, headerFileName))
+		if err != nil {
+			t.Fatalf("unable to open header file: %s", err)
+		}
+		store.file = file
+		err = store.reorg(uint32(forkHeight), newNodes)
+		if numNew > 0 {
+			if err == nil {
+				t.Fatalf("reorg succeeded with a read-only " +
+					"header file")
+			}
+			if _, _, err := store.chainTip(); err == nil {
+				t.Fatalf("read from header store after a " +
+					"failed reorg")
+			}
+		}
+		store.close()
+		store = openTestStore(t, db, dir)
+	} else {
+		err := store.reorg(uint32(forkHeight), newNodes)
+		if err != nil {
+			t.Fatalf("unable to reorg: %s", err)
+		}
+	}
+	defer store.close()
+	checkTestHeaders(t, store, want)
+
+	for _, node := range nodes[forkHeight:] {
+		blockHash := node.header.BlockHash()
+		if _, _, err := store.fetchHeader(blockHash); err == nil {
+			t.Fatalf("reorged header %s still indexed", blockHash)
+		}
+	}
+	err := dbView(db, func(bucket walletdb.ReadBucket) error {
+		if bucket.Get(reorgJournalName) != nil {
+			t.Fatalf("reorg journal wasn't removed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to read database: %s", err)
+	}
+}
+
+// TestFlatHeaderStoreTruncate checks that anything in the header file past
+// the database's tip is truncated when the store is opened.
+func TestFlatHeaderStoreTruncate(t *testing.T) {
+	db, dir, cleanup := newTestDB(t)
+	defer cleanup()
+
+	store := openTestStore(t, db, dir)
+	nodes := makeTestHeaders(testGenesis, 0, 5, 0)
+	if err := store.writeHeaders(nodes); err != nil {
+		t.Fatalf("unable to write headers: %s", err)
+	}
+
+	// A header and a half that never made it to the database.
+	extra := makeTestHeaders(nodes[4].header, 5, 1, 0)
+	var buf bytes.Buffer
+	extra[0].header.Serialize(&buf)
+	buf.Write(buf.Bytes()[:wire.MaxBlockHeaderPayload/2])
+	_, err := store.file.WriteAt(buf.Bytes(),
+		6*wire.MaxBlockHeaderPayload)
+	if err != nil {
+		t.Fatalf("unable to write to header file: %s", err)
+	}
+	store.close()
+
+	store = openTestStore(t, db, dir)
+	defer store.close()
+	checkTestHeaders(t, store, nodes)
+
+	info, err := os.Stat(filepath.Join(dir, headerFileName))
+	if err != nil {
+		t.Fatalf("unable to stat header file: %s", err)
+	}
+	if info.Size() != 6*wire.MaxBlockHeaderPayload {
+		t.Fatalf("header file is %d bytes, want %d", info.Size(),
+			6*wire.MaxBlockHeaderPayload)
+	}
+}
+
+// TestFlatHeaderStoreMigrate checks that headers stored in the database by
+// older versions are moved to the header file and removed from the database,
+// also when the move was interrupted after the file was written.
+func TestFlatHeaderStoreMigrate(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// fileHeaders is the number of headers already in the header
+		// file when the store is opened.
+		fileHeaders int
+	}{
+		{name: "no header file", fileHeaders: 0},
+		{name: "partial header file", fileHeaders: 4},
+		{name: "complete header file", fileHeaders: 11},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testFlatHeaderStoreMigrate(t, test.fileHeaders)
+		})
+	}
+}
+
+func testFlatHeaderStoreMigrate(t *testing.T, fileHeaders int) {
+	db, dir, cleanup := newTestDB(t)
+	defer cleanup()
+
+	nodes := makeTestHeaders(testGenesis, 0, 10, 0)
+	all := append([]*headerNode{{header: testGenesis}}, nodes...)
+
+	// Store the headers the way version 1 did: the serialized header and
+	// height keyed by block hash, and the block hash keyed by height.
+	err := dbUpdate(db, func(bucket walletdb.ReadWriteBucket) error {
+		bhBucket := bucket.NestedReadWriteBucket(blockHeaderBucketName)
+		for height, node := range all {
+			var buf bytes.Buffer
+			node.header.Serialize(&buf)
+			buf.Write(uint32ToBytes(uint32(height)))
+			blockHash := node.header.BlockHash()
+			err := bhBucket.Put(blockHash[:], buf.Bytes())
+			if err != nil {
+				return err
+			}
+			err = bhBucket.Put(uint32ToBytes(uint32(height)),
+				blockHash[:])
+			if err != nil {
+				return err
+			}
+		}
+		if err := putMaxBlockHeight(10)(bucket); err != nil {
+			return err
+		}
+		return putDBVersion(1)(bucket)
+	})
+	if err != nil {
+		t.Fatalf("unable to store version 1 headers: %s", err)
+	}
+
+	var buf bytes.Buffer
+	for _, node := range all[:fileHeaders] {
+		node.header.Serialize(&buf)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, headerFileName),
+		buf.Bytes(), 0600)
+	if err != nil {
+		t.Fatalf("unable to write header file: %s", err)
+	}
+
+	store := openTestStore(t, db, dir)
+	defer store.close()
+	checkTestHeaders(t, store, nodes)
+
+	err = dbView(db, func(bucket walletdb.ReadBucket) error {
+		var version uint32
+		if err := fetchDBVersion(&version)(bucket); err != nil {
+			return err
+		}
+		if version != latestDBVersion {
+			t.Fatalf("database version is %d, want %d", version,
+				latestDBVersion)
+		}
+
+		bhBucket := bucket.NestedReadBucket(blockHeaderBucketName)
+		return bhBucket.ForEach(func(k, v []byte) error {
+			if len(k) != chainhash.HashSize || len(v) != 4 {
+				t.Fatalf("old header index entry %x: %x left "+
+					"in database", k, v)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("unable to read database: %s", err)
+	}
+}
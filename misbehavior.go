@@ -0,0 +1,131 @@
+// NOTE: THIS API IS UNSTABLE RIGHT NOW.
+
+package neutrino
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Misbehavior is a kind of invalid data a peer has served us in answer to one
+// of our queries.
+type Misbehavior uint8
+
+const (
+	// ShortFilter is a filter too short to hold its own element count.
+	ShortFilter Misbehavior = iota
+
+	// MalformedFilter is a filter that can't be decoded.
+	MalformedFilter
+
+	// InvalidFilter is a filter that doesn't match the filter header we
+	// have for its block, and still doesn't once we've fetched the filter
+	// header again.
+	InvalidFilter
+
+	// InvalidBlock is a block that doesn't pass the sanity checks for the
+	// block hash it claims.
+	InvalidBlock
+
+	// InvalidWitnessCommitment is a block whose witness data doesn't
+	// match the witness commitment in its coinbase.
+	InvalidWitnessCommitment
+
+	// InvalidFilterHeader is a filter header that doesn't match the block
+	// it's for, or a run of filter headers that doesn't end at the filter
+	// header checkpoint we've settled on.
+	InvalidFilterHeader
+
+	// numMisbehaviors is the number of kinds of misbehavior we count.
+	numMisbehaviors
+)
+
+var (
+	// MisbehaviorCooldown is how long our queries skip a peer for after
+	// it has served us invalid data, as long as there are other peers to
+	// ask.
+	MisbehaviorCooldown = 10 * time.Minute
+)
+
+// misbehaviorInfo describes how a kind of misbehavior is reported and how
+// much it adds to the peer's ban score.
+var misbehaviorInfo = [numMisbehaviors]struct {
+	reason     string
+	persistent uint32
+	transient  uint32
+}{
+	ShortFilter:     {"sent a filter that's too short", 0, 25},
+	MalformedFilter: {"sent a malformed filter", 0, 25},
+	InvalidFilter: {"sent a filter that doesn't match its filter " +
+		"header", 50, 0},
+	InvalidBlock: {"sent a block that fails sanity checks", 50, 0},
+	InvalidWitnessCommitment: {"sent a block with an invalid " +
+		"witness commitment", BanThreshold + 1, 0},
+	InvalidFilterHeader: {"sent an invalid filter header",
+		BanThreshold + 1, 0},
+}
+
+// String returns a description of the misbehavior.
+func (m Misbehavior) String() string {
+	if m >= numMisbehaviors {
+		return "unknown misbehavior"
+	}
+	return misbehaviorInfo[m].reason
+}
+
+// misbehaved records that the peer has served us invalid data of the passed
+// kind, and increases its ban score accordingly.
+func (sp *serverPeer) misbehaved(m Misbehavior) {
+	atomic.AddUint32(&sp.misbehaviors[m], 1)
+	atomic.StoreInt64(&sp.lastMisbehavior, time.Now().UnixNano())
+
+	info := misbehaviorInfo[m]
+	sp.addBanScore(info.persistent, info.transient, info.reason)
+}
+
+// MisbehaviorCount returns how many times the peer has served us invalid data
+// of the passed kind since it connected.
+func (sp *serverPeer) MisbehaviorCount(m Misbehavior) uint32 {
+	if m >= numMisbehaviors {
+		return 0
+	}
+	return atomic.LoadUint32(&sp.misbehaviors[m])
+}
+
+// LastMisbehavior returns when the peer last served us invalid data, or the
+// zero time if it never has.
+func (sp *serverPeer) LastMisbehavior() time.Time {
+	last := atomic.LoadInt64(&sp.lastMisbehavior)
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, last)
+}
+
+// recentlyMisbehaved returns whether the peer has served us invalid data
+// within the last MisbehaviorCooldown.
+func (sp *serverPeer) recentlyMisbehaved() bool {
+	last := sp.LastMisbehavior()
+	return !last.IsZero() && time.Since(last) < MisbehaviorCooldown
+}
+
+// queryablePeers returns the connected peers that our queries should go to,
+// leaving out those that have recently served us invalid data. If that would
+// leave no peers, all connected peers are returned, so that queries can still
+// make progress.
+func (s *ChainService) queryablePeers() []*serverPeer {
+	var connected, wellBehaved []*serverPeer
+	for _, sp := range s.Peers() {
+		if !sp.Connected() {
+			continue
+		}
+		connected = append(connected, sp)
+		if !sp.recentlyMisbehaved() {
+			wellBehaved = append(wellBehaved, sp)
+		}
+	}
+	if len(wellBehaved) == 0 {
+		return connected
+	}
+	return wellBehaved
+}
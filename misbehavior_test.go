@@ -0,0 +1,231 @@
+package neutrino
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestMisbehaved checks that each kind of misbehavior is counted and adds its
+// persistent and transient ban score, and that a peer whose ban score passes
+// BanThreshold is banned and disconnected.
+func TestMisbehaved(t *testing.T) {
+	tests := []struct {
+		name  string
+		kind  Misbehavior
+		times int
+
+		// persistent and transient are the parts of the ban score the
+		// misbehavior should add up to. The transient part decays, so
+		// it may be a little lower by the time we check it.
+		persistent uint32
+		transient  uint32
+
+		banned bool
+	}{
+		{
+			name:      "short filter",
+			kind:      ShortFilter,
+			times:     1,
+			transient: 25,
+		},
+		{
+			name:      "repeated short filters",
+			kind:      ShortFilter,
+			times:     5,
+			transient: 125,
+			banned:    true,
+		},
+		{
+			name:      "malformed filter",
+			kind:      MalformedFilter,
+			times:     2,
+			transient: 50,
+		},
+		{
+			name:       "invalid filters",
+			kind:       InvalidFilter,
+			times:      2,
+			persistent: 100,
+		},
+		{
+			name:       "repeated invalid filters",
+			kind:       InvalidFilter,
+			times:      3,
+			persistent: 150,
+			banned:     true,
+		},
+		{
+			name:       "invalid block",
+			kind:       InvalidBlock,
+			times:      1,
+			persistent: 50,
+		},
+		{
+			name:       "invalid witness commitment",
+			kind:       InvalidWitnessCommitment,
+			times:      1,
+			persistent: BanThreshold + 1,
+			banned:     true,
+		},
+		{
+			name:       "invalid filter header",
+			kind:       InvalidFilterHeader,
+			times:      1,
+			persistent: BanThreshold + 1,
+			banned:     true,
+		},
+	}
+
+	for _, test := range tests {
+		s, cleanup := newTestChainService(t)
+		sp := newTestFetchPeer(t, s, 0, 0)
+
+		start := time.Now()
+		for i := 0; i < test.times; i++ {
+			sp.misbehaved(test.kind)
+		}
+
+		for m := Misbehavior(0); m < numMisbehaviors; m++ {
+			want := uint32(0)
+			if m == test.kind {
+				want = uint32(test.times)
+			}
+			if count := sp.MisbehaviorCount(m); count != want {
+				t.Errorf("%s: %d %q counted, want %d",
+					test.name, count, m, want)
+			}
+		}
+		if last := sp.LastMisbehavior(); last.Before(start) {
+			t.Errorf("%s: last misbehavior at %v, want after %v",
+				test.name, last, start)
+		}
+
+		score := sp.banScore.Int()
+		if score < test.persistent ||
+			score > test.persistent+test.transient ||
+			test.transient > 0 && score == test.persistent {
+
+			t.Errorf("%s: ban score is %d, want %d persistent and "+
+				"up to %d transient", test.name, score,
+				test.persistent, test.transient)
+		}
+
+		var banned bool
+		select {
+		case bannedPeer := <-s.banPeers:
+			banned = bannedPeer == sp
+		default:
+		}
+		if banned != test.banned {
+			t.Errorf("%s: peer banned is %v, want %v", test.name,
+				banned, test.banned)
+		}
+		if sp.Connected() == test.banned {
+			t.Errorf("%s: peer connected is %v, want %v",
+				test.name, sp.Connected(), !test.banned)
+		}
+
+		sp.Disconnect()
+		cleanup()
+	}
+}
+
+// TestQueryablePeers checks that queries skip peers that have misbehaved
+// within MisbehaviorCooldown, unless that would leave no peers to ask, and
+// never go to peers that aren't connected.
+func TestQueryablePeers(t *testing.T) {
+	type testPeer struct {
+		// misbehaved is how long ago the peer last misbehaved, or
+		// zero if it never has.
+		misbehaved time.Duration
+
+		disconnected bool
+	}
+
+	recently := MisbehaviorCooldown / 2
+	longAgo := MisbehaviorCooldown * 2
+
+	tests := []struct {
+		name  string
+		peers []testPeer
+
+		// queryable is the indices of the peers queries should go to.
+		queryable []int
+	}{
+		{
+			name:      "no peers",
+			queryable: nil,
+		},
+		{
+			name:      "well behaved peers",
+			peers:     []testPeer{{}, {}},
+			queryable: []int{0, 1},
+		},
+		{
+			name:      "recently misbehaved peer skipped",
+			peers:     []testPeer{{misbehaved: recently}, {}},
+			queryable: []int{1},
+		},
+		{
+			name:      "cooldown over",
+			peers:     []testPeer{{misbehaved: longAgo}, {}},
+			queryable: []int{0, 1},
+		},
+		{
+			name: "only misbehaved peers",
+			peers: []testPeer{
+				{misbehaved: recently},
+				{misbehaved: recently},
+			},
+			queryable: []int{0, 1},
+		},
+		{
+			name: "disconnected peer skipped",
+			peers: []testPeer{
+				{disconnected: true},
+				{misbehaved: recently},
+			},
+			queryable: []int{1},
+		},
+	}
+
+	for _, test := range tests {
+		s, cleanup := newTestChainService(t)
+
+		var peers []*serverPeer
+		for i, tp := range test.peers {
+			sp := newTestFetchPeer(t, s, i, 0)
+			if tp.misbehaved != 0 {
+				last := time.Now().Add(-tp.misbehaved)
+				atomic.StoreInt64(&sp.lastMisbehavior,
+					last.UnixNano())
+			}
+			if tp.disconnected {
+				sp.Disconnect()
+			}
+			peers = append(peers, sp)
+		}
+		done := make(chan struct{})
+		serveTestPeers(s, peers, done)
+
+		queryable := s.queryablePeers()
+		if len(queryable) != len(test.queryable) {
+			t.Errorf("%s: got %d queryable peers, want %d",
+				test.name, len(queryable), len(test.queryable))
+		} else {
+			for i, index := range test.queryable {
+				if queryable[i] != peers[index] {
+					t.Errorf("%s: queryable peer %d isn't "+
+						"peer %d", test.name, i, index)
+				}
+			}
+		}
+
+		close(done)
+		for _, sp := range peers {
+			sp.Disconnect()
+		}
+		cleanup()
+	}
+}
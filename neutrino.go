@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -109,20 +110,15 @@ func (ps *peerState) forAllPeers(closure func(sp *serverPeer)) {
 	ps.forAllOutboundPeers(closure)
 }
 
-// cfhRequest records which cfheaders we've requested, and the order in which
-// we've requested them. Since there's no way to associate the cfheaders to the
-// actual block hashes based on the cfheaders message to keep it compact, we
-// track it this way.
-type cfhRequest struct {
-	extended bool
-	stopHash chainhash.Hash
-}
-
 // serverPeer extends the peer to maintain state shared by the server and the
 // blockmanager.
 type serverPeer struct {
 	// The following variables must only be used atomically
-	feeFilter int64
+	feeFilter       int64
+	fetchingHeaders int32
+	headerLatency   int64
+	lastMisbehavior int64
+	misbehaviors    [numMisbehaviors]uint32
 
 	*peer.Peer
 
@@ -136,6 +132,12 @@ type serverPeer struct {
 	banScore       connmgr.DynamicBanScore
 	quit           chan struct{}
 
+	// headerRequest is the oldest getheaders message sent to the peer
+	// that it hasn't answered yet, if any. It's used to measure the
+	// peer's header response latency.
+	headerRequest    *headerRequest
+	headerRequestMtx sync.Mutex
+
 	// The following map of subcribers is used to subscribe to messages
 	// from the peer. This allows broadcast to multiple subscribers at
 	// once, allowing for multiple queries to be going to multiple peers at
@@ -144,23 +146,17 @@ type serverPeer struct {
 	// can't accept will be dropped silently.
 	recvSubscribers map[spMsgSubscription]struct{}
 	mtxSubscribers  sync.RWMutex
-
-	// These are only necessary until the cfheaders logic is refactored as
-	// a query client.
-	requestedCFHeaders map[cfhRequest]int
-	mtxReqCFH          sync.Mutex
 }
 
 // newServerPeer returns a new serverPeer instance. The peer needs to be set by
 // the caller.
 func newServerPeer(s *ChainService, isPersistent bool) *serverPeer {
 	return &serverPeer{
-		server:             s,
-		persistent:         isPersistent,
-		requestedCFHeaders: make(map[cfhRequest]int),
-		knownAddresses:     make(map[string]struct{}),
-		quit:               make(chan struct{}),
-		recvSubscribers:    make(map[spMsgSubscription]struct{}),
+		server:          s,
+		persistent:      isPersistent,
+		knownAddresses:  make(map[string]struct{}),
+		quit:            make(chan struct{}),
+		recvSubscribers: make(map[spMsgSubscription]struct{}),
 	}
 }
 
@@ -219,29 +215,12 @@ func (sp *serverPeer) addBanScore(persistent, transient uint32, reason string) {
 	}
 }
 
-// pushGetCFHeadersMsg sends a getcfheaders message for the provided block
-// locator and stop hash to the connected peer.
-func (sp *serverPeer) pushGetCFHeadersMsg(locator blockchain.BlockLocator,
-	stopHash *chainhash.Hash, ext bool) error {
-
-	msg := wire.NewMsgGetCFHeaders()
-	msg.HashStop = *stopHash
-	for _, hash := range locator {
-		err := msg.AddBlockLocatorHash(hash)
-		if err != nil {
-			return err
-		}
-	}
-
-	msg.Extended = ext
-	sp.QueueMessage(msg, nil)
-	return nil
-}
-
-// pushSendHeadersMsg sends a sendheaders message to the connected peer.
+// pushSendHeadersMsg sends a sendheaders message to the connected peer if it
+// supports it, so that it announces new blocks to us with a headers message
+// rather than an inv.
 func (sp *serverPeer) pushSendHeadersMsg() error {
 	if sp.VersionKnown() {
-		if sp.ProtocolVersion() > wire.SendHeadersVersion {
+		if sp.ProtocolVersion() >= wire.SendHeadersVersion {
 			sp.QueueMessage(wire.NewMsgSendHeaders(), nil)
 		}
 	}
@@ -326,6 +305,14 @@ func (sp *serverPeer) OnInv(p *peer.Peer, msg *wire.MsgInv) {
 func (sp *serverPeer) OnHeaders(p *peer.Peer, msg *wire.MsgHeaders) {
 	log.Tracef("Got headers with %d items from %s", len(msg.Headers),
 		p.Addr())
+	sp.headersReceived(msg.Headers)
+
+	// If we're downloading a range of headers from this peer in
+	// parallel, the header fetcher gets the message through its
+	// subscription instead.
+	if atomic.LoadInt32(&sp.fetchingHeaders) != 0 {
+		return
+	}
 	sp.server.blockManager.QueueHeaders(msg, sp)
 }
 
@@ -422,14 +409,6 @@ func (sp *serverPeer) OnReject(_ *peer.Peer, msg *wire.MsgReject) {
 	// TODO(roaseef): log?
 }
 
-// OnCFHeaders is invoked when a peer receives a cfheaders bitcoin message and
-// is used to notify the server about a list of committed filter headers.
-func (sp *serverPeer) OnCFHeaders(p *peer.Peer, msg *wire.MsgCFHeaders) {
-	log.Tracef("Got cfheaders message with %d items from %s",
-		len(msg.HeaderHashes), p.Addr())
-	sp.server.blockManager.QueueCFHeaders(msg, sp)
-}
-
 // OnAddr is invoked when a peer receives an addr bitcoin message and is
 // used to notify the server about advertised addresses.
 func (sp *serverPeer) OnAddr(_ *peer.Peer, msg *wire.MsgAddr) {
@@ -531,22 +510,28 @@ func (sp *serverPeer) OnWrite(_ *peer.Peer, bytesWritten int, msg wire.Message,
 // blockSubscription allows a client to subscribe to and unsubscribe from block
 // connect and disconnect notifications.
 type blockSubscription struct {
-	onConnectBasic chan<- wire.BlockHeader
-	onConnectExt   chan<- wire.BlockHeader
-	onDisconnect   chan<- wire.BlockHeader
-	quit           <-chan struct{}
+	// filterType is the filter type whose filter headers must be synced
+	// for a block before it's sent on onConnect.
+	filterType   *FilterType
+	onConnect    chan<- wire.BlockHeader
+	onDisconnect chan<- wire.BlockHeader
+	quit         <-chan struct{}
 }
 
 // ChainService is instantiated with functional options
 type ChainService struct {
 	// The following variables must only be used atomically.
 	// Putting the uint64s first makes them 64-bit aligned for 32-bit systems.
-	bytesReceived uint64 // Total bytes received from all peers since start.
-	bytesSent     uint64 // Total bytes sent by all peers since start.
-	started       int32
-	shutdown      int32
+	bytesReceived  uint64 // Total bytes received from all peers since start.
+	bytesSent      uint64 // Total bytes sent by all peers since start.
+	blockHits      uint64 // Blocks served from the block cache.
+	blockStoreHits uint64 // Blocks read from the block store.
+	blockMisses    uint64 // Blocks fetched from the network.
+	started        int32
+	shutdown       int32
 
 	db                walletdb.DB
+	headers           headerStore
 	chainParams       chaincfg.Params
 	addrManager       *addrmgr.AddrManager
 	connManager       *connmgr.ConnManager
@@ -563,8 +548,32 @@ type ChainService struct {
 	blockSubscribers  map[blockSubscription]struct{}
 	mtxSubscribers    sync.RWMutex
 
-	// TODO: Add a map for more granular exclusion?
-	mtxCFilter sync.Mutex
+	// filterCheckpoints holds the user-supplied filter header
+	// checkpoints, keyed by block hash.
+	filterCheckpoints map[chainhash.Hash]FilterHeaderCheckpoint
+
+	// syncedFilterTypes are the filter types whose filter header chains
+	// we sync and whose filters we use.
+	syncedFilterTypes []*FilterType
+
+	// filterStorage decides which filters are kept in the database.
+	filterStorage FilterStoragePolicy
+
+	// filterCache holds recently used filters and filter headers.
+	filterCache *lruCache
+
+	// blockCache holds recently fetched blocks.
+	blockCache *lruCache
+
+	// blockStore holds the blocks that matched rescans on disk. It's nil
+	// unless Config.PersistMatchedBlocks is set.
+	blockStore *flatBlockStore
+
+	// cfilterFetches holds the filters that are being fetched from the
+	// network, so that concurrent requests for the same filter share a
+	// single fetch.
+	cfilterFetches    map[cfilterKey]*cfilterFetch
+	mtxCFilterFetches sync.Mutex
 
 	userAgentName    string
 	userAgentVersion string
@@ -627,29 +636,60 @@ func (s *ChainService) pushTxMsg(sp *serverPeer, hash *chainhash.Hash, doneChan
 }
 
 // rollBackToHeight rolls back all blocks until it hits the specified height.
-// It sends notifications along the way.
+// It sends notifications once the rollback is done.
 func (s *ChainService) rollBackToHeight(height uint32) (*waddrmgr.BlockStamp,
 	error) {
 	bs, err := s.SyncedTo()
 	if err != nil {
 		return nil, err
 	}
-	for uint32(bs.Height) > height {
-		header, _, err := s.GetBlockByHash(bs.Hash)
-		if err != nil {
-			return nil, err
-		}
-		bs, err = s.rollBackLastBlock()
+	if uint32(bs.Height) <= height {
+		return bs, nil
+	}
+	if _, err := s.reorgChain(height, nil); err != nil {
+		return nil, err
+	}
+	return s.SyncedTo()
+}
+
+// reorgChain replaces the blocks above forkHeight with the passed headers,
+// which may be empty. The disconnected blocks are removed along with their
+// filter headers, filters and matched marks, and the new headers are written,
+// all in a single database transaction. Disconnect notifications are only
+// sent once that's committed. It returns the disconnected headers, starting
+// with the old tip.
+func (s *ChainService) reorgChain(forkHeight uint32,
+	headers []*headerNode) ([]wire.BlockHeader, error) {
+
+	_, tipHeight, err := s.LatestBlock()
+	if err != nil {
+		return nil, err
+	}
+	var disconnected []wire.BlockHeader
+	var hashes []chainhash.Hash
+	for height := tipHeight; height > forkHeight; height-- {
+		header, err := s.GetBlockByHeight(height)
 		if err != nil {
 			return nil, err
 		}
-		// Now we send the block disconnected notifications.
-		// TODO: Rethink this so we don't send notifications
-		// outside the package directly from here, and so we
-		// don't end up halting in the middle of processing
-		// blocks if a client mishandles a channel while still
-		// guaranteeing in-order delivery.
-		s.mtxSubscribers.RLock()
+		disconnected = append(disconnected, header)
+		hashes = append(hashes, header.BlockHash())
+	}
+
+	err = s.headers.reorg(forkHeight, headers, deleteFilterHeaders(hashes),
+		deleteFilters(hashes), deleteMatchedFilters(hashes))
+	if err != nil {
+		return nil, err
+	}
+	s.uncacheBlocks(hashes...)
+
+	// Now we send the block disconnected notifications.
+	// TODO: Rethink this so we don't send notifications outside the
+	// package directly from here, and so we don't end up halting in the
+	// middle of processing blocks if a client mishandles a channel while
+	// still guaranteeing in-order delivery.
+	s.mtxSubscribers.RLock()
+	for _, header := range disconnected {
 		for sub := range s.blockSubscribers {
 			if sub.onDisconnect != nil {
 				select {
@@ -658,9 +698,10 @@ func (s *ChainService) rollBackToHeight(height uint32) (*waddrmgr.BlockStamp,
 				}
 			}
 		}
-		s.mtxSubscribers.RUnlock()
 	}
-	return bs, nil
+	s.mtxSubscribers.RUnlock()
+
+	return disconnected, nil
 }
 
 // peerHandler is used to handle peer operations such as adding and removing
@@ -757,6 +798,49 @@ type Config struct {
 	ChainParams  chaincfg.Params
 	ConnectPeers []string
 	AddPeers     []string
+
+	// HeaderSnapshot, if set, is the path to a headers snapshot file
+	// which is imported using ImportHeaders before networking starts.
+	// Only headers up to HeaderSnapshotHeight are imported, and the header
+	// at that height must hash to HeaderSnapshotHash.
+	HeaderSnapshot       string
+	HeaderSnapshotHeight uint32
+	HeaderSnapshotHash   chainhash.Hash
+
+	// Checkpoints are block header checkpoints that are used in addition
+	// to the ones in ChainParams, so that more recent checkpoints can be
+	// added without changing the chain parameters.
+	Checkpoints []chaincfg.Checkpoint
+
+	// FilterHeaderCheckpoints pin the basic and extended filter headers
+	// of blocks. Filter headers that don't match them are rejected, and
+	// they're used as block header checkpoints too.
+	FilterHeaderCheckpoints []FilterHeaderCheckpoint
+
+	// BasicFilterOnly makes the chain service sync and use only the basic
+	// filter header chain. Rescans then match watched outpoints and
+	// addresses only, as watched txids can't be matched without the
+	// extended filter.
+	BasicFilterOnly bool
+
+	// FilterStorage decides which of the filters fetched from the network
+	// are kept in the database. By default, all of them are.
+	FilterStorage FilterStoragePolicy
+
+	// FilterCacheSize is the total size in bytes of the filters and filter
+	// headers kept in memory. If it's 0, DefaultFilterCacheSize is used.
+	FilterCacheSize uint64
+
+	// BlockCacheSize is the total size in bytes of the blocks fetched
+	// from the network that are kept in memory. If it's 0,
+	// DefaultBlockCacheSize is used.
+	BlockCacheSize uint64
+
+	// PersistMatchedBlocks makes the chain service store the blocks that
+	// matched the filters of a rescan or GetUtxo on disk, so they don't
+	// have to be fetched from the network again after a restart. The
+	// stored blocks are never pruned.
+	PersistMatchedBlocks bool
 }
 
 // NewChainService returns a new chain service configured to connect to the
@@ -780,19 +864,91 @@ func NewChainService(cfg Config) (*ChainService, error) {
 		userAgentName:     UserAgentName,
 		userAgentVersion:  UserAgentVersion,
 		blockSubscribers:  make(map[blockSubscription]struct{}),
+		filterCheckpoints: make(map[chainhash.Hash]FilterHeaderCheckpoint),
+		cfilterFetches:    make(map[cfilterKey]*cfilterFetch),
+	}
+
+	// Merge the user-supplied checkpoints into the ones in the chain
+	// parameters, which the header sync uses.
+	checkpoints, err := mergeCheckpoints(cfg.ChainParams.Checkpoints,
+		cfg.Checkpoints, cfg.FilterHeaderCheckpoints)
+	if err != nil {
+		return nil, err
+	}
+	s.chainParams.Checkpoints = checkpoints
+	for _, cp := range cfg.FilterHeaderCheckpoints {
+		s.filterCheckpoints[cp.Hash] = cp
+	}
+
+	s.filterStorage = cfg.FilterStorage
+	filterCacheSize := cfg.FilterCacheSize
+	if filterCacheSize == 0 {
+		filterCacheSize = DefaultFilterCacheSize
+	}
+	s.filterCache = newLRUCache(filterCacheSize)
+	blockCacheSize := cfg.BlockCacheSize
+	if blockCacheSize == 0 {
+		blockCacheSize = DefaultBlockCacheSize
+	}
+	s.blockCache = newLRUCache(blockCacheSize)
+	s.syncedFilterTypes = filterTypes
+	if cfg.BasicFilterOnly {
+		s.syncedFilterTypes = []*FilterType{BasicFilter}
+	}
+
+	err = s.createSPVNS()
+	if err != nil {
+		return nil, err
 	}
 
-	err := s.createSPVNS()
+	s.headers, err = newFlatHeaderStore(
+		filepath.Join(cfg.DataDir, headerFileName), s.db,
+		&s.chainParams.GenesisBlock.Header)
 	if err != nil {
 		return nil, err
 	}
 
+	// If we fail from here on, the files we've opened are closed again,
+	// so that the caller can retry.
+	created := false
+	defer func() {
+		if created {
+			return
+		}
+		if s.blockStore != nil {
+			if err := s.blockStore.close(); err != nil {
+				log.Errorf("Unable to close block store: %s",
+					err)
+			}
+		}
+		if err := s.headers.close(); err != nil {
+			log.Errorf("Unable to close header store: %s", err)
+		}
+	}()
+
+	if cfg.PersistMatchedBlocks {
+		s.blockStore, err = newFlatBlockStore(
+			filepath.Join(cfg.DataDir, blockFileName), s.db)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	bm, err := newBlockManager(&s)
 	if err != nil {
 		return nil, err
 	}
 	s.blockManager = bm
 
+	// Bootstrap the header chain from a snapshot if we've been given one.
+	if cfg.HeaderSnapshot != "" {
+		err := s.importHeaderSnapshot(cfg.HeaderSnapshot,
+			cfg.HeaderSnapshotHeight, cfg.HeaderSnapshotHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Only setup a function to return new addresses to connect to when not
 	// running in connect-only mode.  The simulation network is always in
 	// connect-only mode since it is only intended to connect to specified
@@ -860,23 +1016,28 @@ func NewChainService(cfg Config) (*ChainService, error) {
 	}
 	s.connManager = cmgr
 
-	// Start up persistent peers.
+	// Start up persistent peers. Their addresses are all resolved first,
+	// so that we don't connect to any of them if we fail.
 	permanentPeers := cfg.ConnectPeers
 	if len(permanentPeers) == 0 {
 		permanentPeers = cfg.AddPeers
 	}
+	tcpAddrs := make([]net.Addr, 0, len(permanentPeers))
 	for _, addr := range permanentPeers {
 		tcpAddr, err := addrStringToNetAddr(addr)
 		if err != nil {
 			return nil, err
 		}
-
+		tcpAddrs = append(tcpAddrs, tcpAddr)
+	}
+	for _, tcpAddr := range tcpAddrs {
 		go s.connManager.Connect(&connmgr.ConnReq{
 			Addr:      tcpAddr,
 			Permanent: true,
 		})
 	}
 
+	created = true
 	return &s, nil
 }
 
@@ -1079,11 +1240,10 @@ func (s *ChainService) PublishTransaction(tx *wire.MsgTx) error {
 func newPeerConfig(sp *serverPeer) *peer.Config {
 	return &peer.Config{
 		Listeners: peer.MessageListeners{
-			OnVersion: sp.OnVersion,
-			//OnVerAck:    sp.OnVerAck, // Don't use sendheaders yet
+			OnVersion:   sp.OnVersion,
+			OnVerAck:    sp.OnVerAck,
 			OnInv:       sp.OnInv,
 			OnHeaders:   sp.OnHeaders,
-			OnCFHeaders: sp.OnCFHeaders,
 			OnGetData:   sp.OnGetData,
 			OnReject:    sp.OnReject,
 			OnFeeFilter: sp.OnFeeFilter,
@@ -1168,6 +1328,12 @@ func (s *ChainService) Start() {
 	// managers.
 	s.wg.Add(1)
 	go s.peerHandler()
+
+	// Prune the filters we don't keep in the background.
+	if s.filterStorage.Mode != KeepAllFilters {
+		s.wg.Add(1)
+		go s.filterPruner()
+	}
 }
 
 // Stop gracefully shuts down the server by stopping and disconnecting all
@@ -1181,7 +1347,12 @@ func (s *ChainService) Stop() error {
 	// Signal the remaining goroutines to quit.
 	close(s.quit)
 	s.wg.Wait()
-	return nil
+	if s.blockStore != nil {
+		if err := s.blockStore.close(); err != nil {
+			log.Errorf("Unable to close block store: %s", err)
+		}
+	}
+	return s.headers.close()
 }
 
 // IsCurrent lets the caller know whether the chain service's block manager
@@ -200,7 +200,14 @@ func (s *ChainService) AddedNodeInfo() []*serverPeer {
 func (s *ChainService) Peers() []*serverPeer {
 	replyChan := make(chan []*serverPeer)
 
-	s.query <- getPeersMsg{reply: replyChan}
+	// Don't get stuck if the peer handler has already quit, as the block
+	// manager's goroutines may still be asking for peers while we're
+	// shutting down.
+	select {
+	case s.query <- getPeersMsg{reply: replyChan}:
+	case <-s.quit:
+		return nil
+	}
 
 	return <-replyChan
 }
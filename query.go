@@ -15,6 +15,7 @@ import (
 	"github.com/btcsuite/btcutil"
 	"github.com/btcsuite/btcutil/gcs"
 	"github.com/btcsuite/btcutil/gcs/builder"
+	"github.com/btcsuite/btcwallet/walletdb"
 )
 
 var (
@@ -27,6 +28,10 @@ var (
 	// response. This allows to make up for missed messages in some
 	// instances.
 	QueryNumRetries = 2
+
+	// CFilterBatchSize is the maximum number of filters FetchCFilters asks
+	// our peers for at once.
+	CFilterBatchSize = 200
 )
 
 // queries are a set of options that can be modified per-query, unlike global
@@ -45,6 +50,9 @@ type queryOptions struct {
 	// doneChan lets the query signal the caller when it's done, in case
 	// it's run in a goroutine.
 	doneChan chan<- struct{}
+
+	// quit lets the caller end the query early by closing it.
+	quit <-chan struct{}
 }
 
 // QueryOption is a functional option argument to any of the network query
@@ -85,6 +93,14 @@ func DoneChan(doneChan chan<- struct{}) QueryOption {
 	}
 }
 
+// QueryQuit allows the caller to pass a channel that ends the query early
+// when it's closed, as if none of our peers had answered it.
+func QueryQuit(quit <-chan struct{}) QueryOption {
+	return func(qo *queryOptions) {
+		qo.quit = quit
+	}
+}
+
 type spMsg struct {
 	sp  *serverPeer
 	msg wire.Message
@@ -124,7 +140,7 @@ func (s *ChainService) queryPeers(
 	// held in a single thread. This is the only part of the query
 	// framework that requires access to peerState, so it's done once per
 	// query.
-	peers := s.Peers()
+	peers := s.queryablePeers()
 	syncPeer := s.blockManager.SyncPeer()
 
 	// This will be shared state between the per-peer goroutines. The
@@ -306,6 +322,16 @@ checkResponses:
 		case <-allQuit:
 			break checkResponses
 
+		// When the caller ends the query, we close the allQuit
+		// channel like when we time out.
+		case <-qo.quit:
+			select {
+			case <-allQuit:
+			default:
+				close(allQuit)
+			}
+			break checkResponses
+
 		// A message has arrived over the subscription channel, so we
 		// execute the checkResponses callback to see if this ends our
 		// query session.
@@ -318,31 +344,285 @@ checkResponses:
 	}
 }
 
-// GetCFilter gets a cfilter from the database. Failing that, it requests the
-// cfilter from the network and writes it to the database. If extended is true,
-// an extended filter will be queried for. Otherwise, we'll fetch the regular
-// filter.
-func (s *ChainService) GetCFilter(blockHash chainhash.Hash, extended bool,
-	options ...QueryOption) (*gcs.Filter, error) {
-	// Only get one CFilter at a time to avoid redundancy from mutliple
-	// rescans running at once.
-	s.mtxCFilter.Lock()
-	defer s.mtxCFilter.Unlock()
-
-	// Based on if extended is true or not, we'll set up our set of
-	// querying, and db-write functions.
-	getFilter := s.GetBasicFilter
-	getHeader := s.GetBasicHeader
-	putFilter := s.putBasicFilter
-	if extended {
-		getFilter = s.GetExtFilter
-		getHeader = s.GetExtHeader
-		putFilter = s.putExtFilter
+// queryAllPeers is a helper function that sends a query to all connected peers
+// at once, rather than one at a time like queryPeers, and waits for their
+// answers. The query is sent again to the peers that haven't answered after
+// each timeout, up to the number of retries in the query options.
+func (s *ChainService) queryAllPeers(
+	// queryMsg is the message to send to every peer.
+	queryMsg wire.Message,
+
+	// checkResponse is called for every message within the timeout
+	// period. The peerQuit channel lets the query know that it has the
+	// answer it needs from the peer that sent the message, and the quit
+	// channel that the whole query is done. Both are signaled by closing
+	// the channel.
+	checkResponse func(sp *serverPeer, resp wire.Message,
+		quit chan<- struct{}, peerQuit chan<- struct{}),
+
+	// options takes functional options for executing the query.
+	options ...QueryOption) {
+
+	s.queryPeerSet(s.queryablePeers(), queryMsg, checkResponse,
+		options...)
+}
+
+// queryPeerSet works like queryAllPeers, but sends the query to the passed
+// peers rather than to all of our peers.
+func (s *ChainService) queryPeerSet(peers []*serverPeer,
+	queryMsg wire.Message, checkResponse func(sp *serverPeer,
+		resp wire.Message, quit chan<- struct{},
+		peerQuit chan<- struct{}),
+	options ...QueryOption) {
+
+	qo := defaultQueryOptions()
+	for _, option := range options {
+		option(qo)
+	}
+	if qo.numRetries == 0 {
+		qo.numRetries = 1
+	}
+
+	quit := make(chan struct{})
+	allQuit := make(chan struct{})
+	var subwg sync.WaitGroup
+	msgChan := make(chan spMsg)
+	subscription := spMsgSubscription{
+		msgChan:  msgChan,
+		quitChan: allQuit,
+		wg:       &subwg,
+	}
+
+	// We keep track of the peers we're still waiting to hear from by
+	// their quit channels.
+	peerQuits := make(map[*serverPeer]chan struct{})
+	for _, sp := range peers {
+		if !sp.Connected() {
+			continue
+		}
+		peerQuits[sp] = make(chan struct{})
+		sp.subscribeRecvMsg(subscription)
+	}
+	defer func() {
+		for _, sp := range peers {
+			sp.unsubscribeRecvMsgs(subscription)
+		}
+		close(allQuit)
+		subwg.Wait()
+		if qo.doneChan != nil {
+			close(qo.doneChan)
+		}
+	}()
+
+	sendQuery := func() {
+		for sp := range peerQuits {
+			sp.QueueMessageWithEncoding(queryMsg, nil,
+				wire.WitnessEncoding)
+		}
+	}
+	sendQuery()
+	tries := uint8(1)
+	timeout := time.After(qo.timeout)
+
+	for len(peerQuits) > 0 {
+		select {
+		case <-timeout:
+			if tries == qo.numRetries {
+				return
+			}
+			tries++
+			sendQuery()
+			timeout = time.After(qo.timeout)
+
+		case <-qo.quit:
+			return
+
+		case <-s.quit:
+			return
+
+		case sm := <-msgChan:
+			// Ignore peers we aren't waiting for anymore, so that
+			// checkResponse doesn't have to track them.
+			peerQuit, ok := peerQuits[sm.sp]
+			if !ok {
+				continue
+			}
+			checkResponse(sm.sp, sm.msg, quit, peerQuit)
+
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			select {
+			case <-peerQuit:
+				delete(peerQuits, sm.sp)
+			default:
+			}
+		}
+	}
+}
+
+// queryBatch is a helper function that sends a batch of queries to our
+// connected peers, spread out among them, and waits for the answers. Whenever
+// no query has been answered for the timeout in the query options, the
+// unanswered ones are sent again, each to the next peer, up to the number of
+// retries in the query options.
+func (s *ChainService) queryBatch(
+	// queryMsgs are the messages to send.
+	queryMsgs []wire.Message,
+
+	// checkResponse is called for every message from the peers we're
+	// querying. It returns the index of the query that the message
+	// answers and true if it's a valid answer, and false otherwise.
+	checkResponse func(sp *serverPeer, resp wire.Message) (int, bool),
+
+	// quit lets the caller end the query early by closing it.
+	quit <-chan struct{},
+
+	// options takes functional options for executing the query.
+	options ...QueryOption) {
+
+	qo := defaultQueryOptions()
+	for _, option := range options {
+		option(qo)
+	}
+	if qo.numRetries == 0 {
+		qo.numRetries = 1
+	}
+
+	peers := s.queryablePeers()
+
+	allQuit := make(chan struct{})
+	var subwg sync.WaitGroup
+	msgChan := make(chan spMsg)
+	subscription := spMsgSubscription{
+		msgChan:  msgChan,
+		quitChan: allQuit,
+		wg:       &subwg,
+	}
+	for _, sp := range peers {
+		sp.subscribeRecvMsg(subscription)
+	}
+	defer func() {
+		for _, sp := range peers {
+			sp.unsubscribeRecvMsgs(subscription)
+		}
+		close(allQuit)
+		subwg.Wait()
+		if qo.doneChan != nil {
+			close(qo.doneChan)
+		}
+	}()
+
+	if len(peers) == 0 {
+		return
+	}
+
+	answered := make([]bool, len(queryMsgs))
+	numAnswered := 0
+
+	// Each round, every unanswered query goes to the peer after the one
+	// it went to the round before.
+	sendQueries := func(round int) {
+		for i, queryMsg := range queryMsgs {
+			if answered[i] {
+				continue
+			}
+			sp := peers[(i+round)%len(peers)]
+			sp.QueueMessageWithEncoding(queryMsg, nil,
+				wire.WitnessEncoding)
+		}
+	}
+	round := 0
+	sendQueries(round)
+	timeout := time.After(qo.timeout)
+
+	for numAnswered < len(queryMsgs) {
+		select {
+		case <-timeout:
+			round++
+			if round == int(qo.numRetries) {
+				return
+			}
+			sendQueries(round)
+			timeout = time.After(qo.timeout)
+
+		case <-quit:
+			return
+
+		case <-qo.quit:
+			return
+
+		case <-s.quit:
+			return
+
+		case sm := <-msgChan:
+			i, ok := checkResponse(sm.sp, sm.msg)
+			if !ok || answered[i] {
+				continue
+			}
+			answered[i] = true
+			numAnswered++
+
+			// As long as answers keep coming in, the peers are
+			// working through the batch, so we give them more
+			// time.
+			timeout = time.After(qo.timeout)
+		}
+	}
+}
+
+// GetCFilter gets a cfilter of the passed type from the database. Failing
+// that, it requests the cfilter from the network and writes it to the
+// database.
+func (s *ChainService) GetCFilter(blockHash chainhash.Hash,
+	filterType *FilterType, options ...QueryOption) (*gcs.Filter, error) {
+
+	// We can't verify filters of a type whose filter headers we don't
+	// sync.
+	if !s.syncsFilterType(filterType) {
+		return nil, fmt.Errorf("%s filters aren't synced", filterType)
 	}
 
 	// First check the database to see if we already have this filter. If
 	// so, then we can return it an exit early.
-	filter, err := getFilter(blockHash)
+	filter, err := s.GetFilter(blockHash, filterType)
+	if err == nil && filter != nil {
+		return filter, nil
+	}
+
+	// If someone else is already fetching this filter, we wait for their
+	// result rather than asking the network again. Fetches of other
+	// filters go ahead in parallel.
+	key := cfilterKey{blockHash: blockHash, filterType: filterType}
+	for {
+		fetch, started := s.startCFilterFetch(key)
+		if started {
+			filter, err = s.fetchCFilter(blockHash, filterType,
+				options...)
+			s.finishCFilterFetch(key, fetch, filter, err)
+			return filter, err
+		}
+		<-fetch.done
+
+		// A fetch can fail to get a filter that asking for it again
+		// would still get, for instance because a batch ran out of
+		// time, so rather than pass its error on, we try again.
+		if fetch.err == nil {
+			return fetch.filter, nil
+		}
+	}
+}
+
+// fetchCFilter requests a cfilter of the passed type from the network for
+// GetCFilter and writes it to the database.
+func (s *ChainService) fetchCFilter(blockHash chainhash.Hash,
+	filterType *FilterType, options ...QueryOption) (*gcs.Filter, error) {
+
+	// The filter may have been written to the database since GetCFilter
+	// checked, by a fetch that has finished in the meantime.
+	filter, err := s.GetFilter(blockHash, filterType)
 	if err == nil && filter != nil {
 		return filter, nil
 	}
@@ -354,7 +634,7 @@ func (s *ChainService) GetCFilter(blockHash chainhash.Hash, extended bool,
 	// In order to verify the authenticity of the filter, we'll fetch the
 	// target block header so we can retrieve the hash of the prior block,
 	// which is required to fetch the filter header for that block.
-	block, _, err := s.GetBlockByHash(blockHash)
+	block, height, err := s.GetBlockByHash(blockHash)
 	if err != nil {
 		return nil, err
 	}
@@ -366,12 +646,12 @@ func (s *ChainService) GetCFilter(blockHash chainhash.Hash, extended bool,
 	// In addition to fetching the block header, we'll fetch the filter
 	// headers (for this particular filter type) from the database. These
 	// are required in order to verify the authenticity of the filter.
-	curHeader, err := getHeader(blockHash)
+	curHeader, err := s.GetFilterHeader(blockHash, filterType)
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't get cfheader for block %s "+
 			"from database", blockHash)
 	}
-	prevHeader, err := getHeader(block.PrevBlock)
+	prevHeader, err := s.GetFilterHeader(block.PrevBlock, filterType)
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't get cfheader for block %s "+
 			"from database", blockHash)
@@ -388,7 +668,7 @@ func (s *ChainService) GetCFilter(blockHash chainhash.Hash, extended bool,
 	// query to the set of connected peers.
 	s.queryPeers(
 		// Send a wire.GetCFilterMsg
-		wire.NewMsgGetCFilter(&blockHash, extended),
+		wire.NewMsgGetCFilter(&blockHash, filterType.extended),
 
 		// Check responses and if we get one that matches, end the
 		// query early.
@@ -403,15 +683,19 @@ func (s *ChainService) GetCFilter(blockHash chainhash.Hash, extended bool,
 					return
 				}
 
-				// If the filter data is too short.  Ignore
-				// this message.
-				if len(response.Data) < 4 {
+				// If the response doesn't match our request.
+				// Ignore this message. It may be the answer
+				// to someone else's query, so it isn't held
+				// against the peer.
+				if blockHash != response.BlockHash ||
+					filterType.extended != response.Extended {
 					return
 				}
 
-				// If the response doesn't match our request.
-				// Ignore this message.
-				if blockHash != response.BlockHash {
+				// If the filter data is too short, the peer
+				// is misbehaving. Ignore this message.
+				if len(response.Data) < 4 {
+					sp.misbehaved(ShortFilter)
 					return
 				}
 
@@ -420,16 +704,22 @@ func (s *ChainService) GetCFilter(blockHash chainhash.Hash, extended bool,
 				if err != nil {
 					// Malformed filter data. We can ignore
 					// this message.
+					sp.misbehaved(MalformedFilter)
 					return
 				}
 
 				// Now that we have a proper filter, ensure
 				// that re-calculating the filter header hash
 				// for the header _after_ the filter in the
-				// chain checks out. If not, we can ignore this
-				// response.
+				// chain checks out. If not, either the peer
+				// lied to us or our filter header is wrong,
+				// so we ignore this response and have the
+				// filter header checked again.
 				if builder.MakeHeaderForFilter(gotFilter,
 					*prevHeader) != *curHeader {
+					s.blockManager.reportCFilterMismatch(
+						sp, filterType, blockHash,
+						int32(height), *curHeader)
 					return
 				}
 
@@ -447,19 +737,224 @@ func (s *ChainService) GetCFilter(blockHash chainhash.Hash, extended bool,
 
 	// If we've found a filter, write it to the database for next time.
 	if filter != nil {
-		if putFilter(blockHash, filter); err != nil {
+		err := s.putFilter(blockHash, filterType, filter)
+		if err != nil {
 			return nil, err
 		}
 
-		log.Tracef("Wrote filter for block %s, extended: %t",
-			blockHash, extended)
+		log.Tracef("Wrote %s filter for block %s", filterType,
+			blockHash)
 	}
 
 	return filter, nil
 }
 
+// FetchCFilters fetches the filters of the passed type for the blocks from
+// startHeight to endHeight, inclusive, that aren't in the database yet, and
+// stores them so that GetCFilter can serve them from the database. The
+// filters are requested from our peers in batches of at most
+// CFilterBatchSize, and each one is checked against the filter header chain
+// before it's stored. Filters are only fetched up to the last block we have
+// filter headers for. An error is returned if some of the filters couldn't be
+// fetched.
+func (s *ChainService) FetchCFilters(startHeight, endHeight uint32,
+	filterType *FilterType, options ...QueryOption) error {
+
+	if !s.syncsFilterType(filterType) {
+		return fmt.Errorf("%s filters aren't synced", filterType)
+	}
+
+	for batchStart := startHeight; batchStart <= endHeight; {
+		batchEnd := batchStart + uint32(CFilterBatchSize) - 1
+		if batchEnd > endHeight || batchEnd < batchStart {
+			batchEnd = endHeight
+		}
+		done, err := s.fetchCFilterBatch(batchStart, batchEnd,
+			filterType, options...)
+		if err != nil || done {
+			return err
+		}
+		if batchEnd == endHeight {
+			break
+		}
+		batchStart = batchEnd + 1
+	}
+	return nil
+}
+
+// cfilterRequest is a filter that FetchCFilters asks our peers for, along with
+// the filter headers it's checked against.
+type cfilterRequest struct {
+	blockHash  chainhash.Hash
+	height     uint32
+	prevHeader chainhash.Hash
+	curHeader  chainhash.Hash
+	filter     *gcs.Filter
+
+	// fetch lets concurrent GetCFilter calls for the filter wait for the
+	// batch, and fetch the filter themselves if the batch doesn't get
+	// it.
+	fetch *cfilterFetch
+}
+
+// fetchCFilterBatch fetches a single batch of filters for FetchCFilters and
+// stores them in one database transaction. It returns true if it ran out of
+// filter headers before endHeight.
+func (s *ChainService) fetchCFilterBatch(startHeight, endHeight uint32,
+	filterType *FilterType, options ...QueryOption) (bool, error) {
+
+	var (
+		requests   []*cfilterRequest
+		queryMsgs  []wire.Message
+		byHash     = make(map[chainhash.Hash]int)
+		prevHeader *chainhash.Hash
+		outOfRange bool
+	)
+	for height := startHeight; height <= endHeight; height++ {
+		header, err := s.GetBlockByHeight(height)
+		if err != nil {
+			outOfRange = true
+			break
+		}
+		blockHash := header.BlockHash()
+		curHeader, err := s.GetFilterHeader(blockHash, filterType)
+		if err != nil {
+			outOfRange = true
+			break
+		}
+		if prevHeader == nil {
+			prevHeader, err = s.GetFilterHeader(header.PrevBlock,
+				filterType)
+			if err != nil && height > 0 {
+				return false, fmt.Errorf("Couldn't get "+
+					"cfheader for block %s from database",
+					header.PrevBlock)
+			}
+		}
+		prev := *prevHeader
+		prevHeader = curHeader
+
+		// We don't need to fetch filters we already have, or empty
+		// filters, which GetCFilter returns as nil without asking
+		// the network.
+		if _, err := s.GetFilter(blockHash, filterType); err == nil {
+			continue
+		}
+		if builder.MakeHeaderForFilter(nil, prev) == *curHeader {
+			continue
+		}
+
+		// Filters someone else is fetching already are left to them.
+		key := cfilterKey{blockHash: blockHash, filterType: filterType}
+		fetch, started := s.startCFilterFetch(key)
+		if !started {
+			continue
+		}
+
+		byHash[blockHash] = len(requests)
+		requests = append(requests, &cfilterRequest{
+			blockHash:  blockHash,
+			height:     height,
+			prevHeader: prev,
+			curHeader:  *curHeader,
+			fetch:      fetch,
+		})
+		queryMsgs = append(queryMsgs, wire.NewMsgGetCFilter(
+			&blockHash, filterType.extended))
+	}
+	if len(requests) == 0 {
+		return outOfRange, nil
+	}
+
+	s.queryBatch(
+		queryMsgs,
+		func(sp *serverPeer, resp wire.Message) (int, bool) {
+			// Filters we didn't ask for may be the answers to
+			// someone else's queries, so they're ignored without
+			// holding them against the peer.
+			response, ok := resp.(*wire.MsgCFilter)
+			if !ok || response.Extended != filterType.extended {
+				return 0, false
+			}
+			i, ok := byHash[response.BlockHash]
+			if !ok || requests[i].filter != nil {
+				return 0, false
+			}
+			req := requests[i]
+
+			if len(response.Data) < 4 {
+				sp.misbehaved(ShortFilter)
+				return 0, false
+			}
+			gotFilter, err := gcs.FromNBytes(builder.DefaultP,
+				response.Data)
+			if err != nil {
+				sp.misbehaved(MalformedFilter)
+				return 0, false
+			}
+			if builder.MakeHeaderForFilter(gotFilter,
+				req.prevHeader) != req.curHeader {
+				s.blockManager.reportCFilterMismatch(sp,
+					filterType, req.blockHash,
+					int32(req.height), req.curHeader)
+				return 0, false
+			}
+			req.filter = gotFilter
+			return i, true
+		},
+		nil,
+		options...,
+	)
+
+	missing := 0
+	err := s.dbUpdate(func(bucket walletdb.ReadWriteBucket) error {
+		for _, req := range requests {
+			if req.filter == nil {
+				missing++
+				continue
+			}
+			err := putFilter(req.blockHash, filterType,
+				req.filter)(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	// Now that the filters are in the database, anyone waiting for them
+	// can have them.
+	for _, req := range requests {
+		key := cfilterKey{
+			blockHash:  req.blockHash,
+			filterType: filterType,
+		}
+		fetchErr := err
+		if fetchErr == nil && req.filter == nil {
+			fetchErr = fmt.Errorf("couldn't get %s filter for "+
+				"block %s", filterType, req.blockHash)
+		}
+		s.finishCFilterFetch(key, req.fetch, req.filter, fetchErr)
+	}
+
+	if err != nil {
+		return false, err
+	}
+	log.Tracef("Wrote %d %s filters for blocks %d to %d",
+		len(requests)-missing, filterType, startHeight, endHeight)
+
+	if missing > 0 {
+		return false, fmt.Errorf("couldn't get %d of %d %s filters "+
+			"for blocks %d to %d", missing, len(requests),
+			filterType, startHeight, endHeight)
+	}
+	return outOfRange, nil
+}
+
 // GetBlockFromNetwork gets a block by requesting it from the network, one peer
-// at a time, until one answers.
+// at a time, until one answers. Recently fetched blocks are served from the
+// block cache instead, and blocks stored with Config.PersistMatchedBlocks from
+// disk.
 //
 // TODO(roasbeef): add query option to indicate if the caller wants witness
 // data or not.
@@ -475,6 +970,21 @@ func (s *ChainService) GetBlockFromNetwork(blockHash chainhash.Hash,
 			"from database", blockHash)
 	}
 
+	// If someone has fetched this block recently, we don't need to
+	// download it again.
+	if block := s.getCachedBlock(blockHash); block != nil {
+		return block, nil
+	}
+	epoch := s.blockCache.currentEpoch()
+
+	// Blocks that matched a rescan before may be stored on disk.
+	if block := s.getStoredBlock(blockHash, height); block != nil {
+		s.cacheBlock(block, epoch)
+		return block, nil
+	}
+
+	atomic.AddUint64(&s.blockMisses, 1)
+
 	// Construct the appropriate getdata message to fetch the target block.
 	getData := wire.NewMsgGetData()
 	getData.AddInvVect(wire.NewInvVect(wire.InvTypeWitnessBlock,
@@ -517,7 +1027,7 @@ func (s *ChainService) GetBlockFromNetwork(blockHash chainhash.Hash,
 
 				// If this claims our block but doesn't pass
 				// the sanity check, the peer is trying to
-				// bamboozle us. Disconnect it.
+				// bamboozle us. Penalize and disconnect it.
 				if err := blockchain.CheckBlockSanity(
 					block,
 					// We don't need to check PoW because
@@ -531,12 +1041,48 @@ func (s *ChainService) GetBlockFromNetwork(blockHash chainhash.Hash,
 						"received from %s -- "+
 						"disconnecting peer", blockHash,
 						sp.Addr())
+					sp.misbehaved(InvalidBlock)
 					sp.Disconnect()
 					return
 				}
 
-				// TODO(roasbeef): modify CheckBlockSanity to
-				// also check witness commitment
+				// The block must also commit to its witness
+				// data, or the peer may have stripped or
+				// mangled the witnesses we use to watch for
+				// spends. Ban it if it doesn't.
+				err := blockchain.ValidateWitnessCommitment(
+					block)
+				if err != nil {
+					log.Warnf("Invalid witness commitment "+
+						"for %s received from %s: %s",
+						blockHash, sp.Addr(), err)
+					sp.misbehaved(InvalidWitnessCommitment)
+					return
+				}
+
+				// Finally, the filters built from the block
+				// should match the filter headers we have for
+				// it. The block has been checked against its
+				// hash and witness commitment by now, so if
+				// they don't, it's our filter headers that are
+				// wrong, and we have them checked again rather
+				// than holding it against the peer.
+				mismatched, err := s.mismatchedFilterTypes(
+					block)
+				if err != nil {
+					log.Warnf("Unable to check filters of "+
+						"block %s received from %s: %s",
+						blockHash, sp.Addr(), err)
+					return
+				}
+				for _, filterType := range mismatched {
+					log.Warnf("Block %s doesn't match our "+
+						"%s filter headers -- checking "+
+						"them again", blockHash,
+						filterType)
+					s.blockManager.markCFHeadersSuspect(
+						filterType, int32(height))
+				}
 
 				// At this point, the block matches what we
 				// know about it and we declare it sane. We can
@@ -553,10 +1099,44 @@ func (s *ChainService) GetBlockFromNetwork(blockHash chainhash.Hash,
 		return nil, fmt.Errorf("Couldn't retrieve block %s from "+
 			"network", blockHash)
 	}
+	s.cacheBlock(foundBlock, epoch)
 
 	return foundBlock, nil
 }
 
+// mismatchedFilterTypes returns the filter types we sync whose filters, built
+// from the passed block, don't match the filter headers we have for it.
+// Filter types whose filter headers we haven't synced up to the block yet are
+// skipped.
+func (s *ChainService) mismatchedFilterTypes(block *btcutil.Block) (
+	[]*FilterType, error) {
+
+	var mismatched []*FilterType
+	msgBlock := block.MsgBlock()
+	for _, filterType := range s.syncedFilterTypes {
+		curHeader, err := s.GetFilterHeader(*block.Hash(), filterType)
+		if err != nil {
+			continue
+		}
+		prevHeader, err := s.GetFilterHeader(
+			msgBlock.Header.PrevBlock, filterType)
+		if err != nil {
+			continue
+		}
+
+		filter, err := filterType.build(msgBlock)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't build %s filter: %s",
+				filterType, err)
+		}
+		if builder.MakeHeaderForFilter(filter, *prevHeader) !=
+			*curHeader {
+			mismatched = append(mismatched, filterType)
+		}
+	}
+	return mismatched, nil
+}
+
 // SendTransaction sends a transaction to each peer. It returns an error if any
 // peer rejects the transaction for any reason than that it's already known.
 //
@@ -0,0 +1,323 @@
+package neutrino
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil/gcs"
+	"github.com/btcsuite/btcutil/gcs/builder"
+)
+
+// TestFetchCFilters checks that FetchCFilters stores the filters our peers
+// send in answer to its batches, whatever order they come in, up to the last
+// block we have filter headers for, and that it fails without fetching any
+// more batches once a filter of a batch doesn't arrive.
+func TestFetchCFilters(t *testing.T) {
+	defer func(batchSize int) {
+		CFilterBatchSize = batchSize
+	}(CFilterBatchSize)
+
+	const numHeaders = 6
+
+	tests := []struct {
+		name      string
+		batchSize int
+
+		// filterHeaders is the number of blocks we have filter headers
+		// for.
+		filterHeaders int
+
+		// responses is the heights of the blocks whose filters the
+		// peer sends, in order.
+		responses []int32
+
+		// stored is the heights of the blocks whose filters should be
+		// stored.
+		stored []int32
+
+		err bool
+	}{
+		{
+			name:          "one batch",
+			batchSize:     200,
+			filterHeaders: 6,
+			responses:     []int32{1, 2, 3, 4, 5, 6},
+			stored:        []int32{1, 2, 3, 4, 5, 6},
+		},
+		{
+			name:          "out of order",
+			batchSize:     200,
+			filterHeaders: 6,
+			responses:     []int32{6, 5, 4, 3, 2, 1},
+			stored:        []int32{1, 2, 3, 4, 5, 6},
+		},
+		{
+			name:          "short last batch",
+			batchSize:     4,
+			filterHeaders: 6,
+			responses:     []int32{1, 2, 3, 4, 5, 6},
+			stored:        []int32{1, 2, 3, 4, 5, 6},
+		},
+		{
+			name:          "filter headers end early",
+			batchSize:     200,
+			filterHeaders: 4,
+			responses:     []int32{1, 2, 3, 4, 5, 6},
+			stored:        []int32{1, 2, 3, 4},
+		},
+		{
+			name:          "missing filter",
+			batchSize:     200,
+			filterHeaders: 6,
+			responses:     []int32{1, 2, 4, 5, 6},
+			stored:        []int32{1, 2, 4, 5, 6},
+			err:           true,
+		},
+		{
+			name:          "missing filter in an earlier batch",
+			batchSize:     2,
+			filterHeaders: 6,
+			responses:     []int32{1, 3, 4, 5, 6},
+			stored:        []int32{1},
+			err:           true,
+		},
+	}
+
+	for _, test := range tests {
+		CFilterBatchSize = test.batchSize
+		s, cleanup := newTestChainService(t)
+		nodes, filters := writeTestFilterChain(t, s, numHeaders,
+			test.filterHeaders)
+
+		var responses []wire.Message
+		for _, height := range test.responses {
+			responses = append(responses, testCFilterMsg(
+				nodes[height-1], filters[height-1]))
+		}
+		done := make(chan struct{})
+		sp := newTestFetchPeer(t, s, 0, numHeaders)
+		serveTestPeers(s, []*serverPeer{sp}, done)
+		go respondToQueries(sp, responses, done)
+
+		err := s.FetchCFilters(1, numHeaders, BasicFilter,
+			Timeout(100*time.Millisecond))
+		close(done)
+		sp.Disconnect()
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v, want error %v", test.name,
+				err, test.err)
+		}
+
+		stored := make(map[int32]bool)
+		for _, height := range test.stored {
+			stored[height] = true
+		}
+		for i, node := range nodes {
+			filter, err := s.GetFilter(node.header.BlockHash(),
+				BasicFilter)
+			if err != nil {
+				if stored[node.height] {
+					t.Errorf("%s: filter of block %d not "+
+						"stored", test.name,
+						node.height)
+				}
+				continue
+			}
+			if !stored[node.height] {
+				t.Errorf("%s: filter of block %d stored",
+					test.name, node.height)
+			}
+			want := filters[i].NBytes()
+			if !bytes.Equal(filter.NBytes(), want) {
+				t.Errorf("%s: wrong filter stored for block %d",
+					test.name, node.height)
+			}
+		}
+		cleanup()
+	}
+}
+
+// TestGetCFilterAfterFailedBatch checks that a GetCFilter call waiting for a
+// filter that a batch of FetchCFilters is fetching fetches the filter on its
+// own once the batch fails to get it.
+func TestGetCFilterAfterFailedBatch(t *testing.T) {
+	const numHeaders = 4
+
+	s, cleanup := newTestChainService(t)
+	defer cleanup()
+	nodes, filters := writeTestFilterChain(t, s, numHeaders, numHeaders)
+
+	// The peer doesn't send the filter of block 3 until the batch has
+	// given up on it.
+	const missing = 2
+	var batchResponses []wire.Message
+	for i, node := range nodes {
+		if i != missing {
+			batchResponses = append(batchResponses,
+				testCFilterMsg(node, filters[i]))
+		}
+	}
+	done := make(chan struct{})
+	defer close(done)
+	sp := newTestFetchPeer(t, s, 0, numHeaders)
+	defer sp.Disconnect()
+	serveTestPeers(s, []*serverPeer{sp}, done)
+	batchDone := make(chan struct{})
+	go respondToQueries(sp, batchResponses, batchDone)
+
+	batchErr := make(chan error, 1)
+	go func() {
+		batchErr <- s.FetchCFilters(1, numHeaders, BasicFilter,
+			Timeout(200*time.Millisecond))
+	}()
+
+	// Once the batch is fetching the filter, we ask for it as well.
+	blockHash := nodes[missing].header.BlockHash()
+	waitForCFilterFetch(t, s, cfilterKey{
+		blockHash:  blockHash,
+		filterType: BasicFilter,
+	})
+	type result struct {
+		filter *gcs.Filter
+		err    error
+	}
+	results := make(chan result, 1)
+	go func() {
+		filter, err := s.GetCFilter(blockHash, BasicFilter,
+			Timeout(time.Second))
+		results <- result{filter, err}
+	}()
+
+	if err := <-batchErr; err == nil {
+		t.Fatalf("batch got a filter that wasn't sent")
+	}
+	close(batchDone)
+	go respondToQueries(sp, []wire.Message{
+		testCFilterMsg(nodes[missing], filters[missing]),
+	}, done)
+
+	select {
+	case res := <-results:
+		if res.err != nil {
+			t.Fatalf("unable to get filter: %s", res.err)
+		}
+		if res.filter == nil || !bytes.Equal(res.filter.NBytes(),
+			filters[missing].NBytes()) {
+
+			t.Fatalf("got wrong filter")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("GetCFilter didn't return")
+	}
+}
+
+// writeTestFilterChain writes num headers on top of the genesis block along
+// with the basic filter headers of the first withHeaders of them, and returns
+// the headers and the basic filters that the filter headers commit to. The
+// filters themselves aren't stored.
+func writeTestFilterChain(t *testing.T, s *ChainService, num,
+	withHeaders int) ([]*headerNode, []*gcs.Filter) {
+
+	t.Helper()
+
+	prevHeader, err := s.GetFilterHeader(*s.chainParams.GenesisHash,
+		BasicFilter)
+	if err != nil {
+		t.Fatalf("unable to get genesis filter header: %s", err)
+	}
+
+	nodes := makeTestHeaders(testGenesis, 0, num, 0)
+	var filters []*gcs.Filter
+	var updates []dbUpdateOption
+	for i, node := range nodes {
+		filter, err := BasicFilter.build(testFilterBlock(node))
+		if err != nil {
+			t.Fatalf("unable to build filter: %s", err)
+		}
+		filters = append(filters, filter)
+		if i >= withHeaders {
+			continue
+		}
+
+		filterHeader := builder.MakeHeaderForFilter(filter, *prevHeader)
+		updates = append(updates, putFilterHeader(
+			node.header.BlockHash(), BasicFilter, filterHeader))
+		prevHeader = &filterHeader
+	}
+	if err := s.headers.writeHeaders(nodes, updates...); err != nil {
+		t.Fatalf("unable to write headers: %s", err)
+	}
+	return nodes, filters
+}
+
+// testFilterBlock returns a block with the passed header whose only
+// transaction pays to a script that pushes the block's height, so that each
+// block has a different filter.
+func testFilterBlock(node *headerNode) *wire.MsgBlock {
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+	})
+
+	// The script is OP_DATA_4 followed by the height.
+	pkScript := append([]byte{0x04}, uint32ToBytes(uint32(node.height))...)
+	coinbase.AddTxOut(wire.NewTxOut(50, pkScript))
+
+	return &wire.MsgBlock{
+		Header:       *node.header,
+		Transactions: []*wire.MsgTx{coinbase},
+	}
+}
+
+// testCFilterMsg returns the cfilter message a peer sends with the passed
+// basic filter of the passed block.
+func testCFilterMsg(node *headerNode, filter *gcs.Filter) *wire.MsgCFilter {
+	return &wire.MsgCFilter{
+		BlockHash: node.header.BlockHash(),
+		Data:      filter.NBytes(),
+	}
+}
+
+// serveTestPeers answers the chain service's requests for its peers with the
+// passed peers until done is closed, in place of the peer handler.
+func serveTestPeers(s *ChainService, peers []*serverPeer,
+	done <-chan struct{}) {
+
+	go func() {
+		for {
+			select {
+			case msg := <-s.query:
+				if msg, ok := msg.(getPeersMsg); ok {
+					msg.reply <- peers
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// waitForCFilterFetch waits until a fetch of the filter with the passed key
+// has started.
+func waitForCFilterFetch(t *testing.T, s *ChainService, key cfilterKey) {
+	t.Helper()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		s.mtxCFilterFetches.Lock()
+		_, ok := s.cfilterFetches[key]
+		s.mtxCFilterFetches.Unlock()
+		if ok {
+			return
+		}
+
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("fetch of %s filter for block %s didn't start",
+				key.filterType, key.blockHash)
+		}
+	}
+}
@@ -163,6 +163,10 @@ func (s *ChainService) Rescan(options ...RescanOption) error {
 	for _, txid := range ro.watchTxIDs {
 		ro.watchList = append(ro.watchList, txid[:])
 	}
+	if len(ro.watchTxIDs) > 0 && !s.syncsFilterType(ExtFilter) {
+		log.Warnf("Watched txids won't be matched as only the basic " +
+			"filter is synced")
+	}
 
 	// Check that we have either an end block or a quit channel.
 	if ro.endBlock != nil {
@@ -251,12 +255,30 @@ func (s *ChainService) Rescan(options ...RescanOption) error {
 	// Listen for notifications.
 	blockConnected := make(chan wire.BlockHeader)
 	blockDisconnected := make(chan wire.BlockHeader)
+	// We only go on to a new block once we have the filter headers for
+	// all of the filters we might check.
+	connectType := ExtFilter
+	if !s.syncsFilterType(ExtFilter) {
+		connectType = BasicFilter
+	}
 	subscription := blockSubscription{
-		onConnectExt: blockConnected,
+		filterType:   connectType,
+		onConnect:    blockConnected,
 		onDisconnect: blockDisconnected,
 		quit:         ro.quit,
 	}
 
+	// While we're catching up, the prefetcher fetches the filters and
+	// matching blocks ahead of us.
+	var prefetcher *rescanPrefetcher
+	stopPrefetcher := func() {
+		if prefetcher != nil {
+			prefetcher.stop()
+			prefetcher = nil
+		}
+	}
+	defer stopPrefetcher()
+
 	// Loop through blocks, one at a time. This relies on the underlying
 	// ChainService API to send blockConnected and blockDisconnected
 	// notifications in the correct order.
@@ -348,6 +370,7 @@ rescanLoop:
 					"subscribing to block notifications",
 					curStamp.Height, curStamp.Hash)
 				current = true
+				stopPrefetcher()
 				// Subscribe to block notifications.
 				s.subscribeBlockMsg(subscription)
 				continue rescanLoop
@@ -355,6 +378,12 @@ rescanLoop:
 			curHeader = header
 			curStamp.Height++
 			curStamp.Hash = header.BlockHash()
+
+			if prefetcher == nil {
+				prefetcher = newRescanPrefetcher(s, ro,
+					curStamp.Height)
+			}
+			prefetcher.advance(curStamp.Height)
 		}
 
 		// At this point, we've found the block header that's next in
@@ -375,7 +404,8 @@ rescanLoop:
 		)
 		key := builder.DeriveKey(&curStamp.Hash)
 		matched := false
-		bFilter, err = s.GetCFilter(curStamp.Hash, false)
+
+		bFilter, err = s.GetCFilter(curStamp.Hash, BasicFilter)
 		if err != nil {
 			return err
 		}
@@ -393,9 +423,10 @@ rescanLoop:
 		// If the regular filter didn't match, and a set of
 		// transactions is specified, then we'll also fetch the
 		// extended filter to see if anything actually matches for this
-		// block.
-		if !matched && len(ro.watchTxIDs) > 0 {
-			eFilter, err = s.GetCFilter(curStamp.Hash, true)
+		// block, unless we only sync the basic filter.
+		if !matched && len(ro.watchTxIDs) > 0 &&
+			s.syncsFilterType(ExtFilter) {
+			eFilter, err = s.GetCFilter(curStamp.Hash, ExtFilter)
 			if err != nil {
 				return err
 			}
@@ -410,13 +441,20 @@ rescanLoop:
 		}
 
 		if matched {
+			s.markFilterMatched(curStamp.Hash)
+
 			// We've matched. Now we actually get the block and
 			// cycle through the transactions to see which ones are
 			// relevant.
-			block, err = s.GetBlockFromNetwork(curStamp.Hash,
-				ro.queryOptions...)
-			if err != nil {
-				return err
+			if prefetcher != nil {
+				block = prefetcher.takeBlock(curStamp.Hash)
+			}
+			if block == nil {
+				block, err = s.getMatchedBlock(
+					curStamp.Hash, ro.queryOptions...)
+				if err != nil {
+					return err
+				}
 			}
 			if block == nil {
 				return fmt.Errorf("Couldn't get block %d "+
@@ -457,6 +495,10 @@ rescanLoop:
 			if rewound {
 				current = false
 			}
+
+			// The prefetcher matches against the old watch list,
+			// so we start a new one.
+			stopPrefetcher()
 		default:
 		}
 	}
@@ -776,7 +818,9 @@ type SpendReport struct {
 // WatchOutPoints (with a single outpoint) is required. StartBlock can be used
 // to give a hint about which block the transaction is in, and TxIdx can be
 // used to give a hint of which transaction in the block matches it (coinbase
-// is 0, first normal transaction is 1, etc.).
+// is 0, first normal transaction is 1, etc.). If only the basic filter is
+// synced, StartBlock must be the block the transaction is in, as we can't
+// find it with the basic filter.
 //
 // TODO(roasbeef): WTB utxo-commitments
 func (s *ChainService) GetUtxo(options ...RescanOption) (*SpendReport, error) {
@@ -844,7 +888,7 @@ func (s *ChainService) GetUtxo(options ...RescanOption) (*SpendReport, error) {
 	for {
 		// Check the basic filter for the spend and the extended filter
 		// for the transaction in which the outpoint is funded.
-		filter, err := s.GetCFilter(curStamp.Hash, false,
+		filter, err := s.GetCFilter(curStamp.Hash, BasicFilter,
 			ro.queryOptions...)
 		if err != nil {
 			return nil, fmt.Errorf("Couldn't get basic "+
@@ -863,8 +907,8 @@ func (s *ChainService) GetUtxo(options ...RescanOption) (*SpendReport, error) {
 		// If the regular filter didn't match, then we'll also fetch
 		// the extended filter to see if this is the block in which the
 		// outpoint was actually created.
-		if !matched {
-			filter, err = s.GetCFilter(curStamp.Hash, true,
+		if !matched && s.syncsFilterType(ExtFilter) {
+			filter, err = s.GetCFilter(curStamp.Hash, ExtFilter,
 				ro.queryOptions...)
 			if err != nil {
 				return nil, fmt.Errorf("Couldn't get "+
@@ -878,10 +922,19 @@ func (s *ChainService) GetUtxo(options ...RescanOption) (*SpendReport, error) {
 			}
 		}
 
+		// Without the extended filter, we can't tell which block the
+		// outpoint was created in, so we check the start block, which
+		// the caller should have set to that block.
+		if !matched && !s.syncsFilterType(ExtFilter) {
+			matched = curStamp.Height == ro.startBlock.Height
+		}
+
 		// If either is matched, download the block and check to see
 		// what we have.
 		if matched {
-			block, err := s.GetBlockFromNetwork(curStamp.Hash,
+			s.markFilterMatched(curStamp.Hash)
+
+			block, err := s.getMatchedBlock(curStamp.Hash,
 				ro.queryOptions...)
 			if err != nil {
 				return nil, err
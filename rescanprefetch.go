@@ -0,0 +1,248 @@
+// NOTE: THIS API IS UNSTABLE RIGHT NOW.
+
+package neutrino
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/gcs/builder"
+)
+
+var (
+	// RescanLookahead is how many blocks ahead of the block it's
+	// processing a rescan that's catching up fetches filters for.
+	RescanLookahead = 2000
+
+	// RescanPrefetchBlocks is the maximum number of matching blocks a
+	// rescan that's catching up fetches ahead of time and keeps in memory
+	// until it gets to them.
+	RescanPrefetchBlocks = 8
+)
+
+// prefetchedBlock is a block fetched ahead of time for a rescan.
+type prefetchedBlock struct {
+	height int32
+	block  *btcutil.Block
+}
+
+// rescanPrefetcher fetches the filters a rescan will need for the blocks
+// ahead of it, along with the blocks that match them, in the background, so
+// the rescan doesn't have to wait for the network one block at a time. The
+// filters go into the database and the blocks are kept until the rescan takes
+// them. The rescan still checks every block itself and sends its
+// notifications in order, so anything the prefetcher misses is simply fetched
+// by the rescan when it gets there.
+type rescanPrefetcher struct {
+	s            *ChainService
+	fetchTypes   []*FilterType
+	watchList    [][]byte
+	endHeight    int32
+	queryOptions []QueryOption
+
+	// height is the height of the block the rescan is processing. It
+	// must only be used atomically.
+	height   int32
+	advanced chan struct{}
+
+	// blockSlots limits the number of prefetched blocks in memory. A slot
+	// is taken before a block is fetched, and given back once the rescan
+	// has taken the block or gone past it.
+	blockSlots chan struct{}
+
+	mtx    sync.Mutex
+	blocks map[chainhash.Hash]*prefetchedBlock
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newRescanPrefetcher starts prefetching for the passed rescan, which is at
+// the block at the passed height. The prefetcher matches filters against the
+// rescan's watch list as it is now.
+func newRescanPrefetcher(s *ChainService, ro *rescanOptions,
+	height int32) *rescanPrefetcher {
+
+	p := &rescanPrefetcher{
+		s:          s,
+		fetchTypes: []*FilterType{BasicFilter},
+		watchList:  append([][]byte(nil), ro.watchList...),
+		endHeight:  ro.endBlock.Height,
+		height:     height,
+		advanced:   make(chan struct{}, 1),
+		blockSlots: make(chan struct{}, RescanPrefetchBlocks),
+		blocks:     make(map[chainhash.Hash]*prefetchedBlock),
+		quit:       make(chan struct{}),
+	}
+	if len(ro.watchTxIDs) > 0 && s.syncsFilterType(ExtFilter) {
+		p.fetchTypes = append(p.fetchTypes, ExtFilter)
+	}
+
+	// Our queries end when we're stopped, so that stopping doesn't wait
+	// for the filters and blocks we're fetching.
+	p.queryOptions = append(p.queryOptions, ro.queryOptions...)
+	p.queryOptions = append(p.queryOptions, QueryQuit(p.quit))
+
+	p.wg.Add(1)
+	go p.prefetch(height)
+	return p
+}
+
+// stop stops the prefetcher, ending the queries it's waiting for, and waits
+// for it to finish.
+func (p *rescanPrefetcher) stop() {
+	close(p.quit)
+	p.wg.Wait()
+}
+
+// advance tells the prefetcher that the rescan has moved on to the block at
+// the passed height, and drops the prefetched blocks it has gone past.
+func (p *rescanPrefetcher) advance(height int32) {
+	atomic.StoreInt32(&p.height, height)
+
+	p.mtx.Lock()
+	for blockHash, pb := range p.blocks {
+		if pb.height < height {
+			delete(p.blocks, blockHash)
+			<-p.blockSlots
+		}
+	}
+	p.mtx.Unlock()
+
+	select {
+	case p.advanced <- struct{}{}:
+	default:
+	}
+}
+
+// takeBlock returns the prefetched block with the passed hash, or nil if it
+// hasn't been prefetched.
+func (p *rescanPrefetcher) takeBlock(blockHash chainhash.Hash) *btcutil.Block {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	pb, ok := p.blocks[blockHash]
+	if !ok {
+		return nil
+	}
+	delete(p.blocks, blockHash)
+	<-p.blockSlots
+	return pb.block
+}
+
+// prefetch fetches filters in batches for the blocks from the passed height
+// up to RescanLookahead blocks ahead of the rescan, and fetches the blocks that
+// match them. It must be run as a goroutine.
+func (p *rescanPrefetcher) prefetch(next int32) {
+	defer p.wg.Done()
+
+	for {
+		limit := atomic.LoadInt32(&p.height) + int32(RescanLookahead)
+		if p.endHeight > 0 && limit > p.endHeight {
+			limit = p.endHeight
+		}
+
+		// We can only fetch the filters we have filter headers for.
+		for _, filterType := range p.fetchTypes {
+			synced := p.s.blockManager.lastCFHeaderHeight(filterType)
+			if limit > synced {
+				limit = synced
+			}
+		}
+
+		if next <= limit {
+			end := next + int32(CFilterBatchSize) - 1
+			if end > limit {
+				end = limit
+			}
+			if !p.fetchRange(next, end) {
+				return
+			}
+			next = end + 1
+			continue
+		}
+
+		select {
+		case <-p.advanced:
+		case <-p.quit:
+			return
+		case <-p.s.quit:
+			return
+		}
+	}
+}
+
+// fetchRange fetches the filters for the blocks from start to end, inclusive,
+// and starts fetching the blocks that match them. It returns false if the
+// prefetcher has been stopped.
+func (p *rescanPrefetcher) fetchRange(start, end int32) bool {
+	for _, filterType := range p.fetchTypes {
+		err := p.s.FetchCFilters(uint32(start), uint32(end),
+			filterType, p.queryOptions...)
+		if err != nil {
+			log.Debugf("Couldn't prefetch %s filters for blocks "+
+				"%d to %d: %s", filterType, start, end, err)
+		}
+	}
+
+	for height := start; height <= end; height++ {
+		blockHash, err := p.s.GetBlockHashByHeight(uint32(height))
+		if err != nil {
+			return true
+		}
+		if !p.matches(blockHash) {
+			continue
+		}
+
+		// Wait until we may keep another block in memory.
+		select {
+		case p.blockSlots <- struct{}{}:
+		case <-p.quit:
+			return false
+		case <-p.s.quit:
+			return false
+		}
+		p.wg.Add(1)
+		go p.fetchBlock(height, blockHash)
+	}
+	return true
+}
+
+// matches returns whether one of the filters we have for the block with the
+// passed hash matches the watch list.
+func (p *rescanPrefetcher) matches(blockHash chainhash.Hash) bool {
+	key := builder.DeriveKey(&blockHash)
+	for _, filterType := range p.fetchTypes {
+		filter, err := p.s.GetFilter(blockHash, filterType)
+		if err != nil || filter.N() == 0 {
+			continue
+		}
+		matched, err := filter.MatchAny(key, p.watchList)
+		if err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchBlock fetches the block with the passed hash and keeps it for the
+// rescan, unless the rescan has gone past it already. It must be run as a
+// goroutine, with a block slot taken.
+func (p *rescanPrefetcher) fetchBlock(height int32, blockHash chainhash.Hash) {
+	defer p.wg.Done()
+
+	block, err := p.s.getMatchedBlock(blockHash, p.queryOptions...)
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if err != nil || block == nil || height < atomic.LoadInt32(&p.height) {
+		<-p.blockSlots
+		return
+	}
+	p.blocks[blockHash] = &prefetchedBlock{
+		height: height,
+		block:  block,
+	}
+}
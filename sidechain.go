@@ -0,0 +1,606 @@
+// NOTE: THIS API IS UNSTABLE RIGHT NOW.
+
+package neutrino
+
+import (
+	"container/list"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+var (
+	// MaxSideChains is the maximum number of competing forks of the header
+	// chain that are known to connect to our chain tracked at once. When a
+	// new fork comes in past this limit, the one we've heard from least
+	// recently is dropped.
+	MaxSideChains = 8
+
+	// MaxOrphanChains is the maximum number of forks whose connection to
+	// our chain we're still looking for tracked at once, on top of
+	// MaxSideChains. Each peer has at most one of them. When a new one
+	// comes in past this limit, the one we've heard from least recently
+	// is dropped.
+	MaxOrphanChains = 4
+
+	// OrphanChainTimeout is how long we wait for the ancestors of orphan
+	// headers before we drop them.
+	OrphanChainTimeout = 2 * time.Minute
+
+	// MaxSideChainLength is the maximum number of headers kept for a
+	// single fork. Forks that branch off our chain further back than this
+	// below our tip are dropped.
+	MaxSideChainLength = 2016
+)
+
+// sideChain is a fork of the header chain that doesn't have more work than
+// our chain, at least not yet.
+type sideChain struct {
+	// headers holds the headers of a fork that's known to connect to our
+	// chain. The first entry is the header in our chain the fork builds
+	// on, so the fork's headers can be checked against it, and isn't
+	// part of the fork itself.
+	headers *list.List
+
+	// orphans holds the headers of a fork that we don't yet know how to
+	// connect to our chain, in order. We've asked the peer for their
+	// ancestors, and the headers are moved to a connected fork that
+	// reaches them once they arrive.
+	orphans []*wire.BlockHeader
+
+	// work is the total work of the headers in a connected fork.
+	work *big.Int
+
+	// peer is the peer that told us about the fork. It's nil for the
+	// fork we keep around after switching away from it.
+	peer       *serverPeer
+	lastUpdate time.Time
+}
+
+// connected returns whether the fork is known to connect to our chain.
+func (c *sideChain) connected() bool {
+	return c.headers != nil
+}
+
+// forkPoint returns the header in our chain that a connected fork builds on.
+func (c *sideChain) forkPoint() *headerNode {
+	return c.headers.Front().Value.(*headerNode)
+}
+
+// tipHash returns the hash of the last header in the fork.
+func (c *sideChain) tipHash() chainhash.Hash {
+	if !c.connected() {
+		return c.orphans[len(c.orphans)-1].BlockHash()
+	}
+	return c.headers.Back().Value.(*headerNode).header.BlockHash()
+}
+
+// length returns the number of headers in the fork.
+func (c *sideChain) length() int {
+	if !c.connected() {
+		return len(c.orphans)
+	}
+	return c.headers.Len() - 1
+}
+
+// contains returns whether the fork has a header with the passed hash.
+func (c *sideChain) contains(hash chainhash.Hash) bool {
+	if !c.connected() {
+		for _, header := range c.orphans {
+			if header.BlockHash() == hash {
+				return true
+			}
+		}
+		return false
+	}
+	for el := c.headers.Front().Next(); el != nil; el = el.Next() {
+		if el.Value.(*headerNode).header.BlockHash() == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// handleSideChainHeaders handles headers that don't extend our chain. They
+// either extend a fork we're already tracking, start a new fork from a header
+// in our chain, or are orphans whose ancestors we need to ask the peer for.
+// Once a fork has more work than our chain, we switch to it. It must be
+// called from the block handler goroutine.
+func (b *blockManager) handleSideChainHeaders(sp *serverPeer,
+	headers []*wire.BlockHeader, maxTimestamp time.Time) {
+
+	// Make sure the headers link up and each has valid proof of work for
+	// its own target before we keep any of them around.
+	powLimit := b.server.chainParams.PowLimit
+	for i, header := range headers {
+		if i > 0 && header.PrevBlock != headers[i-1].BlockHash() {
+			log.Warnf("Side chain headers from peer %s don't "+
+				"connect -- disconnecting", sp.Addr())
+			sp.Disconnect()
+			return
+		}
+		stubBlock := btcutil.NewBlock(&wire.MsgBlock{
+			Header: *header,
+		})
+		err := blockchain.CheckProofOfWork(stubBlock, powLimit)
+		if err != nil {
+			log.Warnf("Side chain header from peer %s doesn't "+
+				"pass sanity check: %s -- disconnecting",
+				sp.Addr(), err)
+			sp.Disconnect()
+			return
+		}
+	}
+
+	b.pruneSideChains()
+
+	// Skip any headers we already have in a fork.
+	for len(headers) > 0 && b.sideChainWith(headers[0].BlockHash()) != nil {
+		headers = headers[1:]
+	}
+	if len(headers) == 0 {
+		return
+	}
+
+	fork, err := b.sideChainFor(sp, headers[0].PrevBlock)
+	if err != nil {
+		log.Warnf("Unable to track side chain from peer %s: %s -- "+
+			"disconnecting", sp.Addr(), err)
+		sp.Disconnect()
+		return
+	}
+	if fork == nil {
+		b.addOrphanHeaders(sp, headers)
+		return
+	}
+
+	fork.peer = sp
+	if err := b.extendSideChain(fork, headers, maxTimestamp); err != nil {
+		log.Warnf("Side chain header from peer %s doesn't pass "+
+			"sanity check: %s -- disconnecting", sp.Addr(), err)
+		b.removeSideChain(fork)
+		sp.Disconnect()
+		return
+	}
+	if err := b.connectOrphans(fork, maxTimestamp); err != nil {
+		log.Warnf("Side chain header from peer %s doesn't pass "+
+			"sanity check: %s -- disconnecting", sp.Addr(), err)
+		b.removeSideChain(fork)
+		sp.Disconnect()
+		return
+	}
+	if fork.length() > MaxSideChainLength {
+		log.Infof("Dropping side chain from peer %s with more than "+
+			"%d headers", sp.Addr(), MaxSideChainLength)
+		b.removeSideChain(fork)
+		return
+	}
+
+	b.evaluateSideChain(fork)
+}
+
+// sideChainWith returns the fork that has a header with the passed hash, if
+// any.
+func (b *blockManager) sideChainWith(hash chainhash.Hash) *sideChain {
+	for _, fork := range b.sideChains {
+		if fork.contains(hash) {
+			return fork
+		}
+	}
+	return nil
+}
+
+// sideChainFor returns the connected fork that a header with the passed
+// parent would extend. If the parent is the tip of a fork, that fork is
+// returned. If it's in the middle of a fork or in our own chain, a new fork
+// starting there is returned. If we don't know the parent, nil is returned.
+func (b *blockManager) sideChainFor(sp *serverPeer,
+	prevHash chainhash.Hash) (*sideChain, error) {
+
+	for _, fork := range b.sideChains {
+		if !fork.connected() {
+			continue
+		}
+		if fork.tipHash() == prevHash {
+			return fork, nil
+		}
+
+		// If the parent is in the middle of this fork, the new fork
+		// shares its headers up to there.
+		for el := fork.headers.Front().Next(); el != nil; el = el.Next() {
+			node := el.Value.(*headerNode)
+			if node.header.BlockHash() != prevHash {
+				continue
+			}
+			newFork := &sideChain{
+				headers: list.New(),
+				work:    big.NewInt(0),
+				peer:    sp,
+			}
+			newFork.headers.PushBack(fork.forkPoint())
+			for e := fork.headers.Front().Next(); ; e = e.Next() {
+				n := e.Value.(*headerNode)
+				newFork.headers.PushBack(n)
+				newFork.work.Add(newFork.work,
+					blockchain.CalcWork(n.header.Bits))
+				if e == el {
+					break
+				}
+			}
+			b.addSideChain(newFork)
+			return newFork, nil
+		}
+	}
+
+	forkHeader, forkHeight, err := b.server.GetBlockByHash(prevHash)
+	if err != nil {
+		return nil, nil
+	}
+
+	// A fork from before the latest checkpoint we've synced past is
+	// invalid, and one from too far back isn't worth tracking.
+	_, tipHeight, err := b.server.LatestBlock()
+	if err != nil {
+		return nil, err
+	}
+	prevCheckpoint := b.findPreviousHeaderCheckpoint(int32(tipHeight))
+	if forkHeight < uint32(prevCheckpoint.Height) {
+		return nil, fmt.Errorf("fork at height %d is earlier than "+
+			"checkpoint at height %d", forkHeight,
+			prevCheckpoint.Height)
+	}
+	if int(tipHeight-forkHeight) > MaxSideChainLength {
+		return nil, fmt.Errorf("fork at height %d is more than %d "+
+			"blocks below our tip", forkHeight, MaxSideChainLength)
+	}
+
+	fork := &sideChain{
+		headers: list.New(),
+		work:    big.NewInt(0),
+		peer:    sp,
+	}
+	fork.headers.PushBack(&headerNode{
+		header: &forkHeader,
+		height: int32(forkHeight),
+	})
+	b.addSideChain(fork)
+	return fork, nil
+}
+
+// addOrphanHeaders keeps headers we can't connect to our chain or any fork
+// and asks the peer for their ancestors.
+func (b *blockManager) addOrphanHeaders(sp *serverPeer,
+	headers []*wire.BlockHeader) {
+
+	// If they extend headers we're already waiting on, keep them
+	// together.
+	var fork *sideChain
+	for _, c := range b.sideChains {
+		if !c.connected() && c.tipHash() == headers[0].PrevBlock {
+			fork = c
+			break
+		}
+	}
+	if fork == nil {
+		// Each peer gets to have us look for the ancestors of one
+		// orphan fork at a time.
+		for _, c := range b.sideChains {
+			if !c.connected() && c.peer == sp {
+				b.removeSideChain(c)
+				break
+			}
+		}
+		fork = &sideChain{}
+		b.addSideChain(fork)
+	}
+	fork.orphans = append(fork.orphans, headers...)
+	fork.peer = sp
+	fork.lastUpdate = time.Now()
+	if fork.length() > MaxSideChainLength {
+		log.Infof("Dropping orphan headers from peer %s with more "+
+			"than %d headers", sp.Addr(), MaxSideChainLength)
+		b.removeSideChain(fork)
+		return
+	}
+
+	// Ask for the headers from the last block we have in common with the
+	// peer up to the first orphan's parent.
+	locator, err := b.server.LatestBlockLocator()
+	if err != nil {
+		log.Errorf("Failed to get block locator for the latest "+
+			"block: %s", err)
+		return
+	}
+	log.Debugf("Requesting ancestors of orphan header %s from peer %s",
+		fork.orphans[0].BlockHash(), sp.Addr())
+	err = sp.PushGetHeadersMsg(locator, &fork.orphans[0].PrevBlock)
+	if err != nil {
+		log.Warnf("Failed to send getheaders message to peer %s: %s",
+			sp.Addr(), err)
+	}
+}
+
+// extendSideChain checks the passed headers, which must follow the tip of the
+// passed connected fork, and adds them to it.
+func (b *blockManager) extendSideChain(fork *sideChain,
+	headers []*wire.BlockHeader, maxTimestamp time.Time) error {
+
+	for _, header := range headers {
+		prevNode := fork.headers.Back().Value.(*headerNode)
+		if header.PrevBlock != prevNode.header.BlockHash() {
+			return fmt.Errorf("header %s doesn't connect to side "+
+				"chain", header.BlockHash())
+		}
+		err := b.checkHeaderSanity(header, maxTimestamp, fork.headers)
+		if err != nil {
+			return err
+		}
+
+		node := &headerNode{header: header, height: prevNode.height + 1}
+		for _, cp := range b.server.chainParams.Checkpoints {
+			if cp.Height == node.height &&
+				*cp.Hash != header.BlockHash() {
+				return fmt.Errorf("header %s doesn't match "+
+					"checkpoint %s at height %d",
+					header.BlockHash(), cp.Hash, cp.Height)
+			}
+		}
+
+		fork.headers.PushBack(node)
+		fork.work.Add(fork.work, blockchain.CalcWork(header.Bits))
+	}
+	fork.lastUpdate = time.Now()
+	return nil
+}
+
+// connectOrphans moves the headers of any orphan forks that follow the tip of
+// the passed connected fork to it.
+func (b *blockManager) connectOrphans(fork *sideChain,
+	maxTimestamp time.Time) error {
+
+	for {
+		var orphan *sideChain
+		tipHash := fork.tipHash()
+		for _, c := range b.sideChains {
+			if !c.connected() && c.orphans[0].PrevBlock == tipHash {
+				orphan = c
+				break
+			}
+		}
+		if orphan == nil {
+			return nil
+		}
+
+		log.Debugf("Connected %d orphan headers to side chain at "+
+			"height %d", len(orphan.orphans),
+			fork.headers.Back().Value.(*headerNode).height)
+		b.removeSideChain(orphan)
+		err := b.extendSideChain(fork, orphan.orphans, maxTimestamp)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// evaluateSideChain compares the work of the passed fork to the work of our
+// chain since the fork point and switches to the fork if it has more. If it
+// doesn't, the peer is asked for any headers past the fork's tip.
+func (b *blockManager) evaluateSideChain(fork *sideChain) {
+	forkPoint := fork.forkPoint()
+	knownWork, err := b.chainWorkSince(forkPoint.height)
+	if err != nil {
+		log.Errorf("Unable to calculate work of our chain: %s", err)
+		return
+	}
+
+	log.Tracef("Side chain at height %d with %d headers has work %v, "+
+		"our chain has %v", forkPoint.height, fork.length(), fork.work,
+		knownWork)
+
+	if fork.work.Cmp(knownWork) <= 0 {
+		if fork.peer == nil {
+			return
+		}
+		tipHash := fork.tipHash()
+		locator := blockchain.BlockLocator([]*chainhash.Hash{&tipHash})
+		err := fork.peer.PushGetHeadersMsg(locator, &zeroHash)
+		if err != nil {
+			log.Warnf("Failed to send getheaders message to peer "+
+				"%s: %s", fork.peer.Addr(), err)
+		}
+		return
+	}
+
+	b.switchToSideChain(fork)
+}
+
+// chainWorkSince returns the total work of the headers in our chain above the
+// passed height.
+func (b *blockManager) chainWorkSince(height int32) (*big.Int, error) {
+	_, tipHeight, err := b.server.LatestBlock()
+	if err != nil {
+		return nil, err
+	}
+	work := big.NewInt(0)
+	for h := int32(tipHeight); h > height; h-- {
+		header, err := b.headerAtHeight(b.headerList, h)
+		if err != nil {
+			return nil, err
+		}
+		work.Add(work, blockchain.CalcWork(header.Bits))
+	}
+	return work, nil
+}
+
+// switchToSideChain rolls our chain back to the fork point of the passed fork
+// and writes the fork's headers in its place in a single transaction. The
+// headers we roll back are kept as a fork themselves in case they end up with
+// more work again.
+func (b *blockManager) switchToSideChain(fork *sideChain) {
+	forkPoint := fork.forkPoint()
+	log.Infof("Switching to side chain from peer %s forking at height "+
+		"%d with %d headers", fork.peer.Addr(), forkPoint.height,
+		fork.length())
+
+	// Roll back our chain and write the fork's headers in a single
+	// transaction.
+	batch := make([]*headerNode, 0, fork.length())
+	for el := fork.headers.Front().Next(); el != nil; el = el.Next() {
+		batch = append(batch, el.Value.(*headerNode))
+	}
+	disconnected, err := b.server.reorgChain(uint32(forkPoint.height),
+		batch)
+	if err != nil {
+		log.Criticalf("Couldn't switch to side chain: %s", err)
+		// Should we panic here?
+		return
+	}
+
+	// The headers we rolled back become a fork of their own.
+	oldChain := &sideChain{
+		headers: list.New(),
+		work:    big.NewInt(0),
+	}
+	oldChain.headers.PushBack(forkPoint)
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		header := disconnected[i]
+		oldChain.headers.PushBack(&headerNode{
+			header: &header,
+			height: forkPoint.height + int32(len(disconnected)-i),
+		})
+		oldChain.work.Add(oldChain.work,
+			blockchain.CalcWork(header.Bits))
+	}
+
+	b.removeSideChain(fork)
+	if oldChain.length() > 0 {
+		oldChain.lastUpdate = time.Now()
+		b.addSideChain(oldChain)
+	}
+
+	b.syncPeerMutex.Lock()
+	b.syncPeer = fork.peer
+	b.syncPeerMutex.Unlock()
+
+	// The header list now needs to hold the new headers so the headers
+	// that follow them can be validated. The filter headers of the
+	// disconnected blocks were removed along with them, so the cfheader
+	// sync picks up from the fork point.
+	b.resetHeaderState(forkPoint.header, forkPoint.height)
+	for _, node := range batch {
+		b.addHeaderNode(node)
+	}
+
+	tip := batch[len(batch)-1]
+	tipHash := tip.header.BlockHash()
+	b.nextCheckpoint = b.findNextHeaderCheckpoint(tip.height)
+	b.signalCFHeaderSync()
+
+	// Continue syncing from the new sync peer.
+	locator := blockchain.BlockLocator([]*chainhash.Hash{&tipHash})
+	nextHash := zeroHash
+	if b.nextCheckpoint != nil {
+		nextHash = *b.nextCheckpoint.Hash
+	}
+	err = fork.peer.PushGetHeadersMsg(locator, &nextHash)
+	if err != nil {
+		log.Warnf("Failed to send getheaders message to peer %s: %s",
+			fork.peer.Addr(), err)
+	}
+}
+
+// addSideChain starts tracking the passed fork. If we're tracking too many
+// forks of the same kind, connected or orphan, the one of that kind we've
+// heard from least recently is dropped, so orphans can't push out forks we
+// know to connect to our chain.
+func (b *blockManager) addSideChain(fork *sideChain) {
+	fork.lastUpdate = time.Now()
+
+	limit := MaxSideChains
+	if !fork.connected() {
+		limit = MaxOrphanChains
+	}
+	var (
+		count  int
+		oldest *sideChain
+	)
+	for _, c := range b.sideChains {
+		if c.connected() != fork.connected() {
+			continue
+		}
+		count++
+		if oldest == nil || c.lastUpdate.Before(oldest.lastUpdate) {
+			oldest = c
+		}
+	}
+	if count >= limit && oldest != nil {
+		b.removeSideChain(oldest)
+	}
+	b.sideChains = append(b.sideChains, fork)
+}
+
+// removeSideChain stops tracking the passed fork.
+func (b *blockManager) removeSideChain(fork *sideChain) {
+	for i, c := range b.sideChains {
+		if c == fork {
+			b.sideChains = append(b.sideChains[:i],
+				b.sideChains[i+1:]...)
+			return
+		}
+	}
+}
+
+// removePeerOrphans stops looking for the ancestors of the orphan headers
+// the passed peer sent us, as it can't send them anymore.
+func (b *blockManager) removePeerOrphans(sp *serverPeer) {
+	for i := 0; i < len(b.sideChains); {
+		fork := b.sideChains[i]
+		if !fork.connected() && fork.peer == sp {
+			b.sideChains = append(b.sideChains[:i],
+				b.sideChains[i+1:]...)
+			continue
+		}
+		i++
+	}
+}
+
+// pruneSideChains drops connected forks that branch off too far below our tip
+// or whose fork point is no longer in our chain, and orphan forks whose
+// ancestors we haven't received within OrphanChainTimeout.
+func (b *blockManager) pruneSideChains() {
+	_, tipHeight, err := b.server.LatestBlock()
+	if err != nil {
+		return
+	}
+	for i := 0; i < len(b.sideChains); {
+		fork := b.sideChains[i]
+		if !fork.connected() &&
+			time.Since(fork.lastUpdate) > OrphanChainTimeout {
+
+			log.Debugf("Dropping orphan headers from peer %s "+
+				"whose ancestors never arrived", fork.peer)
+			b.sideChains = append(b.sideChains[:i],
+				b.sideChains[i+1:]...)
+			continue
+		}
+		if fork.connected() {
+			forkPoint := fork.forkPoint()
+			_, height, err := b.server.GetBlockByHash(
+				forkPoint.header.BlockHash())
+			if err != nil || int32(height) != forkPoint.height ||
+				int(int32(tipHeight)-forkPoint.height) >
+					MaxSideChainLength {
+
+				b.sideChains = append(b.sideChains[:i],
+					b.sideChains[i+1:]...)
+				continue
+			}
+		}
+		i++
+	}
+}
@@ -0,0 +1,364 @@
+package neutrino
+
+import (
+	"container/list"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// TestAddSideChain checks that once we track MaxSideChains connected forks or
+// MaxOrphanChains orphan forks, adding another one drops the one of the same
+// kind we've heard from least recently.
+func TestAddSideChain(t *testing.T) {
+	defer func(maxSideChains, maxOrphanChains int) {
+		MaxSideChains = maxSideChains
+		MaxOrphanChains = maxOrphanChains
+	}(MaxSideChains, MaxOrphanChains)
+	MaxSideChains = 2
+	MaxOrphanChains = 1
+
+	tests := []struct {
+		name string
+
+		// connected is whether each fork that's added, in order, is
+		// known to connect to our chain.
+		connected []bool
+
+		// kept is the indices of the forks that should be left.
+		kept []int
+	}{
+		{
+			name:      "below the limits",
+			connected: []bool{true, true, false},
+			kept:      []int{0, 1, 2},
+		},
+		{
+			name:      "too many connected forks",
+			connected: []bool{true, true, true},
+			kept:      []int{1, 2},
+		},
+		{
+			name:      "too many orphan forks",
+			connected: []bool{false, false},
+			kept:      []int{1},
+		},
+		{
+			name:      "orphans don't push out connected forks",
+			connected: []bool{true, true, false, false},
+			kept:      []int{0, 1, 3},
+		},
+		{
+			name:      "connected forks don't push out orphans",
+			connected: []bool{false, true, true, true},
+			kept:      []int{0, 2, 3},
+		},
+	}
+
+	start := time.Now()
+	for _, test := range tests {
+		b := &blockManager{}
+		var forks []*sideChain
+		for i, connected := range test.connected {
+			fork := &sideChain{}
+			if connected {
+				fork.headers = list.New()
+				fork.headers.PushBack(&headerNode{
+					header: testGenesis,
+				})
+			} else {
+				fork.orphans = append(fork.orphans, testGenesis)
+			}
+			b.addSideChain(fork)
+
+			// Make sure the forks are ordered by when they were
+			// added, however coarse the clock is.
+			offset := time.Duration(i) * time.Second
+			fork.lastUpdate = start.Add(offset)
+			forks = append(forks, fork)
+		}
+
+		if len(b.sideChains) != len(test.kept) {
+			t.Errorf("%s: %d forks left, want %d", test.name,
+				len(b.sideChains), len(test.kept))
+			continue
+		}
+		for i, index := range test.kept {
+			if b.sideChains[i] != forks[index] {
+				t.Errorf("%s: fork %d isn't fork %d", test.name,
+					i, index)
+			}
+		}
+	}
+}
+
+// TestPruneSideChains checks that orphan forks are dropped once
+// OrphanChainTimeout has passed, and connected forks once they branch off
+// more than MaxSideChainLength below our tip or their fork point is no
+// longer in our chain.
+func TestPruneSideChains(t *testing.T) {
+	defer func(maxLength int) {
+		MaxSideChainLength = maxLength
+	}(MaxSideChainLength)
+	MaxSideChainLength = 10
+
+	const numHeaders = 20
+	nodes := mineTestHeaders(testGenesis, 0, numHeaders)
+	staleNode := mineSeededTestHeaders(nodes[14].header, 15, 1, 1<<20)[0]
+
+	tests := []struct {
+		name string
+
+		// forkPoint is the fork point of a connected fork, or nil for
+		// an orphan fork.
+		forkPoint *headerNode
+
+		// age is how long ago we last heard about the fork.
+		age time.Duration
+
+		kept bool
+	}{
+		{
+			name: "orphans",
+			kept: true,
+		},
+		{
+			name: "expired orphans",
+			age:  OrphanChainTimeout + time.Second,
+		},
+		{
+			name:      "fork near the tip",
+			forkPoint: nodes[14],
+			kept:      true,
+		},
+		{
+			name:      "old fork near the tip",
+			forkPoint: nodes[14],
+			age:       OrphanChainTimeout + time.Second,
+			kept:      true,
+		},
+		{
+			name:      "fork too far below the tip",
+			forkPoint: nodes[4],
+		},
+		{
+			name:      "fork point not in our chain",
+			forkPoint: staleNode,
+		},
+		{
+			name: "fork point at another height",
+			forkPoint: &headerNode{
+				header: nodes[14].header,
+				height: nodes[14].height - 1,
+			},
+		},
+	}
+
+	s, cleanup := newTestChainService(t)
+	defer cleanup()
+	if err := s.headers.writeHeaders(nodes); err != nil {
+		t.Fatalf("unable to write headers: %s", err)
+	}
+
+	for _, test := range tests {
+		b := s.blockManager
+		fork := &sideChain{lastUpdate: time.Now().Add(-test.age)}
+		if test.forkPoint != nil {
+			fork.headers = list.New()
+			fork.headers.PushBack(test.forkPoint)
+		} else {
+			fork.orphans = append(fork.orphans, staleNode.header)
+		}
+		b.sideChains = []*sideChain{fork}
+
+		b.pruneSideChains()
+		if kept := len(b.sideChains) == 1; kept != test.kept {
+			t.Errorf("%s: fork kept is %v, want %v", test.name,
+				kept, test.kept)
+		}
+	}
+}
+
+// TestHandleSideChainHeaders checks that headers that don't extend our chain
+// start or extend a fork, or are kept as orphans until their ancestors
+// arrive, that forks too far below our tip or longer than
+// MaxSideChainLength are dropped, and that once a fork has more work than our
+// chain, we switch to it and keep the headers we roll back as a fork.
+func TestHandleSideChainHeaders(t *testing.T) {
+	defer func(maxLength int) {
+		MaxSideChainLength = maxLength
+	}(MaxSideChainLength)
+	MaxSideChainLength = 10
+
+	const numHeaders = 20
+	nodes := mineTestHeaders(testGenesis, 0, numHeaders)
+
+	type testFork struct {
+		length    int
+		connected bool
+	}
+	tests := []struct {
+		name string
+
+		// forkHeight is the height of the header in our chain that
+		// the fork's headers build on.
+		forkHeight int32
+
+		// sends is the start and end index of the fork's headers the
+		// peer sends in each headers message.
+		sends [][2]int
+
+		// tip is the index of the fork's header that should be our
+		// tip, or -1 if we should stay on our chain.
+		tip int
+
+		// forks is the forks that should be tracked.
+		forks []testFork
+
+		disconnected bool
+	}{
+		{
+			name:       "fork with less work",
+			forkHeight: 15,
+			sends:      [][2]int{{0, 3}},
+			tip:        -1,
+			forks:      []testFork{{3, true}},
+		},
+		{
+			name:       "fork extended to as much work",
+			forkHeight: 15,
+			sends:      [][2]int{{0, 3}, {3, 5}},
+			tip:        -1,
+			forks:      []testFork{{5, true}},
+		},
+		{
+			name:       "known headers skipped",
+			forkHeight: 15,
+			sends:      [][2]int{{0, 3}, {0, 4}},
+			tip:        -1,
+			forks:      []testFork{{4, true}},
+		},
+		{
+			name:       "fork with more work",
+			forkHeight: 15,
+			sends:      [][2]int{{0, 6}},
+			tip:        5,
+			forks:      []testFork{{5, true}},
+		},
+		{
+			name:       "fork extended to more work",
+			forkHeight: 15,
+			sends:      [][2]int{{0, 3}, {3, 6}},
+			tip:        5,
+			forks:      []testFork{{5, true}},
+		},
+		{
+			name:       "orphans",
+			forkHeight: 15,
+			sends:      [][2]int{{1, 4}},
+			tip:        -1,
+			forks:      []testFork{{3, false}},
+		},
+		{
+			name:       "orphans connected",
+			forkHeight: 15,
+			sends:      [][2]int{{1, 6}, {0, 1}},
+			tip:        5,
+			forks:      []testFork{{5, true}},
+		},
+		{
+			name:         "fork too far below the tip",
+			forkHeight:   5,
+			sends:        [][2]int{{0, 1}},
+			tip:          -1,
+			disconnected: true,
+		},
+		{
+			name:       "fork longer than MaxSideChainLength",
+			forkHeight: 15,
+			sends:      [][2]int{{0, 11}},
+			tip:        -1,
+		},
+		{
+			name:       "orphans longer than MaxSideChainLength",
+			forkHeight: 15,
+			sends:      [][2]int{{1, 12}},
+			tip:        -1,
+		},
+	}
+
+	maxTimestamp := time.Now().Add(2 * time.Hour)
+	for _, test := range tests {
+		s, cleanup := newTestChainService(t)
+		if err := s.headers.writeHeaders(nodes); err != nil {
+			cleanup()
+			t.Fatalf("%s: unable to write headers: %s", test.name,
+				err)
+		}
+		b := s.blockManager
+		b.resetHeaderState(nodes[numHeaders-1].header, numHeaders)
+
+		forkNodes := mineSeededTestHeaders(
+			nodes[test.forkHeight-1].header, test.forkHeight, 12,
+			1<<20)
+		sp := newTestFetchPeer(t, s, 0, numHeaders+1)
+		for _, send := range test.sends {
+			headerMsg := forkNodes[send[0]:send[1]]
+			headers := make([]*wire.BlockHeader, 0, len(headerMsg))
+			for _, node := range headerMsg {
+				headers = append(headers, node.header)
+			}
+			b.handleSideChainHeaders(sp, headers, maxTimestamp)
+		}
+		disconnected := !sp.Connected()
+		sp.Disconnect()
+
+		tip, tipHeight, err := s.LatestBlock()
+		cleanup()
+		if err != nil {
+			t.Fatalf("%s: unable to get chain tip: %s", test.name,
+				err)
+		}
+
+		want := nodes[numHeaders-1]
+		if test.tip >= 0 {
+			want = forkNodes[test.tip]
+			if b.syncPeer != sp {
+				t.Errorf("%s: didn't switch sync peer",
+					test.name)
+			}
+		}
+		if tip.BlockHash() != want.header.BlockHash() ||
+			int32(tipHeight) != want.height {
+
+			t.Errorf("%s: tip is %s at height %d, want %s at "+
+				"height %d", test.name, tip.BlockHash(),
+				tipHeight, want.header.BlockHash(),
+				want.height)
+		}
+
+		if disconnected != test.disconnected {
+			t.Errorf("%s: peer disconnected is %v, want %v",
+				test.name, disconnected, test.disconnected)
+		}
+
+		if len(b.sideChains) != len(test.forks) {
+			t.Errorf("%s: %d forks tracked, want %d", test.name,
+				len(b.sideChains), len(test.forks))
+			continue
+		}
+		for i, wantFork := range test.forks {
+			fork := b.sideChains[i]
+			if fork.length() != wantFork.length ||
+				fork.connected() != wantFork.connected {
+
+				t.Errorf("%s: fork %d has %d headers and "+
+					"connected %v, want %d and %v",
+					test.name, i, fork.length(),
+					fork.connected(), wantFork.length,
+					wantFork.connected)
+			}
+		}
+	}
+}
@@ -0,0 +1,668 @@
+// NOTE: THIS API IS UNSTABLE RIGHT NOW.
+
+package neutrino
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcwallet/walletdb"
+)
+
+const (
+	// snapshotVersionHeaders is the original version of the snapshot
+	// format, which only holds block headers and has no checksum.
+	snapshotVersionHeaders = 1
+
+	// snapshotVersion is the current version of the snapshot format. It
+	// adds optional filter headers for each block and a checksum at the
+	// end of the snapshot.
+	snapshotVersion = 2
+
+	// snapshotBatchSize is the number of headers written to the database
+	// in a single transaction while importing a snapshot.
+	snapshotBatchSize = 2000
+)
+
+// These flags describe which filter headers follow each block header in a
+// snapshot.
+const (
+	snapshotBasicFilterHeaders uint32 = 1 << iota
+	snapshotExtFilterHeaders
+)
+
+// snapshotMagic identifies a headers snapshot file.
+var snapshotMagic = [4]byte{'n', 'h', 'd', 'r'}
+
+// snapshotHeader is the fixed-size header at the start of a headers snapshot.
+// It's followed by numHeaders records, the first of which is for the block at
+// startHeight. Each record is a serialized 80-byte block header, followed by
+// the 32-byte basic and extended filter headers for the block if the
+// respective flags are set. From version 2, the records are followed by the
+// SHA-256 checksum of everything before it in the snapshot.
+//
+// All integers are serialized in little-endian order:
+//
+//	magic       [4]byte  "nhdr"
+//	version     uint32
+//	net         uint32   the wire.BitcoinNet of the chain
+//	startHeight uint32
+//	numHeaders  uint32
+//	flags       uint32   version 2 and later only
+type snapshotHeader struct {
+	version     uint32
+	net         wire.BitcoinNet
+	startHeight uint32
+	numHeaders  uint32
+	flags       uint32
+}
+
+// recordSize returns the serialized size of each record in the snapshot.
+func (h *snapshotHeader) recordSize() int64 {
+	size := int64(wire.MaxBlockHeaderPayload)
+	if h.flags&snapshotBasicFilterHeaders != 0 {
+		size += chainhash.HashSize
+	}
+	if h.flags&snapshotExtFilterHeaders != 0 {
+		size += chainhash.HashSize
+	}
+	return size
+}
+
+// readSnapshotHeader reads and checks the header of a headers snapshot.
+func readSnapshotHeader(r io.Reader) (*snapshotHeader, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, fmt.Errorf("unable to read snapshot magic: %s", err)
+	}
+	if magic != snapshotMagic {
+		return nil, fmt.Errorf("not a headers snapshot")
+	}
+
+	var fields [4]uint32
+	for i := range fields {
+		err := binary.Read(r, binary.LittleEndian, &fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("unable to read snapshot "+
+				"header: %s", err)
+		}
+	}
+	hdr := &snapshotHeader{
+		version:     fields[0],
+		net:         wire.BitcoinNet(fields[1]),
+		startHeight: fields[2],
+		numHeaders:  fields[3],
+	}
+	switch hdr.version {
+	case snapshotVersionHeaders:
+	case snapshotVersion:
+		err := binary.Read(r, binary.LittleEndian, &hdr.flags)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read snapshot "+
+				"flags: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported snapshot version %d",
+			hdr.version)
+	}
+	return hdr, nil
+}
+
+// writeSnapshotHeader writes the header of a snapshot in the current version
+// of the format.
+func writeSnapshotHeader(w io.Writer, hdr *snapshotHeader) error {
+	if _, err := w.Write(snapshotMagic[:]); err != nil {
+		return err
+	}
+	fields := []uint32{
+		snapshotVersion,
+		uint32(hdr.net),
+		hdr.startHeight,
+		hdr.numHeaders,
+		hdr.flags,
+	}
+	for _, field := range fields {
+		if _, err := w.Write(uint32ToBytes(field)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotRecord is a single block's entry in a snapshot.
+type snapshotRecord struct {
+	header      wire.BlockHeader
+	basicHeader *chainhash.Hash
+	extHeader   *chainhash.Hash
+}
+
+// readSnapshotRecord reads the next record from a snapshot.
+func readSnapshotRecord(r io.Reader, hdr *snapshotHeader) (*snapshotRecord,
+	error) {
+
+	var record snapshotRecord
+	if err := record.header.Deserialize(r); err != nil {
+		return nil, err
+	}
+	if hdr.flags&snapshotBasicFilterHeaders != 0 {
+		record.basicHeader = new(chainhash.Hash)
+		if _, err := io.ReadFull(r, record.basicHeader[:]); err != nil {
+			return nil, err
+		}
+	}
+	if hdr.flags&snapshotExtFilterHeaders != 0 {
+		record.extHeader = new(chainhash.Hash)
+		if _, err := io.ReadFull(r, record.extHeader[:]); err != nil {
+			return nil, err
+		}
+	}
+	return &record, nil
+}
+
+// ExportSnapshot writes the block headers from startHeight to endHeight,
+// inclusive, to w in the snapshot format read by ImportHeaders. If we have
+// the basic or extended filter header for the block at endHeight, the
+// respective filter headers for every block in the range are included as
+// well, and must all be in the database. If the chain is reorganized while
+// the snapshot is being written, an error is returned, as the snapshot may
+// mix headers from both sides of the reorg.
+func (s *ChainService) ExportSnapshot(w io.Writer, startHeight,
+	endHeight uint32) error {
+
+	_, tipHeight, err := s.LatestBlock()
+	if err != nil {
+		return err
+	}
+	if startHeight > endHeight || endHeight > tipHeight {
+		return fmt.Errorf("invalid snapshot range %d to %d with tip "+
+			"at height %d", startHeight, endHeight, tipHeight)
+	}
+
+	// Filter headers are written in order, so if we have them for the
+	// last block in the range, we should have them for the whole range.
+	endHeader, err := s.GetBlockByHeight(endHeight)
+	if err != nil {
+		return err
+	}
+	endHash := endHeader.BlockHash()
+	hdr := &snapshotHeader{
+		net:         s.chainParams.Net,
+		startHeight: startHeight,
+		numHeaders:  endHeight - startHeight + 1,
+	}
+	_, err = s.GetFilterHeader(endHash, BasicFilter)
+	switch {
+	case err == nil:
+		hdr.flags |= snapshotBasicFilterHeaders
+	case err != ErrFilterHeaderNotFound:
+		return err
+	}
+	_, err = s.GetFilterHeader(endHash, ExtFilter)
+	switch {
+	case err == nil:
+		hdr.flags |= snapshotExtFilterHeaders
+	case err != ErrFilterHeaderNotFound:
+		return err
+	}
+
+	// Everything we write before the checksum also goes into it.
+	checksum := sha256.New()
+	bw := bufio.NewWriter(w)
+	mw := io.MultiWriter(bw, checksum)
+
+	if err := writeSnapshotHeader(mw, hdr); err != nil {
+		return err
+	}
+
+	log.Infof("Exporting snapshot of headers %d to %d", startHeight,
+		endHeight)
+
+	// Each header is read separately, so we make sure every header
+	// connects to the one before it, and that the last one is still the
+	// block we started out with. Together, they guarantee that every
+	// header we wrote is on the chain ending at endHash.
+	var prevHash chainhash.Hash
+	for height := startHeight; height <= endHeight; height++ {
+		header, err := s.GetBlockByHeight(height)
+		if err != nil {
+			return err
+		}
+		blockHash := header.BlockHash()
+		if height > startHeight && header.PrevBlock != prevHash {
+			return fmt.Errorf("chain was reorganized at height "+
+				"%d while exporting snapshot", height)
+		}
+		if height == endHeight && blockHash != endHash {
+			return fmt.Errorf("chain was reorganized at height "+
+				"%d while exporting snapshot", height)
+		}
+		prevHash = blockHash
+
+		if err := header.Serialize(mw); err != nil {
+			return err
+		}
+
+		if hdr.flags&snapshotBasicFilterHeaders != 0 {
+			filterHeader, err := s.GetFilterHeader(blockHash,
+				BasicFilter)
+			if err != nil {
+				return fmt.Errorf("missing basic filter "+
+					"header for block %d (%s): %s", height,
+					blockHash, err)
+			}
+			if _, err := mw.Write(filterHeader[:]); err != nil {
+				return err
+			}
+		}
+		if hdr.flags&snapshotExtFilterHeaders != 0 {
+			filterHeader, err := s.GetFilterHeader(blockHash,
+				ExtFilter)
+			if err != nil {
+				return fmt.Errorf("missing extended filter "+
+					"header for block %d (%s): %s", height,
+					blockHash, err)
+			}
+			if _, err := mw.Write(filterHeader[:]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := bw.Write(checksum.Sum(nil)); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ImportHeaders reads a headers snapshot from r and adds the headers in it to
+// the database, up to and including the header at stopHeight, which must hash
+// to stopHash. Headers already in the database are checked against the
+// snapshot and skipped, and the first new header must connect to our current
+// tip. Every new header is checked for proper linkage, proof of work,
+// difficulty retargets and checkpoints just as during a sync from the
+// network, and the headers are written in batches.
+//
+// If the snapshot has filter headers, they're imported along with the block
+// headers. Filter headers can't be checked without the filters themselves,
+// so they're only as trustworthy as the source of the snapshot.
+//
+// This can only be called before the ChainService is started.
+func (s *ChainService) ImportHeaders(r io.Reader, stopHeight uint32,
+	stopHash chainhash.Hash) error {
+
+	if atomic.LoadInt32(&s.started) != 0 {
+		return fmt.Errorf("headers can only be imported before the " +
+			"chain service is started")
+	}
+	return s.blockManager.importHeaders(r, stopHeight, stopHash)
+}
+
+// importHeaderSnapshot imports the headers snapshot file at the passed path.
+func (s *ChainService) importHeaderSnapshot(path string, stopHeight uint32,
+	stopHash chainhash.Hash) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return s.ImportHeaders(bufio.NewReader(f), stopHeight, stopHash)
+}
+
+// importHeaders does the work for ImportHeaders. It must not be called while
+// the block handler is running.
+func (b *blockManager) importHeaders(r io.Reader, stopHeight uint32,
+	stopHash chainhash.Hash) error {
+
+	// Everything we read also goes into the checksum, which is only
+	// checked for versions of the format that have one.
+	checksum := sha256.New()
+	r = io.TeeReader(r, checksum)
+
+	hdr, err := readSnapshotHeader(r)
+	if err != nil {
+		return err
+	}
+	if hdr.net != b.server.chainParams.Net {
+		return fmt.Errorf("snapshot is for network %s, not %s",
+			hdr.net, b.server.chainParams.Net)
+	}
+	if stopHeight < hdr.startHeight ||
+		stopHeight-hdr.startHeight >= hdr.numHeaders {
+		return fmt.Errorf("snapshot doesn't contain a header at "+
+			"height %d", stopHeight)
+	}
+
+	tipHeader, tipHeight, err := b.server.LatestBlock()
+	if err != nil {
+		return err
+	}
+	if hdr.startHeight > tipHeight+1 {
+		return fmt.Errorf("snapshot starts at height %d, which "+
+			"doesn't connect to our tip at height %d",
+			hdr.startHeight, tipHeight)
+	}
+
+	// The list of headers we've validated is seeded with our current tip
+	// so the first new header can prove it connects to it. We only keep
+	// as many headers in it as we need to calculate difficulty retargets;
+	// anything older has already been written to the database.
+	hList := list.New()
+	hList.PushBack(&headerNode{
+		header: &tipHeader,
+		height: int32(tipHeight),
+	})
+	maxTimestamp := b.server.timeSource.AdjustedTime().Add(maxTimeOffset)
+	batch := newSnapshotBatch()
+	var imported []chainhash.Hash
+	var lastHash chainhash.Hash
+
+	// Once we've started writing to the database, we can't trust any of
+	// it if the snapshot turns out to be bad, so we roll back to where we
+	// started, including any filter headers we added for blocks we
+	// already knew about.
+	rollBack := func(importErr error) error {
+		log.Warnf("Unable to import snapshot: %s -- rolling back "+
+			"import", importErr)
+		if _, err := b.server.rollBackToHeight(tipHeight); err != nil {
+			return err
+		}
+		err := b.server.dbUpdate(deleteFilterHeaders(imported))
+		if err != nil {
+			return err
+		}
+		b.server.uncacheBlocks(imported...)
+		return importErr
+	}
+
+	log.Infof("Importing headers from snapshot up to height %d (%s)",
+		stopHeight, stopHash)
+
+	for height := hdr.startHeight; height <= stopHeight; height++ {
+		record, err := readSnapshotRecord(r, hdr)
+		if err != nil {
+			return rollBack(fmt.Errorf("unable to read header at "+
+				"height %d from snapshot: %s", height, err))
+		}
+		header := &record.header
+		blockHash := header.BlockHash()
+		lastHash = blockHash
+
+		err = checkSnapshotFilterCheckpoint(b.server, record)
+		if err != nil {
+			return rollBack(err)
+		}
+
+		// If we already know about this height, the snapshot must
+		// agree with us, although we may still be missing its filter
+		// headers.
+		if height <= tipHeight {
+			known, err := b.server.GetBlockByHeight(height)
+			if err != nil {
+				return rollBack(err)
+			}
+			if known.BlockHash() != blockHash {
+				return rollBack(fmt.Errorf("snapshot header "+
+					"%s at height %d conflicts with "+
+					"stored header %s", blockHash, height,
+					known.BlockHash()))
+			}
+			err = batch.addKnown(b.server, record)
+			if err != nil {
+				return rollBack(err)
+			}
+		} else {
+			prevNode := hList.Back().Value.(*headerNode)
+			if header.PrevBlock != prevNode.header.BlockHash() {
+				return rollBack(fmt.Errorf("snapshot header "+
+					"%s at height %d doesn't connect to "+
+					"the previous header", blockHash,
+					height))
+			}
+			err := b.checkHeaderSanity(header, maxTimestamp, hList)
+			if err != nil {
+				return rollBack(fmt.Errorf("snapshot header "+
+					"%s at height %d doesn't pass sanity "+
+					"check: %s", blockHash, height, err))
+			}
+			nextCheckpoint := b.findNextHeaderCheckpoint(
+				prevNode.height)
+			if nextCheckpoint != nil &&
+				nextCheckpoint.Height == int32(height) &&
+				*nextCheckpoint.Hash != blockHash {
+				return rollBack(fmt.Errorf("snapshot header "+
+					"%s at height %d doesn't match "+
+					"checkpoint %s", blockHash, height,
+					nextCheckpoint.Hash))
+			}
+
+			node := &headerNode{header: header, height: int32(height)}
+			hList.PushBack(node)
+			if hList.Len() > int(b.blocksPerRetarget) {
+				hList.Remove(hList.Front())
+			}
+			batch.addNode(node, record)
+		}
+
+		if batch.len() >= snapshotBatchSize {
+			if err := batch.write(b.server); err != nil {
+				return rollBack(err)
+			}
+			imported = append(imported, batch.filterHashes...)
+			batch = newSnapshotBatch()
+		}
+	}
+
+	// Make sure the snapshot ends where we were told it would, and that
+	// its checksum matches if it has one, before writing the final batch.
+	if lastHash != stopHash {
+		return rollBack(fmt.Errorf("snapshot header at height %d is "+
+			"%s, expected %s", stopHeight, lastHash, stopHash))
+	}
+	if hdr.version >= snapshotVersion {
+		err := verifySnapshotChecksum(r, hdr, stopHeight, checksum)
+		if err != nil {
+			return rollBack(err)
+		}
+	}
+	if err := batch.write(b.server); err != nil {
+		return rollBack(err)
+	}
+	imported = append(imported, batch.filterHashes...)
+
+	lastNode := hList.Back().Value.(*headerNode)
+	if lastNode.height == int32(tipHeight) {
+		log.Infof("All headers in snapshot are already known, "+
+			"imported %d filter headers", len(imported))
+		return nil
+	}
+
+	log.Infof("Imported %d headers from snapshot", lastNode.height-
+		int32(tipHeight))
+
+	// Now that the chain has moved forward, the header sync state needs to
+	// start from the new tip.
+	b.nextCheckpoint = b.findNextHeaderCheckpoint(lastNode.height)
+	b.resetHeaderState(lastNode.header, lastNode.height)
+	return nil
+}
+
+// checkSnapshotFilterCheckpoint returns an error if the filter headers in the
+// record don't match a filter header checkpoint for its block.
+func checkSnapshotFilterCheckpoint(s *ChainService,
+	record *snapshotRecord) error {
+
+	blockHash := record.header.BlockHash()
+	if record.basicHeader != nil {
+		err := s.checkFilterHeaderCheckpoint(blockHash,
+			*record.basicHeader, BasicFilter)
+		if err != nil {
+			return err
+		}
+	}
+	if record.extHeader != nil {
+		err := s.checkFilterHeaderCheckpoint(blockHash,
+			*record.extHeader, ExtFilter)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifySnapshotChecksum reads the rest of the records after the one at
+// stopHeight and checks the checksum at the end of the snapshot against the
+// running checksum of everything read so far.
+func verifySnapshotChecksum(r io.Reader, hdr *snapshotHeader,
+	stopHeight uint32, checksum hash.Hash) error {
+
+	lastHeight := hdr.startHeight + hdr.numHeaders - 1
+	remaining := int64(lastHeight-stopHeight) * hdr.recordSize()
+	if _, err := io.CopyN(ioutil.Discard, r, remaining); err != nil {
+		return fmt.Errorf("unable to read snapshot records after "+
+			"height %d: %s", stopHeight, err)
+	}
+
+	// The checksum doesn't cover itself, so we take the sum before
+	// reading it.
+	expected := checksum.Sum(nil)
+	var sum [sha256.Size]byte
+	if _, err := io.ReadFull(r, sum[:]); err != nil {
+		return fmt.Errorf("unable to read snapshot checksum: %s", err)
+	}
+	if !bytes.Equal(sum[:], expected) {
+		return fmt.Errorf("snapshot checksum %x doesn't match "+
+			"contents %x", sum, expected)
+	}
+	return nil
+}
+
+// snapshotBatch collects the block headers and filter headers read from a
+// snapshot so they can be written to the database in a single transaction.
+type snapshotBatch struct {
+	nodes        []*headerNode
+	basicHeaders map[chainhash.Hash]chainhash.Hash
+	extHeaders   map[chainhash.Hash]chainhash.Hash
+
+	// filterHashes holds the hashes of the blocks for which the batch
+	// writes filter headers.
+	filterHashes []chainhash.Hash
+}
+
+// newSnapshotBatch returns an empty snapshot batch.
+func newSnapshotBatch() *snapshotBatch {
+	return &snapshotBatch{
+		nodes:        make([]*headerNode, 0, snapshotBatchSize),
+		basicHeaders: make(map[chainhash.Hash]chainhash.Hash),
+		extHeaders:   make(map[chainhash.Hash]chainhash.Hash),
+	}
+}
+
+// len returns the number of records in the batch.
+func (sb *snapshotBatch) len() int {
+	return len(sb.nodes) + len(sb.filterHashes)
+}
+
+// addNode adds a new block header to the batch, along with the filter
+// headers in its record.
+func (sb *snapshotBatch) addNode(node *headerNode, record *snapshotRecord) {
+	sb.nodes = append(sb.nodes, node)
+	sb.addFilterHeaders(node.header.BlockHash(), record.basicHeader,
+		record.extHeader)
+}
+
+// addKnown adds the filter headers in the record for a block we already have
+// to the batch, unless we have them too, in which case they must match. Any
+// error other than not finding a filter header is returned, as we can't tell
+// whether the snapshot conflicts with us.
+func (sb *snapshotBatch) addKnown(s *ChainService,
+	record *snapshotRecord) error {
+
+	blockHash := record.header.BlockHash()
+	var basicHeader, extHeader *chainhash.Hash
+	if record.basicHeader != nil {
+		known, err := s.GetFilterHeader(blockHash, BasicFilter)
+		switch {
+		case err == ErrFilterHeaderNotFound:
+			basicHeader = record.basicHeader
+		case err != nil:
+			return err
+		case *known != *record.basicHeader:
+			return fmt.Errorf("snapshot basic filter header %s "+
+				"for block %s conflicts with stored header %s",
+				record.basicHeader, blockHash, known)
+		}
+	}
+	if record.extHeader != nil {
+		known, err := s.GetFilterHeader(blockHash, ExtFilter)
+		switch {
+		case err == ErrFilterHeaderNotFound:
+			extHeader = record.extHeader
+		case err != nil:
+			return err
+		case *known != *record.extHeader:
+			return fmt.Errorf("snapshot extended filter header "+
+				"%s for block %s conflicts with stored header "+
+				"%s", record.extHeader, blockHash, known)
+		}
+	}
+	sb.addFilterHeaders(blockHash, basicHeader, extHeader)
+	return nil
+}
+
+// addFilterHeaders adds the passed filter headers for a block to the batch.
+// Either may be nil.
+func (sb *snapshotBatch) addFilterHeaders(blockHash chainhash.Hash,
+	basicHeader, extHeader *chainhash.Hash) {
+
+	if basicHeader == nil && extHeader == nil {
+		return
+	}
+	if basicHeader != nil {
+		sb.basicHeaders[blockHash] = *basicHeader
+	}
+	if extHeader != nil {
+		sb.extHeaders[blockHash] = *extHeader
+	}
+	sb.filterHashes = append(sb.filterHashes, blockHash)
+}
+
+// write writes everything in the batch to the header store, with the filter
+// headers going into the same database transaction as the block headers.
+func (sb *snapshotBatch) write(s *ChainService) error {
+	return s.headers.writeHeaders(sb.nodes, sb.putFilterHeaders())
+}
+
+// putFilterHeaders returns a database update that writes the filter headers
+// in the batch.
+func (sb *snapshotBatch) putFilterHeaders() dbUpdateOption {
+	return func(bucket walletdb.ReadWriteBucket) error {
+		for blockHash, filterHeader := range sb.basicHeaders {
+			err := putFilterHeader(blockHash, BasicFilter,
+				filterHeader)(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		for blockHash, filterHeader := range sb.extHeaders {
+			err := putFilterHeader(blockHash, ExtFilter,
+				filterHeader)(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,247 @@
+package neutrino
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcwallet/walletdb"
+)
+
+// newTestChainService creates a chain service for the regression test network
+// with its data in a temporary directory. The service isn't started. The
+// returned function stops it and removes its data.
+func newTestChainService(t *testing.T) (*ChainService, func()) {
+	t.Helper()
+
+	db, dir, cleanup := newTestDB(t)
+	s, err := NewChainService(Config{
+		DataDir:     dir,
+		Database:    db,
+		ChainParams: chaincfg.RegressionNetParams,
+	})
+	if err != nil {
+		cleanup()
+		t.Fatalf("unable to create chain service: %s", err)
+	}
+	return s, func() {
+		s.Stop()
+		cleanup()
+	}
+}
+
+// mineTestHeaders returns num headers that build on prev, which is at the
+// passed height, each with enough proof of work for the regression test
+// network.
+func mineTestHeaders(prev *wire.BlockHeader, height int32,
+	num int) []*headerNode {
+
+	return mineSeededTestHeaders(prev, height, num, 0)
+}
+
+// mineSeededTestHeaders is like mineTestHeaders, but starts mining each
+// header at the passed nonce, so headers mined with different seeds on the
+// same parent differ.
+func mineSeededTestHeaders(prev *wire.BlockHeader, height int32, num int,
+	seed uint32) []*headerNode {
+
+	target := blockchain.CompactToBig(prev.Bits)
+	nodes := makeTestHeaders(prev, height, num, seed)
+	for i, node := range nodes {
+		if i > 0 {
+			node.header.PrevBlock = nodes[i-1].header.BlockHash()
+		}
+		node.header.Version = 4
+		for {
+			blockHash := node.header.BlockHash()
+			if blockchain.HashToBig(&blockHash).Cmp(target) <= 0 {
+				break
+			}
+			node.header.Nonce++
+		}
+	}
+	return nodes
+}
+
+// testFilterHeader returns the made-up filter header of the passed type that
+// the snapshot tests use for the block at the passed height.
+func testFilterHeader(height int32, filterType *FilterType) chainhash.Hash {
+	return chainhash.DoubleHashH([]byte(filterType.String() +
+		string(uint32ToBytes(uint32(height)))))
+}
+
+// TestSnapshotRoundTrip checks that a snapshot exported by one chain service
+// can be imported by another, and that snapshots that have been tampered with
+// or don't end at the expected block are rejected without changing the chain.
+func TestSnapshotRoundTrip(t *testing.T) {
+	const numHeaders = 20
+
+	src, cleanup := newTestChainService(t)
+	defer cleanup()
+
+	nodes := mineTestHeaders(testGenesis, 0, numHeaders)
+	putFilterHeaders := func(bucket walletdb.ReadWriteBucket) error {
+		for _, node := range nodes {
+			for _, filterType := range filterTypes {
+				err := putFilterHeader(node.header.BlockHash(),
+					filterType, testFilterHeader(
+						node.height, filterType))(bucket)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	err := src.headers.writeHeaders(nodes, putFilterHeaders)
+	if err != nil {
+		t.Fatalf("unable to write headers: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err = src.ExportSnapshot(&buf, 0, numHeaders); err != nil {
+		t.Fatalf("unable to export snapshot: %s", err)
+	}
+	snapshot := buf.Bytes()
+
+	// The snapshot header is followed by a record for every block,
+	// starting with the genesis block, each holding a block header and
+	// both filter headers.
+	hdr := &snapshotHeader{
+		flags: snapshotBasicFilterHeaders | snapshotExtFilterHeaders,
+	}
+	recordOffset := func(height int) int {
+		return 24 + height*int(hdr.recordSize())
+	}
+	if len(snapshot) != recordOffset(numHeaders+1)+chainhash.HashSize {
+		t.Fatalf("snapshot is %d bytes, want %d", len(snapshot),
+			recordOffset(numHeaders+1)+chainhash.HashSize)
+	}
+
+	tests := []struct {
+		name       string
+		stopHeight int32
+
+		// corrupt is the offset of a byte to flip in the snapshot, or
+		// -1 to leave it as it is.
+		corrupt int
+
+		// wrongHash makes the import expect another block at the stop
+		// height.
+		wrongHash bool
+
+		valid bool
+	}{
+		{
+			name:       "whole snapshot",
+			stopHeight: numHeaders,
+			corrupt:    -1,
+			valid:      true,
+		},
+		{
+			name:       "stop early",
+			stopHeight: numHeaders / 2,
+			corrupt:    -1,
+			valid:      true,
+		},
+		{
+			name:       "corrupt filter header",
+			stopHeight: numHeaders,
+			corrupt: recordOffset(5) + wire.MaxBlockHeaderPayload +
+				3,
+		},
+		{
+			name:       "corrupt record after stop height",
+			stopHeight: numHeaders / 2,
+			corrupt: recordOffset(numHeaders) +
+				wire.MaxBlockHeaderPayload + chainhash.HashSize,
+		},
+		{
+			name:       "corrupt checksum",
+			stopHeight: numHeaders,
+			corrupt:    len(snapshot) - 1,
+		},
+		{
+			name:       "wrong stop hash",
+			stopHeight: numHeaders,
+			corrupt:    -1,
+			wrongHash:  true,
+		},
+	}
+
+	for _, test := range tests {
+		dst, cleanup := newTestChainService(t)
+
+		raw := append([]byte(nil), snapshot...)
+		if test.corrupt >= 0 {
+			raw[test.corrupt] ^= 1
+		}
+		stopHash := nodes[test.stopHeight-1].header.BlockHash()
+		if test.wrongHash {
+			stopHash = nodes[test.stopHeight-2].header.BlockHash()
+		}
+		err = dst.ImportHeaders(bytes.NewReader(raw),
+			uint32(test.stopHeight), stopHash)
+		if test.valid && err != nil {
+			t.Errorf("%s: unable to import snapshot: %s",
+				test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: imported invalid snapshot", test.name)
+		}
+
+		// A rejected snapshot must leave the chain at the genesis
+		// block.
+		tipHeight := test.stopHeight
+		if !test.valid {
+			tipHeight = 0
+		}
+		_, gotHeight, err := dst.LatestBlock()
+		if err != nil {
+			t.Fatalf("%s: unable to get tip: %s", test.name, err)
+		}
+		if gotHeight != uint32(tipHeight) {
+			t.Errorf("%s: tip at height %d, want %d", test.name,
+				gotHeight, tipHeight)
+		}
+
+		for _, node := range nodes {
+			blockHash := node.header.BlockHash()
+			for _, filterType := range filterTypes {
+				filterHeader, err := dst.GetFilterHeader(
+					blockHash, filterType)
+				if node.height > tipHeight {
+					if err != ErrFilterHeaderNotFound {
+						t.Errorf("%s: got %s filter "+
+							"header for block %d "+
+							"past the tip: %v",
+							test.name, filterType,
+							node.height, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("%s: unable to get %s filter "+
+						"header for block %d: %s",
+						test.name, filterType,
+						node.height, err)
+					continue
+				}
+				want := testFilterHeader(node.height,
+					filterType)
+				if *filterHeader != want {
+					t.Errorf("%s: %s filter header for "+
+						"block %d is %s, want %s",
+						test.name, filterType,
+						node.height, filterHeader,
+						want)
+				}
+			}
+		}
+
+		cleanup()
+	}
+}
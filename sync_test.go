@@ -353,7 +353,6 @@ func TestSetup(t *testing.T) {
 
 	neutrino.MaxPeers = 3
 	neutrino.BanDuration = 5 * time.Second
-	neutrino.WaitForMoreCFHeaders = time.Second
 	svc, err := neutrino.NewChainService(config)
 	if err != nil {
 		t.Fatalf("Error creating ChainService: %s", err)
@@ -871,8 +870,10 @@ func waitForSync(t *testing.T, svc *neutrino.ChainService,
 			return fmt.Errorf("Timed out after %v waiting for "+
 				"cfheaders synchronization.", syncTimeout)
 		}
-		haveBasicHeader, _ = svc.GetBasicHeader(*knownBestHash)
-		haveExtHeader, _ = svc.GetExtHeader(*knownBestHash)
+		haveBasicHeader, _ = svc.GetFilterHeader(*knownBestHash,
+			neutrino.BasicFilter)
+		haveExtHeader, _ = svc.GetFilterHeader(*knownBestHash,
+			neutrino.ExtFilter)
 		time.Sleep(syncUpdate)
 		total += syncUpdate
 	}
@@ -892,12 +893,14 @@ func waitForSync(t *testing.T, svc *neutrino.ChainService,
 				"height: %s", err)
 		}
 		hash := head.BlockHash()
-		haveBasicHeader, err = svc.GetBasicHeader(hash)
+		haveBasicHeader, err = svc.GetFilterHeader(hash,
+			neutrino.BasicFilter)
 		if err != nil {
 			return fmt.Errorf("Couldn't get basic header "+
 				"for %d (%s) from DB", i, hash)
 		}
-		haveExtHeader, err = svc.GetExtHeader(hash)
+		haveExtHeader, err = svc.GetFilterHeader(hash,
+			neutrino.ExtFilter)
 		if err != nil {
 			return fmt.Errorf("Couldn't get extended "+
 				"header for %d (%s) from DB", i, hash)
@@ -1049,8 +1052,8 @@ func testRandomBlocks(t *testing.T, svc *neutrino.ChainService,
 				return
 			}
 			// Get basic cfilter from network.
-			haveFilter, err := svc.GetCFilter(blockHash, false,
-				queryOptions...)
+			haveFilter, err := svc.GetCFilter(blockHash,
+				neutrino.BasicFilter, queryOptions...)
 			if err != nil {
 				errChan <- err
 				return
@@ -1093,8 +1096,8 @@ func testRandomBlocks(t *testing.T, svc *neutrino.ChainService,
 				return
 			}
 			// Get previous basic filter header from the database.
-			prevHeader, err := svc.GetBasicHeader(
-				blockHeader.PrevBlock)
+			prevHeader, err := svc.GetFilterHeader(
+				blockHeader.PrevBlock, neutrino.BasicFilter)
 			if err != nil {
 				errChan <- fmt.Errorf("Couldn't get basic "+
 					"filter header for block %d (%s) from "+
@@ -1103,7 +1106,8 @@ func testRandomBlocks(t *testing.T, svc *neutrino.ChainService,
 				return
 			}
 			// Get current basic filter header from the database.
-			curHeader, err := svc.GetBasicHeader(blockHash)
+			curHeader, err := svc.GetFilterHeader(blockHash,
+				neutrino.BasicFilter)
 			if err != nil {
 				errChan <- fmt.Errorf("Couldn't get basic "+
 					"filter header for block %d (%s) from "+
@@ -1120,8 +1124,8 @@ func testRandomBlocks(t *testing.T, svc *neutrino.ChainService,
 				return
 			}
 			// Get extended cfilter from network
-			haveFilter, err = svc.GetCFilter(blockHash, true,
-				queryOptions...)
+			haveFilter, err = svc.GetCFilter(blockHash,
+				neutrino.ExtFilter, queryOptions...)
 			if err != nil {
 				errChan <- err
 				return
@@ -1164,8 +1168,8 @@ func testRandomBlocks(t *testing.T, svc *neutrino.ChainService,
 			}
 			// Get previous extended filter header from the
 			// database.
-			prevHeader, err = svc.GetExtHeader(
-				blockHeader.PrevBlock)
+			prevHeader, err = svc.GetFilterHeader(
+				blockHeader.PrevBlock, neutrino.ExtFilter)
 			if err != nil {
 				errChan <- fmt.Errorf("Couldn't get extended "+
 					"filter header for block %d (%s) from "+
@@ -1174,7 +1178,8 @@ func testRandomBlocks(t *testing.T, svc *neutrino.ChainService,
 				return
 			}
 			// Get current basic filter header from the database.
-			curHeader, err = svc.GetExtHeader(blockHash)
+			curHeader, err = svc.GetFilterHeader(blockHash,
+				neutrino.ExtFilter)
 			if err != nil {
 				errChan <- fmt.Errorf("Couldn't get extended "+
 					"filter header for block %d (%s) from "+
@@ -0,0 +1,257 @@
+// NOTE: THIS API IS UNSTABLE RIGHT NOW.
+
+package neutrino
+
+import (
+	"container/list"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/addrmgr"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	// syncPeerCheckInterval is how often the block manager checks whether
+	// the sync peer has stalled.
+	syncPeerCheckInterval = 5 * time.Second
+
+	// headerLatencyWeight is the weight given to the newest sample in the
+	// exponentially weighted moving average of a peer's header response
+	// latency.
+	headerLatencyWeight = 0.2
+
+	// The following weights are used to combine the properties of a peer
+	// into a single score when choosing a sync peer. The peer with the
+	// highest score is chosen.
+	//
+	// syncScoreHeightWeight is subtracted for each block the peer is
+	// behind the best advertised height.
+	syncScoreHeightWeight = 1.0
+
+	// syncScoreLatencyWeight is subtracted for each second the peer takes
+	// to respond to a getheaders message on average.
+	syncScoreLatencyWeight = 10.0
+
+	// syncScoreBanWeight is subtracted for each point of the peer's ban
+	// score.
+	syncScoreBanWeight = 0.5
+
+	// syncScoreGroupWeight is subtracted for each other candidate peer in
+	// the same network group, so that we don't keep syncing from a
+	// cluster of peers run by the same party.
+	syncScoreGroupWeight = 5.0
+
+	// undeliveredHeightBanScore is the transient ban score given to a sync
+	// peer that has no more headers for us while advertising a height
+	// above our tip.
+	undeliveredHeightBanScore = 10
+)
+
+var (
+	// SyncPeerStallTimeout is how long the sync peer may go without
+	// sending us any headers while we're behind the height it advertises
+	// before we replace it with another candidate.
+	SyncPeerStallTimeout = 30 * time.Second
+)
+
+// headerRequest is a getheaders message we've sent a peer and are waiting for
+// the answer to.
+type headerRequest struct {
+	sent    time.Time
+	locator map[chainhash.Hash]struct{}
+}
+
+// answeredBy returns whether the passed headers are the answer to the
+// request. A peer answers with the headers following the first block in our
+// locator that it knows, or with none at all, whereas headers it announces
+// on its own follow its previous tip, which needn't be in our locator.
+func (r *headerRequest) answeredBy(headers []*wire.BlockHeader) bool {
+	if len(headers) == 0 {
+		return true
+	}
+	_, ok := r.locator[headers[0].PrevBlock]
+	return ok
+}
+
+// PushGetHeadersMsg sends a getheaders message to the peer and notes when it
+// was sent, so we can measure how long the peer takes to respond. It shadows
+// the method of the embedded peer.
+func (sp *serverPeer) PushGetHeadersMsg(locator blockchain.BlockLocator,
+	stopHash *chainhash.Hash) error {
+
+	// Only the oldest outstanding request counts, as the peer answers
+	// them in order.
+	sp.headerRequestMtx.Lock()
+	if sp.headerRequest == nil {
+		req := &headerRequest{
+			sent:    time.Now(),
+			locator: make(map[chainhash.Hash]struct{}),
+		}
+		for _, blockHash := range locator {
+			req.locator[*blockHash] = struct{}{}
+		}
+		sp.headerRequest = req
+	}
+	sp.headerRequestMtx.Unlock()
+
+	return sp.Peer.PushGetHeadersMsg(locator, stopHash)
+}
+
+// headersReceived updates the peer's header response latency after it has
+// sent us a headers message. Headers that don't answer our outstanding
+// request, if any, are ignored.
+func (sp *serverPeer) headersReceived(headers []*wire.BlockHeader) {
+	sp.headerRequestMtx.Lock()
+	req := sp.headerRequest
+	if req == nil || !req.answeredBy(headers) {
+		sp.headerRequestMtx.Unlock()
+		return
+	}
+	sp.headerRequest = nil
+	sp.headerRequestMtx.Unlock()
+
+	latency := int64(time.Since(req.sent))
+	old := atomic.LoadInt64(&sp.headerLatency)
+	if old != 0 {
+		latency = int64(headerLatencyWeight*float64(latency) +
+			(1-headerLatencyWeight)*float64(old))
+	}
+	atomic.StoreInt64(&sp.headerLatency, latency)
+}
+
+// headerResponseLatency returns the average time the peer takes to respond to
+// a getheaders message, or 0 if we haven't measured it yet.
+func (sp *serverPeer) headerResponseLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&sp.headerLatency))
+}
+
+// netGroup returns the network group of the peer's address, or an empty
+// string if its address isn't known.
+func (sp *serverPeer) netGroup() string {
+	na := sp.NA()
+	if na == nil {
+		return ""
+	}
+	return addrmgr.GroupKey(na)
+}
+
+// syncPeerScore returns how suitable the peer is as a sync peer. Higher scores
+// are better. bestHeight is the best height advertised by any candidate and
+// groupPeers is the number of candidates in the peer's network group,
+// including the peer itself. defaultLatency is used for a peer whose header
+// response latency we haven't measured yet.
+func syncPeerScore(sp *serverPeer, bestHeight int32, groupPeers int,
+	defaultLatency time.Duration) float64 {
+
+	latency := sp.headerResponseLatency()
+	if latency == 0 {
+		latency = defaultLatency
+	}
+	score := -syncScoreHeightWeight * float64(bestHeight-sp.LastBlock())
+	score -= syncScoreLatencyWeight * latency.Seconds()
+	score -= syncScoreBanWeight * float64(sp.banScore.Int())
+	score -= syncScoreGroupWeight * float64(groupPeers-1)
+	return score
+}
+
+// bestSyncPeer returns the candidate peer with the highest sync peer score, or
+// nil if there are no candidates.
+func bestSyncPeer(peers *list.List) *serverPeer {
+	var (
+		bestHeight int32
+		latencies  []time.Duration
+	)
+	groups := make(map[string]int)
+	for e := peers.Front(); e != nil; e = e.Next() {
+		sp := e.Value.(*serverPeer)
+		if sp.LastBlock() > bestHeight {
+			bestHeight = sp.LastBlock()
+		}
+		groups[sp.netGroup()]++
+		if latency := sp.headerResponseLatency(); latency != 0 {
+			latencies = append(latencies, latency)
+		}
+	}
+
+	// Peers we haven't measured yet are taken to be as fast as the median
+	// of the ones we have, so that they're neither preferred over nor
+	// ruled out by the ones we know to be fast.
+	var defaultLatency time.Duration
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool {
+			return latencies[i] < latencies[j]
+		})
+		defaultLatency = latencies[len(latencies)/2]
+	}
+
+	var bestPeer *serverPeer
+	var bestScore float64
+	for e := peers.Front(); e != nil; e = e.Next() {
+		sp := e.Value.(*serverPeer)
+		score := syncPeerScore(sp, bestHeight, groups[sp.netGroup()],
+			defaultLatency)
+		if bestPeer == nil || score > bestScore {
+			bestPeer, bestScore = sp, score
+		}
+	}
+	return bestPeer
+}
+
+// checkSyncPeer replaces the sync peer if it hasn't sent us any headers for
+// SyncPeerStallTimeout while we're behind the height it advertises. It must
+// be called from the block handler goroutine.
+func (b *blockManager) checkSyncPeer(peers *list.List) {
+	// The parallel header fetcher has its own timeouts and reassigns the
+	// ranges of peers that don't deliver.
+	if b.syncPeer == nil || b.headerFetcher != nil {
+		return
+	}
+	if time.Since(b.syncPeerProgress) < SyncPeerStallTimeout {
+		return
+	}
+	_, height, err := b.server.LatestBlock()
+	if err != nil {
+		log.Errorf("Failed to get latest block: %s", err)
+		return
+	}
+	if int32(height) >= b.syncPeer.LastBlock() {
+		return
+	}
+	b.replaceSyncPeer(peers, "no headers received in "+
+		SyncPeerStallTimeout.String())
+}
+
+// replaceSyncPeer drops the current sync peer as a sync candidate for the
+// passed reason and starts syncing from the best remaining candidate. If
+// there's no other candidate, we keep the peer and ask it for headers again.
+// It must be called from the block handler goroutine.
+func (b *blockManager) replaceSyncPeer(peers *list.List, reason string) {
+	sp := b.syncPeer
+	if peers.Len() > 1 {
+		log.Warnf("Replacing sync peer %s: %s", sp, reason)
+		for e := peers.Front(); e != nil; e = e.Next() {
+			if e.Value == sp {
+				peers.Remove(e)
+				break
+			}
+		}
+	} else {
+		log.Warnf("Not replacing sync peer %s (%s): no other peer "+
+			"to sync from", sp, reason)
+	}
+
+	b.syncPeerMutex.Lock()
+	b.syncPeer = nil
+	b.syncPeerMutex.Unlock()
+	header, height, err := b.server.LatestBlock()
+	if err != nil {
+		log.Errorf("Failed to get latest block: %s", err)
+		return
+	}
+	b.resetHeaderState(&header, int32(height))
+	b.startSync(peers)
+}
@@ -0,0 +1,239 @@
+package neutrino
+
+import (
+	"container/list"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/peer"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// TestHeadersReceived checks that only headers that answer the outstanding
+// getheaders request are used to measure a peer's header response latency.
+func TestHeadersReceived(t *testing.T) {
+	locator := []chainhash.Hash{{1}, {2}}
+
+	tests := []struct {
+		name string
+
+		// noRequest is whether no request is outstanding.
+		noRequest bool
+
+		// headers is the headers the peer sends, given by the previous
+		// block of each.
+		headers []chainhash.Hash
+
+		// answered is whether the headers should be taken as the answer
+		// to the request.
+		answered bool
+	}{
+		{
+			name:     "no headers",
+			answered: true,
+		},
+		{
+			name:     "headers after the tip",
+			headers:  []chainhash.Hash{{1}},
+			answered: true,
+		},
+		{
+			name:     "headers after a fork point",
+			headers:  []chainhash.Hash{{2}, {3}},
+			answered: true,
+		},
+		{
+			name:    "announcement",
+			headers: []chainhash.Hash{{4}},
+		},
+		{
+			name:      "unsolicited",
+			noRequest: true,
+			headers:   []chainhash.Hash{{1}},
+		},
+	}
+
+	for _, test := range tests {
+		sp := &serverPeer{}
+		var req *headerRequest
+		if !test.noRequest {
+			req = &headerRequest{
+				sent:    time.Now().Add(-time.Second),
+				locator: make(map[chainhash.Hash]struct{}),
+			}
+			for _, blockHash := range locator {
+				req.locator[blockHash] = struct{}{}
+			}
+			sp.headerRequest = req
+		}
+
+		var headers []*wire.BlockHeader
+		for _, prevBlock := range test.headers {
+			headers = append(headers, &wire.BlockHeader{
+				PrevBlock: prevBlock,
+			})
+		}
+		sp.headersReceived(headers)
+
+		latency := sp.headerResponseLatency()
+		if test.answered {
+			if sp.headerRequest != nil {
+				t.Errorf("%s: request is still outstanding",
+					test.name)
+			}
+			if latency < time.Second {
+				t.Errorf("%s: latency is %v, want at least 1s",
+					test.name, latency)
+			}
+			continue
+		}
+		if sp.headerRequest != req {
+			t.Errorf("%s: outstanding request changed", test.name)
+		}
+		if latency != 0 {
+			t.Errorf("%s: latency is %v, want unmeasured",
+				test.name, latency)
+		}
+	}
+}
+
+// TestBestSyncPeer checks that the sync peer is chosen by height, header
+// response latency, ban score and network group, and that peers whose
+// latency hasn't been measured yet are neither preferred nor ruled out.
+func TestBestSyncPeer(t *testing.T) {
+	type candidate struct {
+		addr     string
+		height   int32
+		latency  time.Duration
+		banScore uint32
+	}
+
+	tests := []struct {
+		name       string
+		candidates []candidate
+
+		// best is the index of the peer that should be chosen, or -1
+		// if none should be.
+		best int
+	}{
+		{
+			name: "no candidates",
+			best: -1,
+		},
+		{
+			name: "highest",
+			candidates: []candidate{
+				{addr: "1.2.3.4:8333", height: 90},
+				{addr: "8.8.8.8:8333", height: 100},
+			},
+			best: 1,
+		},
+		{
+			name: "faster behind by a block",
+			candidates: []candidate{
+				{
+					addr:    "1.2.3.4:8333",
+					height:  100,
+					latency: 2 * time.Second,
+				},
+				{
+					addr:    "8.8.8.8:8333",
+					height:  99,
+					latency: time.Second,
+				},
+			},
+			best: 1,
+		},
+		{
+			name: "unmeasured not preferred",
+			candidates: []candidate{
+				{addr: "4.4.4.4:8333", height: 100},
+				{
+					addr:    "1.2.3.4:8333",
+					height:  100,
+					latency: time.Second,
+				},
+				{
+					addr:    "8.8.8.8:8333",
+					height:  100,
+					latency: 2 * time.Second,
+				},
+				{
+					addr:    "9.9.9.9:8333",
+					height:  100,
+					latency: 3 * time.Second,
+				},
+			},
+			best: 1,
+		},
+		{
+			name: "unmeasured not ruled out",
+			candidates: []candidate{
+				{
+					addr:    "1.2.3.4:8333",
+					height:  100,
+					latency: 5 * time.Second,
+				},
+				{addr: "8.8.8.8:8333", height: 101},
+			},
+			best: 1,
+		},
+		{
+			name: "all unmeasured",
+			candidates: []candidate{
+				{addr: "1.2.3.4:8333", height: 101},
+				{addr: "8.8.8.8:8333", height: 100},
+			},
+			best: 0,
+		},
+		{
+			name: "ban score",
+			candidates: []candidate{
+				{
+					addr:     "1.2.3.4:8333",
+					height:   100,
+					banScore: 20,
+				},
+				{addr: "8.8.8.8:8333", height: 95},
+			},
+			best: 1,
+		},
+		{
+			name: "network group",
+			candidates: []candidate{
+				{addr: "1.2.3.4:8333", height: 100},
+				{addr: "1.2.5.6:8333", height: 100},
+				{addr: "8.8.8.8:8333", height: 99},
+			},
+			best: 2,
+		},
+	}
+
+	for _, test := range tests {
+		peers := list.New()
+		var sps []*serverPeer
+		for _, c := range test.candidates {
+			p, err := peer.NewOutboundPeer(&peer.Config{}, c.addr)
+			if err != nil {
+				t.Fatalf("%s: unable to create peer %s: %s",
+					test.name, c.addr, err)
+			}
+			p.UpdateLastBlockHeight(c.height)
+			sp := &serverPeer{Peer: p}
+			atomic.StoreInt64(&sp.headerLatency, int64(c.latency))
+			sp.banScore.Increase(c.banScore, 0)
+			peers.PushBack(sp)
+			sps = append(sps, sp)
+		}
+
+		var want *serverPeer
+		if test.best >= 0 {
+			want = sps[test.best]
+		}
+		if got := bestSyncPeer(peers); got != want {
+			t.Errorf("%s: chose %v, want %v", test.name, got, want)
+		}
+	}
+}
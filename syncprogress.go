@@ -0,0 +1,258 @@
+// NOTE: THIS API IS UNSTABLE RIGHT NOW.
+
+package neutrino
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// syncRateInterval is the minimum time between two samples of the
+	// sync rate used to estimate when the sync will complete.
+	syncRateInterval = time.Second
+
+	// syncRateWeight is the weight given to the newest sample in the
+	// exponentially weighted moving average of the sync rate.
+	syncRateWeight = 0.2
+)
+
+// SyncProgress describes how far the chain service has gotten in syncing the
+// block header chain and both filter header chains.
+type SyncProgress struct {
+	// HeaderHeight is the height of the tip of the block header chain.
+	HeaderHeight int32
+
+	// BasicFilterHeaderHeight and ExtFilterHeaderHeight are the heights
+	// up to which the basic and extended filter headers have been
+	// synced.
+	BasicFilterHeaderHeight int32
+	ExtFilterHeaderHeight   int32
+
+	// BestPeerHeight is the highest block height advertised by any of the
+	// peers we can sync from.
+	BestPeerHeight int32
+
+	// SyncPeer is the address of the peer we're syncing from, or empty if
+	// we don't have one.
+	SyncPeer string
+
+	// Current is true if we believe we're synced with our peers.
+	Current bool
+
+	// EstimatedCompletion is when we expect the header and filter header
+	// chains to have caught up with BestPeerHeight, based on the rate at
+	// which they've been syncing. It's the zero time if there's nothing
+	// left to sync or we don't have an estimate yet.
+	EstimatedCompletion time.Time
+}
+
+// syncProgressMsg is a message type to be sent across the message channel for
+// requesting the current sync progress from the block manager.
+type syncProgressMsg struct {
+	reply chan SyncProgress
+}
+
+// syncRateEstimator estimates how fast we're syncing in headers and filter
+// headers per second.
+type syncRateEstimator struct {
+	lastSample time.Time
+	lastDone   int64
+	rate       float64
+}
+
+// sample records the total number of headers and filter headers synced so far
+// and returns the estimated rate. Samples taken less than syncRateInterval
+// apart from the previous one are ignored.
+func (e *syncRateEstimator) sample(done int64, now time.Time) float64 {
+	switch {
+	case e.lastSample.IsZero():
+		e.lastSample, e.lastDone = now, done
+		return e.rate
+
+	case now.Sub(e.lastSample) < syncRateInterval:
+		return e.rate
+	}
+
+	// A reorg can take us backwards, in which case we just start over
+	// from where we are now.
+	if done < e.lastDone {
+		e.lastSample, e.lastDone = now, done
+		return e.rate
+	}
+
+	rate := float64(done-e.lastDone) / now.Sub(e.lastSample).Seconds()
+	if e.rate == 0 {
+		e.rate = rate
+	} else {
+		e.rate = syncRateWeight*rate + (1-syncRateWeight)*e.rate
+	}
+	e.lastSample, e.lastDone = now, done
+	return e.rate
+}
+
+// syncProgressSubscriptions holds the channels on which sync progress updates
+// are sent.
+type syncProgressSubscriptions struct {
+	mtx  sync.Mutex
+	subs map[chan SyncProgress]struct{}
+	last SyncProgress
+
+	// closed is set once the block manager has stopped, after which
+	// there won't be any more updates.
+	closed bool
+}
+
+// subscribe adds a new subscription and returns its channel. If there won't
+// be any more updates, the channel is closed right away.
+func (s *syncProgressSubscriptions) subscribe() chan SyncProgress {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	updates := make(chan SyncProgress, 1)
+	if s.closed {
+		close(updates)
+		return updates
+	}
+	if s.subs == nil {
+		s.subs = make(map[chan SyncProgress]struct{})
+	}
+	s.subs[updates] = struct{}{}
+	return updates
+}
+
+// unsubscribe removes a subscription and closes its channel.
+func (s *syncProgressSubscriptions) unsubscribe(updates chan SyncProgress) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, ok := s.subs[updates]; !ok {
+		return
+	}
+	delete(s.subs, updates)
+	close(updates)
+}
+
+// closeAll removes every subscription and closes its channel, and makes sure
+// later subscriptions are closed right away.
+func (s *syncProgressSubscriptions) closeAll() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for updates := range s.subs {
+		close(updates)
+	}
+	s.subs = nil
+	s.closed = true
+}
+
+// active returns whether there are any subscriptions.
+func (s *syncProgressSubscriptions) active() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return len(s.subs) != 0
+}
+
+// notify sends the passed progress to all subscribers if it's changed since
+// the last update. Sending never blocks: if a subscriber hasn't received the
+// previous update yet, it's replaced by the new one, since only the latest
+// progress is of any interest.
+func (s *syncProgressSubscriptions) notify(progress SyncProgress) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// The estimated completion moves with every sample, so it doesn't
+	// count as a change on its own.
+	unchanged := progress
+	unchanged.EstimatedCompletion = s.last.EstimatedCompletion
+	if unchanged == s.last {
+		return
+	}
+	s.last = progress
+
+	for updates := range s.subs {
+		select {
+		case <-updates:
+		default:
+		}
+		updates <- progress
+	}
+}
+
+// syncProgress returns the current sync progress. The passed list of
+// candidate peers is used to find the best peer height. It must be called
+// from the block handler goroutine.
+func (b *blockManager) syncProgress(peers *list.List) SyncProgress {
+	var progress SyncProgress
+	_, height, err := b.server.LatestBlock()
+	if err != nil {
+		log.Errorf("Failed to get latest block: %s", err)
+	}
+	progress.HeaderHeight = int32(height)
+	progress.BasicFilterHeaderHeight = b.lastCFHeaderHeight(BasicFilter)
+	progress.ExtFilterHeaderHeight = b.lastCFHeaderHeight(ExtFilter)
+
+	for e := peers.Front(); e != nil; e = e.Next() {
+		sp := e.Value.(*serverPeer)
+		if sp.LastBlock() > progress.BestPeerHeight {
+			progress.BestPeerHeight = sp.LastBlock()
+		}
+	}
+	if b.syncPeer != nil {
+		progress.SyncPeer = b.syncPeer.Addr()
+		if b.syncPeer.LastBlock() > progress.BestPeerHeight {
+			progress.BestPeerHeight = b.syncPeer.LastBlock()
+		}
+	}
+	progress.Current = b.current()
+
+	// We count the block headers and the filter headers of each type we
+	// sync towards the progress, as the sync isn't complete until all of
+	// the chains have caught up.
+	done := int64(progress.HeaderHeight)
+	for _, filterType := range b.server.syncedFilterTypes {
+		done += int64(b.lastCFHeaderHeight(filterType))
+	}
+	total := int64(len(b.server.syncedFilterTypes)+1) *
+		int64(progress.BestPeerHeight)
+	now := time.Now()
+	rate := b.syncRate.sample(done, now)
+	if total > done && rate > 0 {
+		remaining := float64(total-done) / rate
+		progress.EstimatedCompletion = now.Add(
+			time.Duration(remaining * float64(time.Second)))
+	}
+	return progress
+}
+
+// SyncProgress returns how far the chain service has gotten in syncing the
+// block header chain and the filter header chains.
+func (s *ChainService) SyncProgress() SyncProgress {
+	reply := make(chan SyncProgress, 1)
+	select {
+	case s.blockManager.peerChan <- syncProgressMsg{reply: reply}:
+	case <-s.blockManager.quit:
+		return SyncProgress{}
+	}
+	select {
+	case progress := <-reply:
+		return progress
+	case <-s.blockManager.quit:
+		return SyncProgress{}
+	}
+}
+
+// SubscribeSyncProgress returns a channel on which the sync progress is sent
+// whenever it changes, along with a function that cancels the subscription
+// and closes the channel. Updates are never queued up: a slow reader only
+// sees the latest progress. The channel is also closed once the chain service
+// is stopped, so it's safe to range over it.
+func (s *ChainService) SubscribeSyncProgress() (<-chan SyncProgress, func()) {
+	updates := s.blockManager.progressSubs.subscribe()
+	cancel := func() {
+		s.blockManager.progressSubs.unsubscribe(updates)
+	}
+	return updates, cancel
+}
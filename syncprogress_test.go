@@ -0,0 +1,203 @@
+package neutrino
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// TestSyncRateEstimator checks that the sync rate is a moving average of the
+// rate between samples, that samples taken too soon after the previous one
+// are ignored, and that the estimate starts over from a sample that goes
+// backwards.
+func TestSyncRateEstimator(t *testing.T) {
+	type sample struct {
+		done int64
+		at   time.Duration
+
+		// rate is the rate the sample should return.
+		rate float64
+	}
+
+	tests := []struct {
+		name    string
+		samples []sample
+	}{
+		{
+			name:    "first sample",
+			samples: []sample{{0, 0, 0}},
+		},
+		{
+			name: "steady rate",
+			samples: []sample{
+				{0, 0, 0},
+				{10, time.Second, 10},
+				{20, 2 * time.Second, 10},
+			},
+		},
+		{
+			name: "sample too soon",
+			samples: []sample{
+				{0, 0, 0},
+				{5, 500 * time.Millisecond, 0},
+				{20, 2 * time.Second, 10},
+			},
+		},
+		{
+			name: "moving average",
+			samples: []sample{
+				{0, 0, 0},
+				{10, time.Second, 10},
+				{30, 2 * time.Second, 12},
+			},
+		},
+		{
+			name: "going backwards",
+			samples: []sample{
+				{0, 0, 0},
+				{10, time.Second, 10},
+				{5, 2 * time.Second, 10},
+				{25, 3 * time.Second, 12},
+			},
+		},
+	}
+
+	start := time.Now()
+	for _, test := range tests {
+		var e syncRateEstimator
+		for i, s := range test.samples {
+			rate := e.sample(s.done, start.Add(s.at))
+			if math.Abs(rate-s.rate) > 1e-9 {
+				t.Errorf("%s: sample %d: rate is %v, want %v",
+					test.name, i, rate, s.rate)
+			}
+		}
+	}
+}
+
+// TestSyncProgressSubscriptions checks that subscribers only get the latest
+// progress, that progress that only differs in its estimated completion isn't
+// sent, and that subscriptions are closed by closeAll, as are those made after
+// it.
+func TestSyncProgressSubscriptions(t *testing.T) {
+	type step struct {
+		// op is "notify", "receive", "closeAll", "subscribe" or
+		// "closed".
+		op     string
+		height int32
+
+		// moved makes notify send a different estimated completion
+		// than the previous one.
+		moved bool
+
+		// found is whether receive should find an update.
+		found bool
+	}
+	notify := func(height int32) step {
+		return step{op: "notify", height: height}
+	}
+	receive := func(height int32, found bool) step {
+		return step{op: "receive", height: height, found: found}
+	}
+	closeAll := step{op: "closeAll"}
+	closed := step{op: "closed"}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "latest progress only",
+			steps: []step{
+				notify(1), notify(2), receive(2, true),
+				receive(0, false),
+			},
+		},
+		{
+			name: "unchanged progress",
+			steps: []step{
+				notify(1), receive(1, true),
+				{op: "notify", height: 1, moved: true},
+				receive(0, false), notify(2), receive(2, true),
+			},
+		},
+		{
+			name:  "close",
+			steps: []step{closeAll, closed},
+		},
+		{
+			name: "pending progress before close",
+			steps: []step{
+				notify(1), closeAll, receive(1, true), closed,
+			},
+		},
+		{
+			name: "subscribe after close",
+			steps: []step{
+				closeAll, {op: "subscribe"}, closed, notify(1),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		var subs syncProgressSubscriptions
+		updates := subs.subscribe()
+		estimate := time.Now()
+		for i, s := range test.steps {
+			switch s.op {
+			case "notify":
+				if s.moved {
+					estimate = estimate.Add(time.Second)
+				}
+				subs.notify(SyncProgress{
+					HeaderHeight:        s.height,
+					EstimatedCompletion: estimate,
+				})
+
+			case "receive":
+				var (
+					progress SyncProgress
+					found    bool
+				)
+				select {
+				case progress, found = <-updates:
+				default:
+				}
+				if found != s.found {
+					t.Errorf("%s: step %d: found update: "+
+						"%v, want %v", test.name, i,
+						found, s.found)
+				}
+				if found && progress.HeaderHeight != s.height {
+					t.Errorf("%s: step %d: got height %d, "+
+						"want %d", test.name, i,
+						progress.HeaderHeight, s.height)
+				}
+
+			case "closeAll":
+				subs.closeAll()
+				if subs.active() {
+					t.Errorf("%s: step %d: subscriptions "+
+						"left after closeAll",
+						test.name, i)
+				}
+
+			case "subscribe":
+				updates = subs.subscribe()
+
+			case "closed":
+				select {
+				case _, ok := <-updates:
+					if ok {
+						t.Errorf("%s: step %d: got an "+
+							"update, want closed",
+							test.name, i)
+					}
+				default:
+					t.Errorf("%s: step %d: subscription "+
+						"isn't closed", test.name, i)
+				}
+			}
+		}
+	}
+}